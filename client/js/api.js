@@ -2,9 +2,8 @@ const API_BASE = window.location.hostname === 'localhost'
   ? 'http://localhost:8080'
   : window.location.origin;
 
-async function request(method, path, body) {
+async function request(method, path, body, token = localStorage.getItem('token')) {
   const headers = { 'Content-Type': 'application/json' };
-  const token = localStorage.getItem('token');
   if (token) headers['Authorization'] = 'Bearer ' + token;
 
   const res = await fetch(API_BASE + path, {
@@ -18,17 +17,33 @@ async function request(method, path, body) {
   try { data = JSON.parse(text); } catch { data = text; }
 
   if (!res.ok) {
-    const msg = (data && data.error) ? data.error : `HTTP ${res.status}`;
+    let msg = (data && (data.detail || data.error)) || `HTTP ${res.status}`;
+    if (data && data.fields) {
+      msg += ': ' + Object.entries(data.fields).map(([k, v]) => `${k} ${v}`).join('; ');
+    }
     throw new Error(msg);
   }
   return data;
 }
 
 const api = {
-  register: (username, email, password, role) =>
-    request('POST', '/api/auth/register', { username, email, password, role }),
+  register: (username, email, password) =>
+    request('POST', '/api/auth/register', { username, email, password }),
   login: (email, password) =>
     request('POST', '/api/auth/login', { email, password }),
+  me: (token) => request('GET', '/api/me', undefined, token),
+  verifyMFA: (mfaToken, code, recoveryCode) =>
+    request('POST', '/api/auth/mfa', recoveryCode
+      ? { mfa_token: mfaToken, recovery_code: recoveryCode }
+      : { mfa_token: mfaToken, code }),
+  enrollTOTP: (mfaToken) => request('POST', '/api/me/mfa/totp', undefined, mfaToken),
+  verifyTOTP: (mfaToken, code) => request('POST', '/api/me/mfa/totp/verify', { code }, mfaToken),
+  requestPasswordReset: (email) =>
+    request('POST', '/api/auth/password-reset', { email }),
+  confirmPasswordReset: (token, newPassword) =>
+    request('POST', '/api/auth/password-reset/confirm', { token, new_password: newPassword }),
+
+  confirmEmail: (token) => request('POST', '/api/me/email/confirm', { token }),
 
   listUsers: () => request('GET', '/api/users'),
   updateRole: (id, role) => request('PUT', `/api/users/${id}/role`, { role }),
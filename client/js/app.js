@@ -6,6 +6,24 @@ function showPage(name) {
   });
 }
 
+function showMessage(title, text) {
+  document.getElementById('message-title').textContent = title;
+  document.getElementById('message-text').textContent = text;
+  showPage('message');
+}
+
+// start shows the view of the current hash route, or the app.
+function start() {
+  const route = currentRoute();
+  if (route) {
+    route.show(route.params);
+  } else if (loadSession()) {
+    showAppUI();
+  } else {
+    showAuthPage();
+  }
+}
+
 function escHtml(str) {
   if (!str) return '';
   return String(str)
@@ -45,9 +63,11 @@ document.addEventListener('DOMContentLoaded', () => {
   document.getElementById('filter-status').addEventListener('change', loadTickets);
   document.getElementById('filter-priority').addEventListener('change', loadTickets);
 
-  if (loadSession()) {
-    showAppUI();
-  } else {
-    showAuthPage();
-  }
+  document.getElementById('btn-message-continue').addEventListener('click', () => {
+    leaveRoute();
+    start();
+  });
+
+  window.addEventListener('hashchange', start);
+  start();
 });
@@ -1,5 +1,8 @@
 let currentUser = null;
 
+// The MFA challenge of a login that still needs a second factor.
+let mfaChallenge = null;
+
 function getUser() { return currentUser; }
 
 function setSession(token, user) {
@@ -55,6 +58,9 @@ function initAuth() {
 
   document.getElementById('btn-login').addEventListener('click', handleLogin);
   document.getElementById('btn-register').addEventListener('click', handleRegister);
+  document.getElementById('btn-forgot-password').addEventListener('click', handleForgotPassword);
+  document.getElementById('btn-reset-password').addEventListener('click', handleResetPassword);
+  document.getElementById('btn-mfa').addEventListener('click', handleMFA);
   document.getElementById('btn-logout').addEventListener('click', handleLogout);
 }
 
@@ -64,9 +70,7 @@ async function handleLogin() {
   const errEl = document.getElementById('auth-error');
   errEl.textContent = '';
   try {
-    const data = await api.login(email, password);
-    setSession(data.token, data.user);
-    showAppUI();
+    finishLogin(await api.login(email, password));
   } catch (e) {
     errEl.textContent = e.message;
   }
@@ -76,13 +80,102 @@ async function handleRegister() {
   const username = document.getElementById('reg-username').value.trim();
   const email = document.getElementById('reg-email').value.trim();
   const password = document.getElementById('reg-password').value;
-  const role = document.getElementById('reg-role').value;
   const errEl = document.getElementById('auth-error');
   errEl.textContent = '';
   try {
-    const data = await api.register(username, email, password, role);
-    setSession(data.token, data.user);
-    showAppUI();
+    finishLogin(await api.register(username, email, password));
+  } catch (e) {
+    errEl.textContent = e.message;
+  }
+}
+
+// finishLogin continues a login with its session, or with the second factor
+// if one is due.
+function finishLogin(data) {
+  if (data.mfa_token) {
+    showMFAStep(data);
+    return;
+  }
+  setSession(data.token, data.user);
+  start();
+}
+
+async function showMFAStep(challenge) {
+  mfaChallenge = challenge;
+  document.getElementById('nav').style.display = 'none';
+  document.getElementById('mfa-code').value = '';
+  const errEl = document.getElementById('mfa-error');
+  errEl.textContent = '';
+  const enroll = document.getElementById('mfa-enroll');
+  enroll.style.display = 'none';
+  showPage('mfa');
+
+  if (challenge.mfa_enrollment_required) {
+    try {
+      const data = await api.enrollTOTP(challenge.mfa_token);
+      document.getElementById('mfa-secret').value = data.secret;
+      document.getElementById('mfa-uri').href = data.provisioning_uri;
+      enroll.style.display = '';
+    } catch (e) {
+      errEl.textContent = e.message;
+    }
+  }
+}
+
+async function handleMFA() {
+  const code = document.getElementById('mfa-code').value.trim();
+  const errEl = document.getElementById('mfa-error');
+  errEl.textContent = '';
+  try {
+    if (mfaChallenge.mfa_enrollment_required) {
+      const data = await api.verifyTOTP(mfaChallenge.mfa_token, code);
+      setSession(data.token, data.user);
+      mfaChallenge = null;
+      showMessage('Двухфакторная аутентификация включена',
+        'Сохраните резервные коды, они показываются только один раз: ' + data.recovery_codes.join(', '));
+      return;
+    }
+    // Authenticator apps show six digits; anything else is a recovery code.
+    const data = /^\d{6}$/.test(code)
+      ? await api.verifyMFA(mfaChallenge.mfa_token, code)
+      : await api.verifyMFA(mfaChallenge.mfa_token, '', code);
+    mfaChallenge = null;
+    finishLogin(data);
+  } catch (e) {
+    errEl.textContent = e.message;
+  }
+}
+
+async function handleForgotPassword() {
+  const email = document.getElementById('login-email').value.trim();
+  const errEl = document.getElementById('auth-error');
+  errEl.textContent = '';
+  if (!email) {
+    errEl.textContent = 'Введите email, на который зарегистрирована учётная запись';
+    return;
+  }
+  try {
+    await api.requestPasswordReset(email);
+    showMessage('Проверьте почту', 'Если для ' + email + ' есть учётная запись, на него отправлена ссылка для сброса пароля.');
+  } catch (e) {
+    errEl.textContent = e.message;
+  }
+}
+
+async function handleResetPassword() {
+  const password = document.getElementById('reset-password').value;
+  const repeat = document.getElementById('reset-password-repeat').value;
+  const errEl = document.getElementById('reset-error');
+  errEl.textContent = '';
+  if (password !== repeat) {
+    errEl.textContent = 'Пароли не совпадают';
+    return;
+  }
+  const route = currentRoute();
+  try {
+    await api.confirmPasswordReset(route ? route.params.get('token') : '', password);
+    clearSession();
+    showMessage('Пароль изменён', 'Войдите с новым паролем.');
   } catch (e) {
     errEl.textContent = e.message;
   }
@@ -92,3 +185,66 @@ function handleLogout() {
   clearSession();
   showAuthPage();
 }
+
+// The link in the password reset mail.
+routes['reset-password'] = () => {
+  document.getElementById('nav').style.display = 'none';
+  document.getElementById('reset-error').textContent = '';
+  showPage('reset-password');
+};
+
+// The link in the confirmation mail for a changed email address. Confirming
+// needs a session, so the user logs in first if necessary.
+routes['verify-email'] = async (params) => {
+  if (!loadSession()) {
+    showAuthPage();
+    document.getElementById('auth-error').textContent = 'Войдите, чтобы подтвердить новый email';
+    return;
+  }
+  try {
+    const user = await api.confirmEmail(params.get('token'));
+    setSession(localStorage.getItem('token'), user);
+    showMessage('Email подтверждён', 'Теперь для входа используйте ' + user.email + '.');
+  } catch (e) {
+    showMessage('Не удалось подтвердить email', e.message);
+  }
+};
+
+const ssoErrors = {
+  sso_denied: 'Вход через SSO отменён',
+  sso_expired: 'Время на вход через SSO истекло, попробуйте ещё раз',
+  sso_state_mismatch: 'Вход через SSO начат в другом браузере, попробуйте ещё раз',
+  sso_email_unverified: 'Провайдер не подтвердил ваш email',
+  sso_account_exists: 'Учётная запись с этим email уже есть, войдите с паролем',
+  sso_failed: 'Не удалось войти через SSO',
+};
+
+// Where single sign-on returns to, with a session token or, when a second
+// factor is due, an MFA token.
+routes['oidc-callback'] = async (params) => {
+  leaveRoute();
+  const mfaToken = params.get('mfa_token');
+  if (mfaToken) {
+    showMFAStep({
+      mfa_token: mfaToken,
+      mfa_required: params.get('mfa') === 'required',
+      mfa_enrollment_required: params.get('mfa') === 'enroll',
+    });
+    return;
+  }
+  try {
+    const token = params.get('token');
+    setSession(token, await api.me(token));
+    showAppUI();
+  } catch (e) {
+    showAuthPage();
+    document.getElementById('auth-error').textContent = e.message;
+  }
+};
+
+// Where single sign-on returns to when it fails.
+routes['login'] = (params) => {
+  leaveRoute();
+  showAuthPage();
+  document.getElementById('auth-error').textContent = ssoErrors[params.get('error')] || ssoErrors.sso_failed;
+};
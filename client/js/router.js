@@ -0,0 +1,14 @@
+// Links in mails and redirects from the server open hash routes such as
+// #/verify-email?token=...; each view registers its handler here by name.
+const routes = {};
+
+function currentRoute() {
+  const m = window.location.hash.match(/^#\/([\w-]+)(?:\?(.*))?$/);
+  if (!m || !routes[m[1]]) return null;
+  return { show: routes[m[1]], params: new URLSearchParams(m[2] || '') };
+}
+
+// leaveRoute drops the hash, and any token in it, from the address bar.
+function leaveRoute() {
+  history.replaceState(null, '', window.location.pathname + window.location.search);
+}
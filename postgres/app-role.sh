@@ -0,0 +1,7 @@
+#!/bin/sh
+# Creates the role the server connects as when the database is first
+# initialised. Migration 015_app_role.sql grants it access to the schema.
+set -e
+psql -v ON_ERROR_STOP=1 --username "$POSTGRES_USER" --dbname "$POSTGRES_DB" <<EOSQL
+CREATE ROLE helpdesk_app LOGIN NOSUPERUSER NOBYPASSRLS PASSWORD '$APP_DB_PASSWORD';
+EOSQL
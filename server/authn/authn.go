@@ -0,0 +1,118 @@
+package authn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"helpdesk/server/models"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator checks a login name and password and returns the matching
+// local user. It returns ErrInvalidCredentials when the credentials are
+// wrong or the login is unknown to it.
+type Authenticator interface {
+	Authenticate(ctx context.Context, login, password string) (*models.User, error)
+}
+
+// Chain tries each authenticator in turn until one accepts the credentials.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, login, password string) (*models.User, error) {
+	for _, a := range c {
+		user, err := a.Authenticate(ctx, login, password)
+		if !errors.Is(err, ErrInvalidCredentials) {
+			return user, err
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// Local checks passwords against the bcrypt hashes in users.password_hash.
+type Local struct {
+	Users *models.UserStore
+}
+
+func (l *Local) Authenticate(ctx context.Context, login, password string) (*models.User, error) {
+	user, err := l.Users.GetByEmail(ctx, login)
+	if err != nil || user.PasswordHash == "" {
+		// Spend the same bcrypt time as for a real account so the response
+		// time does not tell whether the email exists.
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// Identity is a user as described by an external identity source.
+type Identity struct {
+	Subject  string
+	Email    string
+	Username string
+	Role     models.Role
+}
+
+// ErrLocalAccount is returned by SyncUser for an identity whose email belongs
+// to an account with a password.
+var ErrLocalAccount = errors.New("email belongs to an account with a password")
+
+// SyncUser finds the local account for identity, by subject first and then
+// by email, creating it on first login. When syncRole is set the local role
+// is overwritten with identity.Role.
+//
+// Accounts with a password are never linked by email: anyone can register
+// one for an address they do not own, and would keep their password once the
+// owner's identity is linked to it.
+func SyncUser(ctx context.Context, users *models.UserStore, identity *Identity, syncRole bool) (*models.User, error) {
+	user, err := users.GetByExternalSubject(ctx, identity.Subject)
+	if err != nil {
+		user, err = users.GetByEmail(ctx, identity.Email)
+		if err == nil && user.PasswordHash != "" {
+			return nil, ErrLocalAccount
+		}
+		if err == nil {
+			err = users.LinkExternalSubject(ctx, user.ID, identity.Subject)
+		} else {
+			user, err = createExternal(ctx, users, identity)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if syncRole && user.Role != identity.Role {
+		if err := users.UpdateRole(ctx, user.ID, user.Version, identity.Role); err != nil {
+			return nil, err
+		}
+		return users.GetByID(ctx, user.ID)
+	}
+	return user, nil
+}
+
+func createExternal(ctx context.Context, users *models.UserStore, identity *Identity) (*models.User, error) {
+	username := identity.Username
+	for n := 2; n <= 6; n++ {
+		user, err := users.CreateExternal(ctx, username, identity.Email, identity.Subject, identity.Role)
+		if !errors.Is(err, models.ErrUsernameTaken) {
+			return user, err
+		}
+		username = fmt.Sprintf("%s-%d", identity.Username, n)
+	}
+	return nil, models.ErrUsernameTaken
+}
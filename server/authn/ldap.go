@@ -0,0 +1,232 @@
+package authn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"helpdesk/server/config"
+	"helpdesk/server/models"
+)
+
+// LDAP authenticates against a directory: it looks the login up with
+// UserFilter, binds as the found DN with the given password and maps the
+// user's groups to a role. The local account is created or updated on every
+// successful login.
+type LDAP struct {
+	Users *models.UserStore
+
+	URL            string
+	StartTLS       bool
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string
+	EmailAttribute string
+	UserAttribute  string
+	GroupBaseDN    string
+	GroupFilter    string
+	AdminGroups    []string
+	OperatorGroups []string
+
+	// Timeout bounds the dial and every request to the directory, so a hung
+	// server cannot hold login requests indefinitely.
+	Timeout time.Duration
+}
+
+func NewLDAP(users *models.UserStore, cfg *config.Config) *LDAP {
+	return &LDAP{
+		Users:          users,
+		URL:            cfg.LDAPURL,
+		StartTLS:       cfg.LDAPStartTLS,
+		BindDN:         cfg.LDAPBindDN,
+		BindPassword:   cfg.LDAPBindPassword,
+		BaseDN:         cfg.LDAPBaseDN,
+		UserFilter:     cfg.LDAPUserFilter,
+		EmailAttribute: cfg.LDAPEmailAttribute,
+		UserAttribute:  cfg.LDAPUsernameAttribute,
+		GroupBaseDN:    cfg.LDAPGroupBaseDN,
+		GroupFilter:    cfg.LDAPGroupFilter,
+		AdminGroups:    cfg.LDAPAdminGroups,
+		OperatorGroups: cfg.LDAPOperatorGroups,
+		Timeout:        cfg.LDAPTimeout,
+	}
+}
+
+func (l *LDAP) Authenticate(ctx context.Context, login, password string) (*models.User, error) {
+	identity, err := l.lookup(ctx, login, password)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := SyncUser(ctx, l.Users, identity, true)
+	if errors.Is(err, ErrLocalAccount) {
+		// The directory vouches for the email, not for the local account
+		// that already owns it; that account keeps logging in with its own
+		// password.
+		slog.WarnContext(ctx, "ldap login matches a local account", "email", identity.Email)
+		return nil, ErrInvalidCredentials
+	}
+	return user, err
+}
+
+// lookup checks login and password against the directory and describes the
+// user it found.
+func (l *LDAP) lookup(ctx context.Context, login, password string) (*Identity, error) {
+	// An empty password would turn the user bind into an unauthenticated
+	// bind, which many servers accept.
+	if login == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	timeout := l.Timeout
+	if deadline, ok := ctx.Deadline(); ok && (timeout <= 0 || time.Until(deadline) < timeout) {
+		timeout = time.Until(deadline)
+	}
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, fmt.Errorf("ldap dial: %w", err)
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		conn.SetTimeout(timeout)
+	}
+	// Closing the connection fails the request in flight, so a cancelled
+	// login stops waiting for the directory.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	identity, err := l.query(conn, login, password)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return identity, err
+}
+
+func (l *LDAP) query(conn *ldap.Conn, login, password string) (*Identity, error) {
+	if l.StartTLS {
+		if err := conn.StartTLS(&tls.Config{ServerName: hostOf(l.URL)}); err != nil {
+			return nil, fmt.Errorf("ldap starttls: %w", err)
+		}
+	}
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap service bind: %w", err)
+		}
+	}
+
+	entry, err := l.findUser(conn, login)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap user bind: %w", err)
+	}
+
+	groups, err := l.groups(conn, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	email := entry.GetAttributeValue(l.EmailAttribute)
+	if email == "" {
+		return nil, fmt.Errorf("ldap entry %s has no %s attribute", entry.DN, l.EmailAttribute)
+	}
+	username := entry.GetAttributeValue(l.UserAttribute)
+	if username == "" {
+		username, _, _ = strings.Cut(email, "@")
+	}
+
+	return &Identity{
+		Subject:  "ldap:" + strings.ToLower(entry.DN),
+		Email:    email,
+		Username: username,
+		Role:     l.mapRole(groups),
+	}, nil
+}
+
+func (l *LDAP) findUser(conn *ldap.Conn, login string) (*ldap.Entry, error) {
+	filter := strings.ReplaceAll(l.UserFilter, "{login}", ldap.EscapeFilter(login))
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter, []string{l.EmailAttribute, l.UserAttribute, "memberOf"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap user search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	return res.Entries[0], nil
+}
+
+// groups returns the DNs of the user's groups, either from a group search
+// (OpenLDAP groupOfNames) or from the memberOf attribute (Active Directory).
+func (l *LDAP) groups(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	if l.GroupFilter == "" {
+		return entry.GetAttributeValues("memberOf"), nil
+	}
+
+	filter := strings.ReplaceAll(l.GroupFilter, "{dn}", ldap.EscapeFilter(entry.DN))
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, []string{"dn"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap group search: %w", err)
+	}
+	groups := make([]string, len(res.Entries))
+	for i, e := range res.Entries {
+		groups[i] = e.DN
+	}
+	return groups, nil
+}
+
+// mapRole matches configured groups against either the full group DN or
+// its CN, case-insensitively.
+func (l *LDAP) mapRole(groups []string) models.Role {
+	member := map[string]bool{}
+	for _, dn := range groups {
+		dn = strings.ToLower(dn)
+		member[dn] = true
+		if parsed, err := ldap.ParseDN(dn); err == nil && len(parsed.RDNs) > 0 {
+			for _, attr := range parsed.RDNs[0].Attributes {
+				if attr.Type == "cn" {
+					member[attr.Value] = true
+				}
+			}
+		}
+	}
+
+	for _, g := range l.AdminGroups {
+		if member[strings.ToLower(g)] {
+			return models.RoleAdmin
+		}
+	}
+	for _, g := range l.OperatorGroups {
+		if member[strings.ToLower(g)] {
+			return models.RoleOperator
+		}
+	}
+	return models.RoleUser
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,287 @@
+package authn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+
+	"helpdesk/server/models"
+)
+
+// directory is the data served by fakeLDAP. Searches match entries whose
+// attribute values appear in the filter as equality assertions, which is
+// all the filters of these tests need.
+type directory struct {
+	passwords map[string]string // DN -> password
+	entries   []ldapEntry
+}
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func (d *directory) search(base, filter string) []ldapEntry {
+	var found []ldapEntry
+	for _, e := range d.entries {
+		if !strings.HasSuffix(e.dn, base) {
+			continue
+		}
+		for name, values := range e.attrs {
+			for _, v := range values {
+				if strings.Contains(filter, "("+name+"="+v+")") {
+					found = append(found, e)
+					goto next
+				}
+			}
+		}
+	next:
+	}
+	return found
+}
+
+// fakeLDAP serves dir on a loopback port and returns its URL. It speaks
+// just enough of the protocol for LDAP: simple binds, searches and unbind.
+func fakeLDAP(t *testing.T, dir *directory) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveLDAP(conn, dir)
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func serveLDAP(conn net.Conn, dir *directory) {
+	defer conn.Close()
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil || len(req.Children) < 2 {
+			return
+		}
+		id := req.Children[0].Value
+		op := req.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultSuccess)
+			if want, ok := dir.passwords[dn]; !ok || want != password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			writeLDAP(conn, id, ldapResult(ldap.ApplicationBindResponse, code))
+
+		case ldap.ApplicationSearchRequest:
+			base := op.Children[0].Value.(string)
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			for _, e := range dir.search(base, filter) {
+				writeLDAP(conn, id, searchEntry(e))
+			}
+			writeLDAP(conn, id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+
+		default:
+			return
+		}
+	}
+}
+
+func writeLDAP(conn net.Conn, id any, op *ber.Packet) {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	msg.AppendChild(op)
+	conn.Write(msg.Bytes())
+}
+
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return p
+}
+
+func searchEntry(e ldapEntry) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+	attrs := ber.NewSequence("")
+	for name, values := range e.attrs {
+		attr := ber.NewSequence("")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	p.AppendChild(attrs)
+	return p
+}
+
+var testDirectory = &directory{
+	passwords: map[string]string{
+		"cn=admin,dc=example,dc=com":            "service",
+		"uid=alice,ou=people,dc=example,dc=com": "alice-secret",
+		"uid=bob,ou=people,dc=example,dc=com":   "bob-secret",
+	},
+	entries: []ldapEntry{
+		{"uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+			"uid":      {"alice"},
+			"mail":     {"alice@example.com"},
+			"memberOf": {"cn=helpdesk-operators,ou=groups,dc=example,dc=com"},
+		}},
+		{"uid=bob,ou=people,dc=example,dc=com", map[string][]string{
+			"mail": {"bob@example.com"},
+		}},
+		{"cn=helpdesk-admins,ou=groups,dc=example,dc=com", map[string][]string{
+			"member": {"uid=alice,ou=people,dc=example,dc=com"},
+		}},
+	},
+}
+
+func testLDAP(url string) *LDAP {
+	return &LDAP{
+		URL:            url,
+		BindDN:         "cn=admin,dc=example,dc=com",
+		BindPassword:   "service",
+		BaseDN:         "ou=people,dc=example,dc=com",
+		UserFilter:     "(&(objectClass=person)(|(mail={login})(uid={login})))",
+		EmailAttribute: "mail",
+		UserAttribute:  "uid",
+		AdminGroups:    []string{"helpdesk-admins"},
+		OperatorGroups: []string{"helpdesk-operators"},
+		Timeout:        2 * time.Second,
+	}
+}
+
+func TestLDAPLookup(t *testing.T) {
+	url := fakeLDAP(t, testDirectory)
+
+	tests := []struct {
+		name        string
+		login       string
+		password    string
+		groupFilter string
+		want        *Identity
+		wantErr     error
+	}{
+		{
+			name: "uid with memberOf", login: "alice", password: "alice-secret",
+			want: &Identity{Subject: "ldap:uid=alice,ou=people,dc=example,dc=com", Email: "alice@example.com", Username: "alice", Role: models.RoleOperator},
+		},
+		{
+			name: "email with group search", login: "alice@example.com", password: "alice-secret",
+			groupFilter: "(&(objectClass=groupOfNames)(member={dn}))",
+			want:        &Identity{Subject: "ldap:uid=alice,ou=people,dc=example,dc=com", Email: "alice@example.com", Username: "alice", Role: models.RoleAdmin},
+		},
+		{
+			name: "username from email", login: "bob@example.com", password: "bob-secret",
+			want: &Identity{Subject: "ldap:uid=bob,ou=people,dc=example,dc=com", Email: "bob@example.com", Username: "bob", Role: models.RoleUser},
+		},
+		{name: "wrong password", login: "alice", password: "bob-secret", wantErr: ErrInvalidCredentials},
+		{name: "unknown user", login: "carol", password: "alice-secret", wantErr: ErrInvalidCredentials},
+		{name: "empty password", login: "alice", password: "", wantErr: ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := testLDAP(url)
+			if tt.groupFilter != "" {
+				l.GroupBaseDN = "ou=groups,dc=example,dc=com"
+				l.GroupFilter = tt.groupFilter
+			}
+
+			got, err := l.lookup(context.Background(), tt.login, tt.password)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("lookup error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookup: %v", err)
+			}
+			if *got != *tt.want {
+				t.Errorf("lookup = %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+// hungLDAP accepts connections and never answers.
+func hungLDAP(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func TestLDAPLookupHungServer(t *testing.T) {
+	url := hungLDAP(t)
+
+	t.Run("timeout", func(t *testing.T) {
+		l := testLDAP(url)
+		l.Timeout = 100 * time.Millisecond
+
+		start := time.Now()
+		if _, err := l.lookup(context.Background(), "alice", "alice-secret"); err == nil {
+			t.Fatal("lookup succeeded against a server that never answers")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("lookup took %v with a 100ms timeout", elapsed)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		l := testLDAP(url)
+		l.Timeout = time.Minute
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		if _, err := l.lookup(ctx, "alice", "alice-secret"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("lookup error = %v, want %v", err, context.Canceled)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("lookup took %v after cancellation", elapsed)
+		}
+	})
+}
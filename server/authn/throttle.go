@@ -0,0 +1,246 @@
+package authn
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"helpdesk/server/config"
+	"helpdesk/server/models"
+)
+
+// Throttle slows down and then locks out repeated failed logins, both per
+// account and per client IP. Counters live in the database so that every
+// replica sees the same state.
+type Throttle struct {
+	Attempts *models.LoginAttemptStore
+	Users    *models.UserStore
+	Audit    *models.AuditStore
+
+	MaxFailures   int
+	IPMaxFailures int
+	Lockout       time.Duration
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+}
+
+func NewThrottle(attempts *models.LoginAttemptStore, users *models.UserStore, audit *models.AuditStore, cfg *config.Config) *Throttle {
+	return &Throttle{
+		Attempts:      attempts,
+		Users:         users,
+		Audit:         audit,
+		MaxFailures:   cfg.LoginMaxFailures,
+		IPMaxFailures: cfg.LoginIPMaxFailures,
+		Lockout:       cfg.LoginLockout,
+		BaseDelay:     cfg.LoginBackoffBase,
+		MaxDelay:      cfg.LoginBackoffMax,
+	}
+}
+
+// AccountKey is the counter key for a login name. Unknown logins are
+// counted too, so lockouts do not reveal which accounts exist.
+func AccountKey(login string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(login))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// MFAKey is the counter key for second-factor attempts of a user.
+func MFAKey(userID int) string {
+	return "mfa:" + strconv.Itoa(userID)
+}
+
+// Attempt reserves a login attempt for login from ip. It returns how long
+// the caller has to wait when the account or the IP is locked out or still
+// backing off. Otherwise the attempt counts as a failed one straight away,
+// so that parallel guesses are slowed down like consecutive ones, until
+// Succeed or Release takes it back. A key that has reached its limit is
+// locked by the next attempt.
+func (t *Throttle) Attempt(ctx context.Context, login, ip string) (time.Duration, error) {
+	return t.attempt(ctx, map[string]int{
+		AccountKey(login): t.MaxFailures,
+		ipKey(ip):         t.IPMaxFailures,
+	}, func(a *models.LoginAttempt) {
+		t.lockedOut(ctx, a, t.userID(ctx, a.Key, login), ip)
+	})
+}
+
+// AttemptReauth reserves an attempt at re-entering the password of a
+// signed-in user, against the same counters as a login, so that a stolen
+// session cannot guess the password faster than the login form. When the
+// account runs out of attempts, its sessions are revoked.
+func (t *Throttle) AttemptReauth(ctx context.Context, user *models.User, ip string) (time.Duration, error) {
+	account := AccountKey(user.Email)
+	return t.attempt(ctx, map[string]int{
+		account:   t.MaxFailures,
+		ipKey(ip): t.IPMaxFailures,
+	}, func(a *models.LoginAttempt) {
+		if a.Key == account {
+			if err := t.Users.RevokeSessions(ctx, user.ID); err != nil {
+				slog.ErrorContext(ctx, "revoke sessions after lockout", "user_id", user.ID, "err", err)
+			}
+		}
+		t.lockedOut(ctx, a, &user.ID, ip)
+	})
+}
+
+// AttemptMFA reserves an attempt at the second factor of a user, like
+// Attempt does for passwords. When the user runs out of attempts, their
+// sessions are revoked along with the MFA token being guessed at, so that
+// whoever has the password has to start over with it after the lockout.
+func (t *Throttle) AttemptMFA(ctx context.Context, userID int, ip string) (time.Duration, error) {
+	return t.attempt(ctx, map[string]int{MFAKey(userID): t.MaxFailures}, func(a *models.LoginAttempt) {
+		if err := t.Users.RevokeSessions(ctx, userID); err != nil {
+			slog.ErrorContext(ctx, "revoke sessions after mfa lockout", "user_id", userID, "err", err)
+		}
+		t.lockedOut(ctx, a, &userID, ip)
+	})
+}
+
+// SucceedMFA clears the second-factor failures of a user.
+func (t *Throttle) SucceedMFA(ctx context.Context, userID int) error {
+	return t.Attempts.Reset(ctx, MFAKey(userID))
+}
+
+// attempt reserves an attempt against the keys of limits and calls locked
+// for every key this attempt locks.
+func (t *Throttle) attempt(ctx context.Context, limits map[string]int, locked func(*models.LoginAttempt)) (time.Duration, error) {
+	keys := make([]string, 0, len(limits))
+	for k := range limits {
+		keys = append(keys, k)
+	}
+	now := time.Now()
+	held := false
+	var newlyLocked []*models.LoginAttempt
+	attempts, err := t.Attempts.Attempt(ctx, keys, t.Lockout, t.Lockout,
+		func(a *models.LoginAttempt) (hold, lock bool) {
+			switch {
+			case a.LockedUntil != nil && a.LockedUntil.After(now):
+				hold = true
+			case a.Failures >= limits[a.Key]:
+				lock = true
+				newlyLocked = append(newlyLocked, a)
+			case a.LastFailureAt.Add(t.delay(a)).After(now):
+				hold = true
+			}
+			held = held || hold || lock
+			return hold, lock
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, a := range newlyLocked {
+		locked(a)
+	}
+	if !held {
+		return 0, nil
+	}
+	return t.wait(attempts, now), nil
+}
+
+// wait returns how long after now the last of attempts allows another one.
+func (t *Throttle) wait(attempts []*models.LoginAttempt, now time.Time) time.Duration {
+	var until time.Time
+	for _, a := range attempts {
+		if a.LockedUntil != nil && a.LockedUntil.After(until) {
+			until = *a.LockedUntil
+		}
+		if next := a.LastFailureAt.Add(t.delay(a)); next.After(until) {
+			until = next
+		}
+	}
+	if until.After(now) {
+		return until.Sub(now)
+	}
+	return 0
+}
+
+// delay is the progressive backoff after a's failures: BaseDelay doubled
+// for every further failure, up to MaxDelay. Shared IPs get half their
+// limit free so that busy offices are not slowed by a few typos.
+func (t *Throttle) delay(a *models.LoginAttempt) time.Duration {
+	n := a.Failures
+	if strings.HasPrefix(a.Key, "ip:") {
+		n -= t.IPMaxFailures / 2
+	}
+	if n <= 0 {
+		return 0
+	}
+	d := t.BaseDelay
+	for i := 1; i < n && d < t.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > t.MaxDelay {
+		d = t.MaxDelay
+	}
+	return d
+}
+
+// Succeed clears the account's failures after a successful login. The IP
+// counter only gets the attempt back, so that one valid account cannot be
+// used to reset it.
+func (t *Throttle) Succeed(ctx context.Context, login, ip string) error {
+	if err := t.Attempts.Reset(ctx, AccountKey(login)); err != nil {
+		return err
+	}
+	return t.Attempts.Refund(ctx, ipKey(ip))
+}
+
+// Release takes back an attempt that could not be decided, such as one the
+// directory did not answer.
+func (t *Throttle) Release(ctx context.Context, login, ip string) error {
+	if err := t.Attempts.Refund(ctx, AccountKey(login)); err != nil {
+		return err
+	}
+	return t.Attempts.Refund(ctx, ipKey(ip))
+}
+
+// userID returns the ID of the account behind an account key, if any.
+func (t *Throttle) userID(ctx context.Context, key, login string) *int {
+	if key != AccountKey(login) {
+		return nil
+	}
+	user, err := t.Users.GetByEmail(ctx, login)
+	if err != nil {
+		return nil
+	}
+	return &user.ID
+}
+
+func (t *Throttle) lockedOut(ctx context.Context, a *models.LoginAttempt, userID *int, ip string) {
+	e := &models.AuditEntry{
+		Action:       models.AuditLoginLockout,
+		TargetUserID: userID,
+		IP:           ip,
+		Details: map[string]string{
+			"key":      a.Key,
+			"failures": strconv.Itoa(a.Failures),
+			"duration": t.Lockout.String(),
+		},
+	}
+	if err := t.Audit.Record(ctx, e); err != nil {
+		slog.ErrorContext(ctx, "audit", "action", e.Action, "err", err)
+	}
+}
+
+// Run periodically deletes counters that have expired.
+func (t *Throttle) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := t.Attempts.DeleteStale(ctx, time.Now().Add(-t.Lockout)); err != nil {
+			slog.Error("delete stale login attempts", "err", err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"helpdesk/server/models"
+)
+
+const tenantUsage = `usage:
+  server tenant list
+  server tenant create <slug> <name>
+  server tenant delete <slug> --confirm`
+
+// runTenantCommand provisions and deprovisions tenants from the command line.
+func runTenantCommand(ctx context.Context, database *sql.DB, args []string) error {
+	tenants := models.NewTenantStore(database)
+
+	if len(args) == 0 {
+		return errors.New(tenantUsage)
+	}
+	switch args[0] {
+	case "list":
+		list, err := tenants.List(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSLUG\tNAME\tCREATED")
+		for _, t := range list {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", t.ID, t.Slug, t.Name, t.CreatedAt.Format(time.RFC3339))
+		}
+		return tw.Flush()
+
+	case "create":
+		if len(args) != 3 {
+			return errors.New(tenantUsage)
+		}
+		if !models.ValidTenantSlug(args[1]) {
+			return fmt.Errorf("invalid slug %q: use lowercase letters, digits and '-'", args[1])
+		}
+		t, err := tenants.Provision(ctx, args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created tenant %s (id %d)\n", t.Slug, t.ID)
+		return nil
+
+	case "delete":
+		if len(args) != 3 || args[2] != "--confirm" {
+			return errors.New(tenantUsage)
+		}
+		err := tenants.Deprovision(ctx, args[1])
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no tenant %q", args[1])
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted tenant %s and all of its data\n", args[1])
+		return nil
+	}
+	return errors.New(tenantUsage)
+}
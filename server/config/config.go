@@ -1,7 +1,14 @@
 package config
 
 import (
+	"errors"
+	"net"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -12,6 +19,105 @@ type Config struct {
 	DBName     string
 	JWTSecret  string
 	ServerPort string
+
+	// DBMigrationUser owns the schema and runs the migrations. The server
+	// itself connects as DBUser, which must be subject to row-level security.
+	DBMigrationUser     string
+	DBMigrationPassword string
+
+	DevMode             bool
+	JWTAlgorithm        string
+	JWTIssuer           string
+	JWTRotationInterval time.Duration
+	JWTKeyRetention     time.Duration
+
+	RequireIfMatch bool
+
+	AppURL       string
+	MailBackend  string
+	MailFrom     string
+	MailDir      string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUser     string
+	SMTPPassword string
+
+	PasswordResetTTL time.Duration
+	MFAIssuer        string
+	MFAChallengeTTL  time.Duration
+	ImpersonationTTL time.Duration
+
+	PasswordLoginEnabled bool
+	OIDCIssuer           string
+	OIDCClientID         string
+	OIDCClientSecret     string
+	OIDCRedirectURL      string
+	OIDCGroupsClaim      string
+	OIDCAdminGroups      []string
+	OIDCOperatorGroups   []string
+
+	LDAPURL               string
+	LDAPStartTLS          bool
+	LDAPBindDN            string
+	LDAPBindPassword      string
+	LDAPBaseDN            string
+	LDAPUserFilter        string
+	LDAPEmailAttribute    string
+	LDAPUsernameAttribute string
+	LDAPGroupBaseDN       string
+	LDAPGroupFilter       string
+	LDAPAdminGroups       []string
+	LDAPOperatorGroups    []string
+	LDAPTimeout           time.Duration
+
+	LoginMaxFailures   int
+	LoginIPMaxFailures int
+	LoginLockout       time.Duration
+	LoginBackoffBase   time.Duration
+	LoginBackoffMax    time.Duration
+	TrustedProxies     []string
+
+	DefaultTenant    string
+	TenantBaseDomain string
+	TenantHeader     string
+	TenantDBMaxConns int
+
+	SoftDeleteRetentionDays int
+	PurgeInterval           time.Duration
+
+	LogFormat string
+	LogLevel  string
+
+	MetricsPort string
+	MetricsPath string
+
+	ServerReadTimeout  time.Duration
+	ServerWriteTimeout time.Duration
+	ServerIdleTimeout  time.Duration
+	ShutdownDelay      time.Duration
+	ShutdownTimeout    time.Duration
+	QueryTimeout       time.Duration
+
+	TracingExporter string
+	TracingEndpoint string
+
+	RateLimitUserRequests int
+	RateLimitUserPeriod   time.Duration
+	RateLimitAnonRequests int
+	RateLimitAnonPeriod   time.Duration
+	RateLimitRedisURL     string
+	MaxBodyBytes          int64
+
+	CORSAllowedOrigins   []string
+	CORSAllowCredentials bool
+	CORSMaxAge           time.Duration
+	CORSExposedHeaders   []string
+	HSTSMaxAge           time.Duration
+
+	SLACritical time.Duration
+	SLAHigh     time.Duration
+	SLAMedium   time.Duration
+	SLALow      time.Duration
 }
 
 func Load() *Config {
@@ -21,11 +127,179 @@ func Load() *Config {
 		DBUser:     getEnv("DB_USER", "helpdesk"),
 		DBPassword: getEnv("DB_PASSWORD", "helpdesk"),
 		DBName:     getEnv("DB_NAME", "helpdesk"),
-		JWTSecret:  getEnv("JWT_SECRET", "test-key"),
+		JWTSecret:  getEnv("JWT_SECRET", ""),
 		ServerPort: getEnv("SERVER_PORT", "8080"),
+
+		DBMigrationUser:     getEnv("DB_MIGRATION_USER", ""),
+		DBMigrationPassword: getEnv("DB_MIGRATION_PASSWORD", ""),
+
+		DevMode:             getEnvBool("DEV_MODE", false),
+		JWTAlgorithm:        getEnv("JWT_ALGORITHM", "EdDSA"),
+		JWTIssuer:           getEnv("JWT_ISSUER", "helpdesk"),
+		JWTRotationInterval: getEnvDuration("JWT_ROTATION_INTERVAL", 30*24*time.Hour),
+		JWTKeyRetention:     getEnvDuration("JWT_KEY_RETENTION", 48*time.Hour),
+
+		RequireIfMatch: getEnvBool("REQUIRE_IF_MATCH", false),
+
+		AppURL:       getEnv("APP_URL", "http://localhost:3000"),
+		MailBackend:  getEnv("MAIL_BACKEND", "log"),
+		MailFrom:     getEnv("MAIL_FROM", "helpdesk@localhost"),
+		MailDir:      getEnv("MAIL_DIR", "mail-outbox"),
+		SMTPHost:     getEnv("SMTP_HOST", "localhost"),
+		SMTPPort:     getEnv("SMTP_PORT", "25"),
+		SMTPUser:     getEnv("SMTP_USER", ""),
+		SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+
+		PasswordResetTTL: getEnvDuration("PASSWORD_RESET_TTL", time.Hour),
+		MFAIssuer:        getEnv("MFA_ISSUER", "Helpdesk"),
+		MFAChallengeTTL:  getEnvDuration("MFA_CHALLENGE_TTL", 5*time.Minute),
+		ImpersonationTTL: getEnvDuration("IMPERSONATION_TTL", 15*time.Minute),
+
+		PasswordLoginEnabled: getEnvBool("PASSWORD_LOGIN_ENABLED", true),
+		OIDCIssuer:           getEnv("OIDC_ISSUER", ""),
+		OIDCClientID:         getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:     getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:      getEnv("OIDC_REDIRECT_URL", "http://localhost:8080/api/auth/oidc/callback"),
+		OIDCGroupsClaim:      getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		OIDCAdminGroups:      getEnvList("OIDC_ADMIN_GROUPS"),
+		OIDCOperatorGroups:   getEnvList("OIDC_OPERATOR_GROUPS"),
+
+		LDAPURL:               getEnv("LDAP_URL", ""),
+		LDAPStartTLS:          getEnvBool("LDAP_STARTTLS", false),
+		LDAPBindDN:            getEnv("LDAP_BIND_DN", ""),
+		LDAPBindPassword:      getEnv("LDAP_BIND_PASSWORD", ""),
+		LDAPBaseDN:            getEnv("LDAP_BASE_DN", ""),
+		LDAPUserFilter:        getEnv("LDAP_USER_FILTER", "(&(objectClass=person)(|(mail={login})(uid={login})))"),
+		LDAPEmailAttribute:    getEnv("LDAP_EMAIL_ATTRIBUTE", "mail"),
+		LDAPUsernameAttribute: getEnv("LDAP_USERNAME_ATTRIBUTE", "uid"),
+		LDAPGroupBaseDN:       getEnv("LDAP_GROUP_BASE_DN", ""),
+		LDAPGroupFilter:       getEnv("LDAP_GROUP_FILTER", ""),
+		LDAPAdminGroups:       getEnvList("LDAP_ADMIN_GROUPS"),
+		LDAPOperatorGroups:    getEnvList("LDAP_OPERATOR_GROUPS"),
+		LDAPTimeout:           getEnvDuration("LDAP_TIMEOUT", 5*time.Second),
+
+		LoginMaxFailures:   getEnvInt("LOGIN_MAX_FAILURES", 5),
+		LoginIPMaxFailures: getEnvInt("LOGIN_IP_MAX_FAILURES", 50),
+		LoginLockout:       getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+		LoginBackoffBase:   getEnvDuration("LOGIN_BACKOFF_BASE", time.Second),
+		LoginBackoffMax:    getEnvDuration("LOGIN_BACKOFF_MAX", 30*time.Second),
+		TrustedProxies:     getEnvList("TRUSTED_PROXIES"),
+
+		DefaultTenant:    getEnv("DEFAULT_TENANT", "default"),
+		TenantBaseDomain: getEnv("TENANT_BASE_DOMAIN", ""),
+		TenantHeader:     getEnv("TENANT_HEADER", "X-Tenant"),
+		TenantDBMaxConns: getEnvInt("TENANT_DB_MAX_CONNS", 10),
+
+		SoftDeleteRetentionDays: getEnvInt("SOFT_DELETE_RETENTION_DAYS", 0),
+		PurgeInterval:           getEnvDuration("PURGE_INTERVAL", time.Hour),
+
+		LogFormat: getEnv("LOG_FORMAT", "text"),
+		LogLevel:  getEnv("LOG_LEVEL", "info"),
+
+		MetricsPort: getEnv("METRICS_PORT", "9090"),
+		MetricsPath: getEnv("METRICS_PATH", "/metrics"),
+
+		ServerReadTimeout:  getEnvDuration("SERVER_READ_TIMEOUT", 15*time.Second),
+		ServerWriteTimeout: getEnvDuration("SERVER_WRITE_TIMEOUT", 30*time.Second),
+		ServerIdleTimeout:  getEnvDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+		ShutdownDelay:      getEnvDuration("SHUTDOWN_DELAY", 0),
+		ShutdownTimeout:    getEnvDuration("SHUTDOWN_TIMEOUT", 25*time.Second),
+		QueryTimeout:       getEnvDuration("QUERY_TIMEOUT", 10*time.Second),
+
+		TracingExporter: getEnv("TRACING_EXPORTER", "none"),
+		TracingEndpoint: getEnv("TRACING_ENDPOINT", ""),
+
+		RateLimitUserRequests: getEnvInt("RATE_LIMIT_USER_REQUESTS", 300),
+		RateLimitUserPeriod:   getEnvDuration("RATE_LIMIT_USER_PERIOD", time.Minute),
+		RateLimitAnonRequests: getEnvInt("RATE_LIMIT_ANON_REQUESTS", 30),
+		RateLimitAnonPeriod:   getEnvDuration("RATE_LIMIT_ANON_PERIOD", time.Minute),
+		RateLimitRedisURL:     getEnv("RATE_LIMIT_REDIS_URL", ""),
+		MaxBodyBytes:          int64(getEnvInt("MAX_BODY_BYTES", 1<<20)),
+
+		CORSAllowedOrigins:   getEnvList("CORS_ALLOWED_ORIGINS"),
+		CORSAllowCredentials: getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+		CORSMaxAge:           getEnvDuration("CORS_MAX_AGE", 10*time.Minute),
+		CORSExposedHeaders: getEnvListOr("CORS_EXPOSED_HEADERS", []string{"ETag", "X-Request-ID", "Retry-After",
+			"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy"}),
+		HSTSMaxAge: getEnvDuration("HSTS_MAX_AGE", 365*24*time.Hour),
+
+		SLACritical: getEnvDuration("SLA_CRITICAL", 4*time.Hour),
+		SLAHigh:     getEnvDuration("SLA_HIGH", 24*time.Hour),
+		SLAMedium:   getEnvDuration("SLA_MEDIUM", 3*24*time.Hour),
+		SLALow:      getEnvDuration("SLA_LOW", 7*24*time.Hour),
 	}
 }
 
+// insecureJWTSecret is the secret the server used to fall back to. It is
+// still accepted, along with an empty secret, in dev mode only.
+const insecureJWTSecret = "test-key"
+
+// Validate rejects configurations that are unsafe outside of dev mode.
+func (c *Config) Validate() error {
+	if c.JWTAlgorithm == "HS256" && (c.JWTSecret == "" || c.JWTSecret == insecureJWTSecret) {
+		if !c.DevMode {
+			return errors.New("JWT_SECRET is empty or the insecure default; set a real secret, " +
+				"switch JWT_ALGORITHM to RS256 or EdDSA, or set DEV_MODE=true")
+		}
+		c.JWTSecret = insecureJWTSecret
+	}
+	if c.LoginMaxFailures < 1 || c.LoginIPMaxFailures < 1 {
+		return errors.New("LOGIN_MAX_FAILURES and LOGIN_IP_MAX_FAILURES must be positive")
+	}
+	if c.MetricsPort == c.ServerPort {
+		return errors.New("METRICS_PORT must differ from SERVER_PORT so that metrics stay off the public listener")
+	}
+	if !strings.HasPrefix(c.MetricsPath, "/") {
+		return errors.New("METRICS_PATH must start with /")
+	}
+	if len(c.CORSAllowedOrigins) == 0 {
+		c.CORSAllowedOrigins = []string{strings.TrimSuffix(c.AppURL, "/")}
+	}
+	if c.CORSAllowCredentials && slices.Contains(c.CORSAllowedOrigins, "*") {
+		return errors.New("CORS_ALLOW_CREDENTIALS cannot be combined with CORS_ALLOWED_ORIGINS=*")
+	}
+	if c.MaxBodyBytes < 1 {
+		return errors.New("MAX_BODY_BYTES must be positive")
+	}
+	if c.JWTKeyRetention < 24*time.Hour {
+		return errors.New("JWT_KEY_RETENTION must be at least the 24h session token lifetime")
+	}
+	return nil
+}
+
+// ForTenant returns the configuration of tenant slug. With a base domain,
+// the app and the OIDC callback of a tenant other than the default one are
+// served from its subdomain, so links in mails and SSO redirects lead back
+// to that tenant. The callback of every tenant must be registered with the
+// identity provider.
+func (c *Config) ForTenant(slug string) *Config {
+	if c.TenantBaseDomain == "" || slug == c.DefaultTenant {
+		return c
+	}
+	t := *c
+	t.AppURL = tenantURL(c.AppURL, slug, c.TenantBaseDomain)
+	t.OIDCRedirectURL = tenantURL(c.OIDCRedirectURL, slug, c.TenantBaseDomain)
+	if slices.Equal(c.CORSAllowedOrigins, []string{strings.TrimSuffix(c.AppURL, "/")}) {
+		t.CORSAllowedOrigins = []string{strings.TrimSuffix(t.AppURL, "/")}
+	}
+	return &t
+}
+
+// tenantURL moves rawURL to the subdomain slug of baseDomain, keeping its
+// scheme, port and path.
+func tenantURL(rawURL, slug, baseDomain string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	host := slug + "." + strings.ToLower(baseDomain)
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	u.Host = host
+	return u.String()
+}
+
 func getEnv(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -33,3 +307,44 @@ func getEnv(key, fallback string) string {
 
 	return fallback
 }
+
+func getEnvBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getEnvInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getEnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func getEnvListOr(key string, fallback []string) []string {
+	if list := getEnvList(key); len(list) > 0 {
+		return list
+	}
+	return fallback
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestForTenant(t *testing.T) {
+	cfg := &Config{
+		AppURL:             "https://helpdesk.example.com",
+		OIDCRedirectURL:    "https://helpdesk.example.com:8443/api/auth/oidc/callback",
+		CORSAllowedOrigins: []string{"https://helpdesk.example.com"},
+		DefaultTenant:      "default",
+		TenantBaseDomain:   "Helpdesk.Example.com",
+	}
+
+	tests := []struct {
+		slug     string
+		appURL   string
+		redirect string
+	}{
+		{"default", "https://helpdesk.example.com", "https://helpdesk.example.com:8443/api/auth/oidc/callback"},
+		{"acme", "https://acme.helpdesk.example.com", "https://acme.helpdesk.example.com:8443/api/auth/oidc/callback"},
+		{"globex", "https://globex.helpdesk.example.com", "https://globex.helpdesk.example.com:8443/api/auth/oidc/callback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.slug, func(t *testing.T) {
+			got := cfg.ForTenant(tt.slug)
+			if got.AppURL != tt.appURL {
+				t.Errorf("AppURL = %q, want %q", got.AppURL, tt.appURL)
+			}
+			if got.OIDCRedirectURL != tt.redirect {
+				t.Errorf("OIDCRedirectURL = %q, want %q", got.OIDCRedirectURL, tt.redirect)
+			}
+			if want := []string{tt.appURL}; !slices.Equal(got.CORSAllowedOrigins, want) {
+				t.Errorf("CORSAllowedOrigins = %v, want %v", got.CORSAllowedOrigins, want)
+			}
+		})
+	}
+	if cfg.AppURL != "https://helpdesk.example.com" {
+		t.Errorf("ForTenant changed the shared configuration: AppURL = %q", cfg.AppURL)
+	}
+}
+
+func TestForTenantWithoutBaseDomain(t *testing.T) {
+	cfg := &Config{AppURL: "http://localhost:3000", DefaultTenant: "default"}
+	if got := cfg.ForTenant("acme"); got.AppURL != cfg.AppURL {
+		t.Errorf("AppURL = %q, want %q", got.AppURL, cfg.AppURL)
+	}
+}
+
+func TestForTenantKeepsExplicitOrigins(t *testing.T) {
+	cfg := &Config{
+		AppURL:             "https://helpdesk.example.com",
+		CORSAllowedOrigins: []string{"https://portal.example.com"},
+		DefaultTenant:      "default",
+		TenantBaseDomain:   "helpdesk.example.com",
+	}
+	got := cfg.ForTenant("acme")
+	if want := []string{"https://portal.example.com"}; !slices.Equal(got.CORSAllowedOrigins, want) {
+		t.Errorf("CORSAllowedOrigins = %v, want %v", got.CORSAllowedOrigins, want)
+	}
+}
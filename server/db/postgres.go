@@ -1,21 +1,84 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
 
 	"helpdesk/server/config"
 )
 
+const migrationsDir = "migrations"
+
+// Connect opens the system connection pool. It sees the rows of every
+// tenant and is meant for migrations, provisioning and background jobs.
 func Connect(cfg *config.Config) (*sql.DB, error) {
+	return open(cfg, "-c app.all_tenants=on")
+}
+
+// ConnectMigrator opens a connection as the owner of the schema for running
+// migrations, or as the application role when no migration user is set.
+func ConnectMigrator(cfg *config.Config) (*sql.DB, error) {
+	if cfg.DBMigrationUser == "" {
+		return Connect(cfg)
+	}
+	owner := *cfg
+	owner.DBUser = cfg.DBMigrationUser
+	owner.DBPassword = cfg.DBMigrationPassword
+	return Connect(&owner)
+}
+
+// RequireRLS fails if the connection's role is a superuser or bypasses
+// row-level security, either of which would let every query see the rows of
+// all tenants.
+func RequireRLS(db *sql.DB) error {
+	var (
+		user          string
+		super, bypass bool
+	)
+	err := db.QueryRow(
+		`SELECT rolname, rolsuper, rolbypassrls FROM pg_roles WHERE rolname = current_user`,
+	).Scan(&user, &super, &bypass)
+	if err != nil {
+		return fmt.Errorf("check database role: %w", err)
+	}
+	if super || bypass {
+		return fmt.Errorf("database role %q bypasses row-level security; connect as a role without SUPERUSER and BYPASSRLS, such as helpdesk_app, and run migrations as DB_MIGRATION_USER", user)
+	}
+	return nil
+}
+
+// ConnectTenant opens a pool whose sessions are confined to one tenant by
+// the row-level security policies.
+func ConnectTenant(cfg *config.Config, tenantID int) (*sql.DB, error) {
+	db, err := open(cfg, fmt.Sprintf("-c app.tenant_id=%d", tenantID))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.TenantDBMaxConns)
+	return db, nil
+}
+
+func open(cfg *config.Config, options string) (*sql.DB, error) {
 	dsn := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName,
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable options='%s'",
+		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName, options,
+	)
+	db, err := otelsql.Open("postgres", dsn,
+		otelsql.WithAttributes(semconv.DBSystemNamePostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitConnPrepare:      true,
+			OmitRows:             true,
+		}),
 	)
-	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -25,11 +88,118 @@ func Connect(cfg *config.Config) (*sql.DB, error) {
 	return db, nil
 }
 
+// RunMigrations applies every migrations/*.sql file that is not yet recorded
+// in schema_migrations, in lexical order, each in its own transaction.
 func RunMigrations(db *sql.DB) error {
-	data, err := os.ReadFile("migrations/001_init.sql")
+	if _, err := db.Exec(
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+		     name       TEXT PRIMARY KEY,
+		     applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		 )`,
+	); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	if err := adoptInitialSchema(db); err != nil {
+		return err
+	}
+
+	files, err := migrationFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		var applied bool
+		if err := db.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE name=$1)`, name,
+		).Scan(&applied); err != nil {
+			return fmt.Errorf("check migration %s: %w", name, err)
+		}
+		if applied {
+			continue
+		}
+		if err := applyMigration(db, file, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PendingMigrations returns the names of migrations/*.sql files that have not
+// been applied yet.
+func PendingMigrations(ctx context.Context, db *sql.DB) ([]string, error) {
+	files, err := migrationFiles()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT name FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		applied[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, file := range files {
+		if name := filepath.Base(file); !applied[name] {
+			pending = append(pending, name)
+		}
+	}
+	return pending, nil
+}
+
+func migrationFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(migrationsDir, "*.sql"))
+	if err != nil {
+		return nil, fmt.Errorf("list migrations: %w", err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func applyMigration(db *sql.DB, file, name string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read migration %s: %w", name, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(string(data)); err != nil {
+		return fmt.Errorf("apply migration %s: %w", name, err)
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (name) VALUES ($1)`, name); err != nil {
+		return fmt.Errorf("record migration %s: %w", name, err)
+	}
+	return tx.Commit()
+}
+
+// adoptInitialSchema marks 001_init.sql as applied on databases that were
+// created before schema_migrations existed.
+func adoptInitialSchema(db *sql.DB) error {
+	_, err := db.Exec(
+		`INSERT INTO schema_migrations (name)
+		 SELECT '001_init.sql'
+		 WHERE to_regclass('public.users') IS NOT NULL
+		   AND NOT EXISTS (SELECT 1 FROM schema_migrations)`,
+	)
 	if err != nil {
-		return fmt.Errorf("read migration: %w", err)
+		return fmt.Errorf("adopt initial schema: %w", err)
 	}
-	_, err = db.Exec(string(data))
-	return err
+	return nil
 }
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"helpdesk/server/middleware"
+	"helpdesk/server/models"
+	"helpdesk/server/problem"
+)
+
+type APIKeyHandler struct {
+	Keys *models.APIKeyStore
+}
+
+type apiKeyRequest struct {
+	Name      string     `json:"name" validate:"required,max=64"`
+	Scopes    []string   `json:"scopes" validate:"required"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (body *apiKeyRequest) check(r *http.Request, fields map[string]string) {
+	for _, scope := range body.Scopes {
+		if !models.ValidScope(scope) {
+			fields["scopes"] = "must contain only tickets:read, tickets:write, comments:write or admin"
+			break
+		}
+		if scope == models.ScopeAdmin && !middleware.HasPermission(r.Context(), models.PermUserManage) {
+			fields["scopes"] = "admin scope requires the user.manage permission"
+			break
+		}
+	}
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+		fields["expires_at"] = "must be in the future"
+	}
+}
+
+// Create issues a new key. The plaintext key is only part of this response.
+func (h *APIKeyHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var body apiKeyRequest
+	if !decode(w, r, &body) {
+		return
+	}
+
+	key, secret, err := h.Keys.Create(r.Context(), middleware.UserIDFromCtx(r.Context()), body.Name, body.Scopes, body.ExpiresAt)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		*models.APIKey
+		Key string `json:"key"`
+	}{key, secret})
+}
+
+func (h *APIKeyHandler) List(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.Keys.ListByUser(r.Context(), middleware.UserIDFromCtx(r.Context()))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if keys == nil {
+		keys = []*models.APIKey{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (h *APIKeyHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+
+	err = h.Keys.Revoke(r.Context(), middleware.UserIDFromCtx(r.Context()), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
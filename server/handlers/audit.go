@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"helpdesk/server/models"
+	"helpdesk/server/problem"
+)
+
+type AuditHandler struct {
+	Audit *models.AuditStore
+}
+
+func (h *AuditHandler) List(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, r, problem.Invalid("limit must be between 1 and 1000"))
+			return
+		}
+		limit = n
+	}
+
+	entries, err := h.Audit.List(r.Context(), r.URL.Query().Get("action"), limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if entries == nil {
+		entries = []*models.AuditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
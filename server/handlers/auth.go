@@ -1,32 +1,53 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 
+	"helpdesk/server/authn"
+	"helpdesk/server/jwtkeys"
+	"helpdesk/server/mail"
 	"helpdesk/server/middleware"
 	"helpdesk/server/models"
+	"helpdesk/server/problem"
 )
 
 type AuthHandler struct {
-	Users     *models.UserStore
-	JWTSecret string
+	Users            *models.UserStore
+	Authenticator    authn.Authenticator
+	Throttle         *authn.Throttle
+	IPs              *middleware.IPResolver
+	Resets           *models.PasswordResetStore
+	MFA              *models.MFAStore
+	Mailer           mail.Sender
+	Keys             *jwtkeys.KeySet
+	AppURL           string
+	PasswordResetTTL time.Duration
+	MFAChallengeTTL  time.Duration
+
+	RegistrationDisabled bool
 }
 
+// registerRequest has no role: self-registered accounts are always plain
+// users, and other roles are assigned by an admin.
 type registerRequest struct {
-	Username string      `json:"username"`
-	Email    string      `json:"email"`
-	Password string      `json:"password"`
-	Role     models.Role `json:"role"`
+	Username string `json:"username" validate:"required,max=64"`
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required,password"`
 }
 
 type loginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email" validate:"required"`
+	Password string `json:"password" validate:"required"`
 }
 
 type tokenResponse struct {
@@ -34,67 +55,183 @@ type tokenResponse struct {
 	User  *models.User `json:"user"`
 }
 
+type mfaChallengeResponse struct {
+	MFARequired           bool   `json:"mfa_required,omitempty"`
+	MFAEnrollmentRequired bool   `json:"mfa_enrollment_required,omitempty"`
+	MFAToken              string `json:"mfa_token"`
+}
+
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
+	if h.RegistrationDisabled {
+		writeError(w, r, problem.Forbidden("registration is disabled, use single sign-on"))
+		return
+	}
+
 	var req registerRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", http.StatusBadRequest)
+	if !decode(w, r, &req) {
 		return
 	}
 
-	if req.Username == "" || req.Email == "" || req.Password == "" {
-		jsonError(w, "username, email and password are required", http.StatusBadRequest)
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	role := req.Role
-	if role != models.RoleAdmin && role != models.RoleOperator && role != models.RoleUser {
-		role = models.RoleUser
+	user, err := h.Users.Create(r.Context(), req.Username, req.Email, string(hash), models.RoleUser)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// The account works right away, but joins no organization until the
+	// address is confirmed. A lost mail can be sent again from the profile.
+	if err := sendEmailConfirmation(r.Context(), h.Users, h.Mailer, h.AppURL, user, user.Email); err != nil {
+		slog.ErrorContext(r.Context(), "send email confirmation", "user_id", user.ID, "err", err)
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	h.completeLogin(w, r, user, http.StatusCreated)
+}
+
+func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	if h.Authenticator == nil {
+		writeError(w, r, problem.Forbidden("password login is disabled, use single sign-on"))
+		return
+	}
+
+	var req loginRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	ip := h.IPs.ClientIP(r)
+	wait, err := h.Throttle.Attempt(r.Context(), req.Email, ip)
 	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, problem.New(problem.KindRateLimited, "login_throttled", "too many failed login attempts, try again later"))
 		return
 	}
 
-	user, err := h.Users.Create(req.Username, req.Email, string(hash), role)
+	user, err := h.Authenticator.Authenticate(r.Context(), req.Email, req.Password)
+	if errors.Is(err, authn.ErrInvalidCredentials) {
+		// Attempt has already counted the failure.
+		writeError(w, r, problem.Unauthenticated("invalid credentials"))
+		return
+	}
 	if err != nil {
-		jsonError(w, "user already exists or invalid data", http.StatusConflict)
+		slog.ErrorContext(r.Context(), "login", "email", req.Email, "err", err)
+		if err := h.Throttle.Release(r.Context(), req.Email, ip); err != nil {
+			slog.ErrorContext(r.Context(), "release login attempt", "email", req.Email, "err", err)
+		}
+		writeError(w, r, problem.New(problem.KindUnavailable, "authentication_unavailable", "authentication service unavailable"))
 		return
 	}
+	if err := h.Throttle.Succeed(r.Context(), req.Email, ip); err != nil {
+		slog.ErrorContext(r.Context(), "reset failed logins", "email", req.Email, "err", err)
+	}
+
+	h.completeLogin(w, r, user, http.StatusOK)
+}
 
-	token, err := h.generateToken(user)
+// completeLogin issues a session token for a user whose password has been
+// checked, or an MFA token when a second step is still due.
+func (h *AuthHandler) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User, code int) {
+	token, purpose, err := loginToken(r.Context(), h.Keys, h.MFA, user, h.MFAChallengeTTL)
 	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(code)
+	if purpose != middleware.PurposeSession {
+		json.NewEncoder(w).Encode(mfaChallengeResponse{
+			MFARequired:           purpose == middleware.PurposeMFA,
+			MFAEnrollmentRequired: purpose == middleware.PurposeMFAEnroll,
+			MFAToken:              token,
+		})
+		return
+	}
 	json.NewEncoder(w).Encode(tokenResponse{Token: token, User: user})
 }
 
-func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
-	var req loginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", http.StatusBadRequest)
+// loginToken returns the token for a user who has passed the first factor
+// and its purpose: a session token, or an MFA token valid for challengeTTL
+// when the user has to verify or enroll a second factor first.
+func loginToken(ctx context.Context, keys *jwtkeys.KeySet, mfa *models.MFAStore, user *models.User, challengeTTL time.Duration) (string, string, error) {
+	purpose := middleware.PurposeSession
+	if user.MFAEnabled {
+		purpose = middleware.PurposeMFA
+	} else {
+		required, err := mfa.RoleRequiresMFA(ctx, user.Role)
+		if err != nil {
+			return "", "", err
+		}
+		if required {
+			purpose = middleware.PurposeMFAEnroll
+		}
+	}
+
+	if purpose == middleware.PurposeSession {
+		token, err := signToken(keys, user)
+		return token, purpose, err
+	}
+	token, err := signPurposeToken(keys, user, purpose, challengeTTL)
+	return token, purpose, err
+}
+
+// VerifyMFA exchanges the MFA token from Login and a TOTP or recovery code
+// for a session token.
+func (h *AuthHandler) VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		MFAToken     string `json:"mfa_token" validate:"required"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	claims, err := middleware.ParseToken(r.Context(), h.Keys, h.Users, body.MFAToken)
+	if err != nil || claims.Purpose != middleware.PurposeMFA {
+		writeError(w, r, problem.Unauthenticated("invalid or expired mfa token"))
 		return
 	}
 
-	user, err := h.Users.GetByEmail(req.Email)
+	wait, err := h.Throttle.AttemptMFA(r.Context(), claims.UserID, h.IPs.ClientIP(r))
 	if err != nil {
-		jsonError(w, "invalid credentials", http.StatusUnauthorized)
+		writeError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, problem.New(problem.KindRateLimited, "mfa_throttled", "too many invalid codes, try again later"))
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		jsonError(w, "invalid credentials", http.StatusUnauthorized)
+	if err := verifySecondFactor(r.Context(), h.MFA, claims.UserID, body.Code, body.RecoveryCode); err != nil {
+		if errors.Is(err, models.ErrInvalidToken) {
+			writeError(w, r, problem.Unauthenticated("invalid code"))
+			return
+		}
+		writeError(w, r, err)
 		return
 	}
+	if err := h.Throttle.SucceedMFA(r.Context(), claims.UserID); err != nil {
+		slog.ErrorContext(r.Context(), "reset failed mfa attempts", "user_id", claims.UserID, "err", err)
+	}
 
-	token, err := h.generateToken(user)
+	user, err := h.Users.GetByID(r.Context(), claims.UserID)
+	if err != nil {
+		writeError(w, r, problem.Unauthenticated("invalid or expired mfa token"))
+		return
+	}
+	token, err := signToken(h.Keys, user)
 	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
@@ -102,20 +239,35 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(tokenResponse{Token: token, User: user})
 }
 
-func (h *AuthHandler) generateToken(user *models.User) (string, error) {
+// JWKS publishes the public keys that verify tokens issued by this server.
+func (h *AuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.Keys.JWKS())
+}
+
+func signToken(keys *jwtkeys.KeySet, user *models.User) (string, error) {
+	return signPurposeToken(keys, user, middleware.PurposeSession, 24*time.Hour)
+}
+
+func signPurposeToken(keys *jwtkeys.KeySet, user *models.User, purpose string, ttl time.Duration) (string, error) {
 	claims := &middleware.Claims{
-		UserID: user.ID,
-		Role:   user.Role,
+		UserID:         user.ID,
+		Role:           user.Role,
+		SessionVersion: user.SessionVersion,
+		TenantID:       user.TenantID,
+		Purpose:        purpose,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			Issuer:    keys.Issuer(),
+			Subject:   strconv.Itoa(user.ID),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(h.JWTSecret))
+	return keys.Sign(claims)
 }
 
-func jsonError(w http.ResponseWriter, msg string, code int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+// writeError answers r with err as problem details, see problem.Write.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	problem.Write(w, r, err)
 }
@@ -2,49 +2,49 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"helpdesk/server/middleware"
 	"helpdesk/server/models"
+	"helpdesk/server/problem"
 )
 
 type CommentHandler struct {
-	Comments *models.CommentStore
-	Tickets  *models.TicketStore
+	Comments       *models.CommentStore
+	Tickets        *models.TicketStore
+	Users          *models.UserStore
+	RequireIfMatch bool
 }
 
 func (h *CommentHandler) Create(w http.ResponseWriter, r *http.Request) {
 	ticketID, err := pathID(r, "id")
 	if err != nil {
-		jsonError(w, "invalid ticket id", http.StatusBadRequest)
+		writeError(w, r, problem.Invalid("invalid ticket id"))
 		return
 	}
 
-	ticket, err := h.Tickets.GetByID(ticketID)
+	ticket, err := h.Tickets.GetByID(r.Context(), ticketID)
 	if err != nil {
-		jsonError(w, "ticket not found", http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
-	role := middleware.RoleFromCtx(r.Context())
-	userID := middleware.UserIDFromCtx(r.Context())
-
-	if role == models.RoleUser && ticket.AuthorID != userID {
-		jsonError(w, "forbidden", http.StatusForbidden)
+	if !canReadTicket(r, h.Users, ticket) {
+		writeError(w, r, problem.Forbidden("forbidden"))
 		return
 	}
 
 	var body struct {
-		Content string `json:"content"`
+		Content string `json:"content" validate:"required"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Content == "" {
-		jsonError(w, "content is required", http.StatusBadRequest)
+	if !decode(w, r, &body) {
 		return
 	}
 
-	comment, err := h.Comments.Create(ticketID, userID, body.Content)
+	comment, err := h.Comments.Create(r.Context(), ticketID, middleware.UserIDFromCtx(r.Context()), body.Content)
 	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
@@ -56,27 +56,109 @@ func (h *CommentHandler) Create(w http.ResponseWriter, r *http.Request) {
 func (h *CommentHandler) List(w http.ResponseWriter, r *http.Request) {
 	ticketID, err := pathID(r, "id")
 	if err != nil {
-		jsonError(w, "invalid ticket id", http.StatusBadRequest)
+		writeError(w, r, problem.Invalid("invalid ticket id"))
+		return
+	}
+
+	ticket, err := h.Tickets.GetByID(r.Context(), ticketID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if !canReadTicket(r, h.Users, ticket) {
+		writeError(w, r, problem.Forbidden("forbidden"))
+		return
+	}
+
+	comments, err := h.Comments.ListByTicket(r.Context(), ticketID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if comments == nil {
+		comments = []*models.Comment{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comments)
+}
+
+func (h *CommentHandler) Update(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
 		return
 	}
 
-	ticket, err := h.Tickets.GetByID(ticketID)
+	comment, err := h.Comments.GetByID(r.Context(), id)
 	if err != nil {
-		jsonError(w, "ticket not found", http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
-	role := middleware.RoleFromCtx(r.Context())
 	userID := middleware.UserIDFromCtx(r.Context())
 
-	if role == models.RoleUser && ticket.AuthorID != userID {
-		jsonError(w, "forbidden", http.StatusForbidden)
+	if !middleware.HasPermission(r.Context(), models.PermCommentUpdateAny) && comment.UserID != userID {
+		writeError(w, r, problem.Forbidden("forbidden"))
 		return
 	}
 
-	comments, err := h.Comments.ListByTicket(ticketID)
+	version, err := matchVersion(r, comment.Version, h.RequireIfMatch)
 	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		preconditionError(w, r, err, comment.Version, comment)
+		return
+	}
+
+	var body struct {
+		Content string `json:"content" validate:"required"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	err = h.Comments.Update(r.Context(), id, version, body.Content)
+	if errors.Is(err, models.ErrVersionConflict) {
+		current, err := h.Comments.GetByID(r.Context(), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		preconditionError(w, r, errPreconditionFailed, current.Version, current)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	updated, err := h.Comments.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeVersioned(w, http.StatusOK, updated.Version, updated)
+}
+
+func (h *CommentHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+
+	if err := h.Comments.Delete(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *CommentHandler) ListDeleted(w http.ResponseWriter, r *http.Request) {
+	comments, err := h.Comments.ListDeleted(r.Context())
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	if comments == nil {
@@ -87,15 +169,16 @@ func (h *CommentHandler) List(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(comments)
 }
 
-func (h *CommentHandler) Delete(w http.ResponseWriter, r *http.Request) {
+func (h *CommentHandler) Restore(w http.ResponseWriter, r *http.Request) {
 	id, err := pathID(r, "id")
 	if err != nil {
-		jsonError(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, problem.Invalid("invalid id"))
 		return
 	}
 
-	if err := h.Comments.Delete(id); err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+	err = h.Comments.Restore(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"helpdesk/server/problem"
+	"helpdesk/server/validate"
+)
+
+// checker is implemented by request bodies with rules their validate tags
+// cannot express. check adds a message for every invalid field.
+type checker interface {
+	check(r *http.Request, fields map[string]string)
+}
+
+// decode reads the JSON body of r into v, rejecting unknown fields, and
+// validates it. It answers r itself and returns false if the body is not
+// acceptable, reporting all invalid fields at once.
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, r, bodyError(err))
+		return false
+	}
+
+	fields := validate.Struct(v)
+	if c, ok := v.(checker); ok {
+		c.check(r, fields)
+	}
+	if len(fields) > 0 {
+		writeError(w, r, problem.Validation(fields))
+		return false
+	}
+	return true
+}
+
+// decodePatch reads the JSON Merge Patch document in the body of r.
+func decodePatch(w http.ResponseWriter, r *http.Request) (map[string]json.RawMessage, bool) {
+	var doc map[string]json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&doc)
+	if err == nil && doc == nil {
+		err = errors.New("null patch")
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, bodyError(err))
+		} else {
+			writeError(w, r, problem.Invalid("body must be a JSON merge patch object"))
+		}
+		return nil, false
+	}
+	return doc, true
+}
+
+// bodyError explains why the request body could not be decoded.
+func bodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooLarge):
+		return problem.New(problem.KindTooLarge, "body_too_large", "request body too large")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return problem.Validation(map[string]string{typeErr.Field: "must be " + jsonType(typeErr.Type)})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields.
+		name, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return problem.Validation(map[string]string{name: "unknown field"})
+	case errors.Is(err, io.EOF):
+		return problem.Invalid("request body is required")
+	}
+	return problem.Invalid("request body must be a JSON object")
+}
+
+func jsonType(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
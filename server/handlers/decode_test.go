@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"helpdesk/server/problem"
+)
+
+func TestDecode(t *testing.T) {
+	const valid = `"username": "alice", "email": "alice@example.com", "password": "secret12"`
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		fields map[string]string
+	}{
+		{name: "valid", body: `{` + valid + `}`},
+		{
+			name: "role", body: `{` + valid + `, "role": "admin"}`,
+			status: http.StatusUnprocessableEntity,
+			fields: map[string]string{"role": "unknown field"},
+		},
+		{
+			name: "unknown field", body: `{` + valid + `, "is_admin": true}`,
+			status: http.StatusUnprocessableEntity,
+			fields: map[string]string{"is_admin": "unknown field"},
+		},
+		{
+			name: "wrong type", body: `{"username": 1, "email": "alice@example.com", "password": "secret12"}`,
+			status: http.StatusUnprocessableEntity,
+			fields: map[string]string{"username": "must be a string"},
+		},
+		{
+			name: "invalid fields", body: `{"email": "alice", "password": "secret"}`,
+			status: http.StatusUnprocessableEntity,
+			fields: map[string]string{
+				"username": "is required",
+				"email":    "must be a valid email address",
+				"password": "must be at least 8 characters, at most 72 bytes, and contain a letter and a digit or symbol",
+			},
+		},
+		{name: "empty", body: ``, status: http.StatusBadRequest},
+		{name: "not an object", body: `[]`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/auth/register", strings.NewReader(tt.body))
+
+			var req registerRequest
+			ok := decode(w, r, &req)
+			if ok != (tt.status == 0) {
+				t.Fatalf("decode = %v, want %v; response %s", ok, tt.status == 0, w.Body)
+			}
+			if ok {
+				return
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			var details problem.Details
+			if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if tt.fields != nil && !maps.Equal(details.Fields, tt.fields) {
+				t.Errorf("fields = %v, want %v", details.Fields, tt.fields)
+			}
+		})
+	}
+}
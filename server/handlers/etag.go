@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"helpdesk/server/problem"
+)
+
+var (
+	errIfMatchRequired    = problem.New(problem.KindPreconditionRequired, "if_match_required", "If-Match header is required")
+	errPreconditionFailed = errors.New("resource has been modified")
+)
+
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// matchVersion resolves the version a conditional write applies to. Without
+// an If-Match header the current version is used unless required is set.
+// If-Match uses the strong comparison of RFC 9110, so weak tags never match.
+func matchVersion(r *http.Request, current int, required bool) (int, error) {
+	header := strings.TrimSpace(strings.Join(r.Header.Values("If-Match"), ","))
+	if header == "" {
+		if required {
+			return 0, errIfMatchRequired
+		}
+		return current, nil
+	}
+	if header == "*" {
+		return current, nil
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag(current) {
+			return current, nil
+		}
+	}
+	return 0, errPreconditionFailed
+}
+
+func writeVersioned(w http.ResponseWriter, code, version int, v any) {
+	w.Header().Set("ETag", etag(version))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func preconditionError(w http.ResponseWriter, r *http.Request, err error, version int, current any) {
+	if errors.Is(err, errIfMatchRequired) {
+		writeError(w, r, err)
+		return
+	}
+	writeVersioned(w, http.StatusPreconditionFailed, version, current)
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		ifMatch  []string
+		required bool
+		want     int
+		err      error
+	}{
+		{name: "absent", want: 3},
+		{name: "absent but required", required: true, err: errIfMatchRequired},
+		{name: "current", ifMatch: []string{`"3"`}, want: 3},
+		{name: "stale", ifMatch: []string{`"2"`}, err: errPreconditionFailed},
+		{name: "unquoted", ifMatch: []string{`3`}, err: errPreconditionFailed},
+		{name: "weak", ifMatch: []string{`W/"3"`}, err: errPreconditionFailed},
+		{name: "any", ifMatch: []string{`*`}, required: true, want: 3},
+		{name: "list", ifMatch: []string{`"1", "3"`}, want: 3},
+		{name: "list without current", ifMatch: []string{`"1","2"`}, err: errPreconditionFailed},
+		{name: "list with weak current", ifMatch: []string{`"1", W/"3"`}, err: errPreconditionFailed},
+		{name: "repeated header", ifMatch: []string{`"1"`, `"3"`}, want: 3},
+		{name: "blank", ifMatch: []string{" "}, required: true, err: errIfMatchRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/api/tickets/1", nil)
+			for _, v := range tt.ifMatch {
+				r.Header.Add("If-Match", v)
+			}
+			got, err := matchVersion(r, 3, tt.required)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("version = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"helpdesk/server/db"
+)
+
+const readinessTimeout = 2 * time.Second
+
+type HealthHandler struct {
+	DB *sql.DB
+
+	draining atomic.Bool
+}
+
+// Drain makes the readiness check fail so that the load balancer stops
+// sending new requests while the server shuts down.
+func (h *HealthHandler) Drain() { h.draining.Store(true) }
+
+// Live reports that the process is up. It checks nothing else, so that a
+// database outage does not get every replica restarted.
+func (h *HealthHandler) Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Ready reports whether the server can take traffic: it is not shutting
+// down, the database answers and every migration has been applied.
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		notReady(w, "shutting down")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	if err := h.DB.PingContext(ctx); err != nil {
+		slog.WarnContext(ctx, "readiness: ping database", "err", err)
+		notReady(w, "database unavailable")
+		return
+	}
+	pending, err := db.PendingMigrations(ctx, h.DB)
+	if err != nil {
+		slog.WarnContext(ctx, "readiness: check migrations", "err", err)
+		notReady(w, "database unavailable")
+		return
+	}
+	if len(pending) > 0 {
+		notReady(w, "pending migrations: "+strings.Join(pending, ", "))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func notReady(w http.ResponseWriter, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]string{"status": "unavailable", "reason": reason})
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"helpdesk/server/jwtkeys"
+	"helpdesk/server/middleware"
+	"helpdesk/server/models"
+	"helpdesk/server/problem"
+)
+
+type ImpersonationHandler struct {
+	Users *models.UserStore
+	Roles *models.RoleStore
+	Audit *models.AuditStore
+	Keys  *jwtkeys.KeySet
+	IPs   *middleware.IPResolver
+	TTL   time.Duration
+}
+
+// Start issues a short-lived, read-only token that acts as the given user
+// while remembering the admin behind it. Admins can only impersonate users
+// whose permissions they hold themselves.
+func (h *ImpersonationHandler) Start(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+
+	actorID := middleware.UserIDFromCtx(r.Context())
+	if id == actorID {
+		writeError(w, r, problem.Invalid("cannot impersonate yourself"))
+		return
+	}
+
+	user, err := h.Users.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	ok, err := holdsPermissions(r.Context(), h.Roles, user.Role)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !ok {
+		writeError(w, r, problem.Forbidden("user has permissions you do not have"))
+		return
+	}
+
+	expiresAt := time.Now().Add(h.TTL)
+	token, err := h.Keys.Sign(&middleware.Claims{
+		UserID:         user.ID,
+		Role:           user.Role,
+		SessionVersion: user.SessionVersion,
+		TenantID:       user.TenantID,
+		ImpersonatorID: actorID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    h.Keys.Issuer(),
+			Subject:   strconv.Itoa(user.ID),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := h.Audit.Record(r.Context(), &models.AuditEntry{
+		Action:       models.AuditImpersonationStart,
+		ActorID:      &actorID,
+		TargetUserID: &user.ID,
+		IP:           h.IPs.ClientIP(r),
+		Details:      map[string]string{"expires_at": expiresAt.UTC().Format(time.RFC3339)},
+	}); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Token          string       `json:"token"`
+		User           *models.User `json:"user"`
+		ImpersonatorID int          `json:"impersonator_id"`
+		ExpiresAt      time.Time    `json:"expires_at"`
+	}{token, user, actorID, expiresAt})
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"helpdesk/server/authn"
+	"helpdesk/server/middleware"
+	"helpdesk/server/models"
+	"helpdesk/server/problem"
+)
+
+type LockoutHandler struct {
+	Users    *models.UserStore
+	Attempts *models.LoginAttemptStore
+	Audit    *models.AuditStore
+	IPs      *middleware.IPResolver
+}
+
+// List returns the account and IP keys that are currently locked out.
+func (h *LockoutHandler) List(w http.ResponseWriter, r *http.Request) {
+	locked, err := h.Attempts.ListLocked(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if locked == nil {
+		locked = []*models.LoginAttempt{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(locked)
+}
+
+// UnlockUser clears the failed logins under the email and the username, the
+// second-factor attempts, and any lockout, of a user's account.
+func (h *LockoutHandler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+
+	user, err := h.Users.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// LDAP users may sign in with their uid, which is counted under its own
+	// account key.
+	keys := []string{authn.AccountKey(user.Email), authn.AccountKey(user.Username), authn.MFAKey(user.ID)}
+	for _, k := range keys {
+		if err := h.Attempts.Reset(r.Context(), k); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	actorID := middleware.ActorIDFromCtx(r.Context())
+	if err := h.Audit.Record(r.Context(), &models.AuditEntry{
+		Action:       models.AuditLoginUnlock,
+		ActorID:      &actorID,
+		TargetUserID: &user.ID,
+		IP:           h.IPs.ClientIP(r),
+		Details:      map[string]string{"key": keys[0], "username_key": keys[1]},
+	}); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"helpdesk/server/authn"
+	"helpdesk/server/jwtkeys"
+	"helpdesk/server/mail"
+	"helpdesk/server/middleware"
+	"helpdesk/server/models"
+	"helpdesk/server/problem"
+	"helpdesk/server/validate"
+)
+
+const emailVerificationTTL = 24 * time.Hour
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+type MeHandler struct {
+	Users    *models.UserStore
+	Throttle *authn.Throttle
+	IPs      *middleware.IPResolver
+	Mailer   mail.Sender
+	Keys     *jwtkeys.KeySet
+	AppURL   string
+}
+
+func (h *MeHandler) Get(w http.ResponseWriter, r *http.Request) {
+	user, err := h.Users.GetByID(r.Context(), middleware.UserIDFromCtx(r.Context()))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeVersioned(w, http.StatusOK, user.Version, user)
+}
+
+// Update applies a JSON Merge Patch to the caller's profile. A changed email
+// only takes effect after it has been confirmed via ConfirmEmail; patching
+// an unverified email with itself sends a new confirmation link.
+func (h *MeHandler) Update(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.UserIDFromCtx(r.Context())
+	user, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	doc, ok := decodePatch(w, r)
+	if !ok {
+		return
+	}
+
+	patch, email, fields := parseProfilePatch(doc)
+	if email != nil && *email != user.Email {
+		if existing, err := h.Users.GetByEmail(r.Context(), *email); err == nil && existing.ID != userID {
+			fields["email"] = models.ErrEmailTaken.Error()
+		}
+	}
+	if len(fields) > 0 {
+		writeError(w, r, problem.Validation(fields))
+		return
+	}
+
+	if err := h.Users.UpdateProfile(r.Context(), userID, patch); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if email != nil && (*email != user.Email || !user.EmailVerified) {
+		if err := sendEmailConfirmation(r.Context(), h.Users, h.Mailer, h.AppURL, user, *email); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	updated, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeVersioned(w, http.StatusOK, updated.Version, updated)
+}
+
+// sendEmailConfirmation records email as the pending address of user and
+// mails it a link that confirms it.
+func sendEmailConfirmation(ctx context.Context, users *models.UserStore, mailer mail.Sender, appURL string,
+	user *models.User, email string) error {
+	token, tokenHash, err := newToken()
+	if err != nil {
+		return err
+	}
+	if err := users.SetPendingEmail(ctx, user.ID, email, tokenHash, time.Now().Add(emailVerificationTTL)); err != nil {
+		return err
+	}
+	return mailer.Send(mail.Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: "Hello " + user.Username + ",\n\n" +
+			"Confirm this address for your helpdesk account by opening:\n" +
+			appURL + "/#/verify-email?token=" + token + "\n\n" +
+			"The link expires in 24 hours. If you did not request this, ignore this message.\n",
+	})
+}
+
+func (h *MeHandler) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token" validate:"required"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	userID := middleware.UserIDFromCtx(r.Context())
+	err := h.Users.ConfirmEmail(r.Context(), userID, hashToken(body.Token))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	user, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeVersioned(w, http.StatusOK, user.Version, user)
+}
+
+// ChangePassword verifies the current password, stores the new one and
+// revokes every other session and all API keys. The response carries a fresh token for the
+// caller's own session.
+func (h *MeHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CurrentPassword string `json:"current_password" validate:"required"`
+		NewPassword     string `json:"new_password" validate:"required,password"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	user, err := h.Users.GetByID(r.Context(), middleware.UserIDFromCtx(r.Context()))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !checkPassword(w, r, h.Throttle, h.IPs, user, body.CurrentPassword) {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	user.SessionVersion, err = h.Users.ChangePassword(r.Context(), user.ID, string(hash))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	token, err := signToken(h.Keys, user)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokenResponse{Token: token, User: user})
+}
+
+func parseProfilePatch(doc map[string]json.RawMessage) (models.ProfilePatch, *string, map[string]string) {
+	var patch models.ProfilePatch
+	var email *string
+	fields := map[string]string{}
+
+	for name, raw := range doc {
+		isNull := string(raw) == "null"
+		switch name {
+		case "display_name":
+			var v *string
+			if json.Unmarshal(raw, &v) != nil || (v != nil && validate.Var(*v, "max=128") != "") {
+				fields[name] = "must be a string of at most 128 characters or null"
+				continue
+			}
+			patch.SetDisplayName = true
+			patch.DisplayName = v
+		case "email":
+			var v string
+			if isNull || json.Unmarshal(raw, &v) != nil || !validate.Email(v) {
+				fields[name] = "must be a valid email address"
+				continue
+			}
+			email = &v
+		case "timezone":
+			var v string
+			if isNull || json.Unmarshal(raw, &v) != nil || v == "" {
+				fields[name] = "must be an IANA time zone name"
+				continue
+			}
+			if _, err := time.LoadLocation(v); err != nil {
+				fields[name] = "must be an IANA time zone name"
+				continue
+			}
+			patch.Timezone = &v
+		case "locale":
+			var v string
+			if isNull || json.Unmarshal(raw, &v) != nil || !localePattern.MatchString(v) || len(v) > 16 {
+				fields[name] = "must be a BCP 47 language tag"
+				continue
+			}
+			patch.Locale = &v
+		case "notification_prefs":
+			var v models.NotificationPrefs
+			if isNull || json.Unmarshal(raw, &v) != nil {
+				fields[name] = "must be an object of boolean flags"
+				continue
+			}
+			patch.NotificationPrefs = v
+		default:
+			fields[name] = "unknown field"
+		}
+	}
+	return patch, email, fields
+}
+
+// checkPassword verifies the password a signed-in user re-enters, with the
+// attempts counted like logins. It answers the request and returns false if
+// the password is wrong or the account is throttled.
+func checkPassword(w http.ResponseWriter, r *http.Request, throttle *authn.Throttle, ips *middleware.IPResolver,
+	user *models.User, password string) bool {
+	ip := ips.ClientIP(r)
+	wait, err := throttle.AttemptReauth(r.Context(), user, ip)
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, problem.New(problem.KindRateLimited, "login_throttled", "too many failed attempts, try again later"))
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		writeError(w, r, problem.Forbidden("current password is incorrect"))
+		return false
+	}
+	if err := throttle.Succeed(r.Context(), user.Email, ip); err != nil {
+		slog.ErrorContext(r.Context(), "reset failed login attempts", "user_id", user.ID, "err", err)
+	}
+	return true
+}
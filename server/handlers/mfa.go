@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"helpdesk/server/authn"
+	"helpdesk/server/jwtkeys"
+	"helpdesk/server/middleware"
+	"helpdesk/server/models"
+	"helpdesk/server/problem"
+	"helpdesk/server/totp"
+)
+
+const recoveryCodeCount = 10
+
+var errMFAEnabled = problem.Conflict("mfa_enabled", "two-factor authentication is already enabled")
+
+type MFAHandler struct {
+	Users    *models.UserStore
+	MFA      *models.MFAStore
+	Throttle *authn.Throttle
+	IPs      *middleware.IPResolver
+	Keys     *jwtkeys.KeySet
+	Issuer   string
+}
+
+// Enroll starts TOTP enrollment and returns the secret together with the
+// otpauth:// URI to render as a QR code. TOTP is only enabled once a code
+// generated from it has been verified.
+func (h *MFAHandler) Enroll(w http.ResponseWriter, r *http.Request) {
+	user, err := h.Users.GetByID(r.Context(), middleware.UserIDFromCtx(r.Context()))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if user.MFAEnabled {
+		writeError(w, r, errMFAEnabled)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := h.MFA.StartEnrollment(r.Context(), user.ID, secret); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(h.Issuer, user.Email, secret),
+	})
+}
+
+// Verify confirms enrollment with a code from the authenticator app. The
+// response holds the recovery codes, which are not shown again, and a session
+// token so that users enrolling during login can continue.
+func (h *MFAHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code string `json:"code" validate:"required"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	userID := middleware.UserIDFromCtx(r.Context())
+	secret, enabled, err := h.MFA.TOTPSecret(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if enabled {
+		writeError(w, r, errMFAEnabled)
+		return
+	}
+
+	step, ok := totp.Validate(secret, body.Code, time.Now())
+	if !ok || h.MFA.UseStep(r.Context(), userID, step) != nil {
+		writeError(w, r, problem.Unauthenticated("invalid code"))
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := h.MFA.Enable(r.Context(), userID, hashes); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	user, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	token, err := signToken(h.Keys, user)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":          token,
+		"user":           user,
+		"recovery_codes": codes,
+	})
+}
+
+// Disable turns TOTP off after checking the password, or a current code for
+// accounts that sign in through SSO or LDAP and have no local password.
+func (h *MFAHandler) Disable(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	user, err := h.Users.GetByID(r.Context(), middleware.UserIDFromCtx(r.Context()))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	switch {
+	case user.PasswordHash != "" && body.Password == "":
+		writeError(w, r, problem.Validation(map[string]string{"password": "is required"}))
+		return
+	case user.PasswordHash != "":
+		if !checkPassword(w, r, h.Throttle, h.IPs, user, body.Password) {
+			return
+		}
+	case body.Code == "":
+		writeError(w, r, problem.Validation(map[string]string{"code": "is required"}))
+		return
+	default:
+		if !h.checkCode(w, r, user.ID, body.Code) {
+			return
+		}
+	}
+
+	required, err := h.MFA.RoleRequiresMFA(r.Context(), user.Role)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if required {
+		writeError(w, r, problem.Forbidden("two-factor authentication is required for your role"))
+		return
+	}
+
+	if err := h.MFA.Disable(r.Context(), user.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a
+// current TOTP code.
+func (h *MFAHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code string `json:"code" validate:"required"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	userID := middleware.UserIDFromCtx(r.Context())
+	if !h.checkCode(w, r, userID, body.Code) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := h.MFA.ReplaceRecoveryCodes(r.Context(), userID, hashes); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+func (h *MFAHandler) GetPolicy(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.MFA.RequiredRoles(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]models.Role{"required_roles": roles})
+}
+
+func (h *MFAHandler) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RequiredRoles []models.Role `json:"required_roles"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+	err := h.MFA.SetRequiredRoles(r.Context(), body.RequiredRoles)
+	if errors.Is(err, models.ErrUnknownRole) {
+		writeError(w, r, problem.Validation(map[string]string{"required_roles": "must contain only existing roles"}))
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	h.GetPolicy(w, r)
+}
+
+// checkCode verifies a current TOTP code of a signed-in user, with the
+// attempts counted like those at login. It answers the request and returns
+// false if the code is wrong or the user is throttled.
+func (h *MFAHandler) checkCode(w http.ResponseWriter, r *http.Request, userID int, code string) bool {
+	wait, err := h.Throttle.AttemptMFA(r.Context(), userID, h.IPs.ClientIP(r))
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, problem.New(problem.KindRateLimited, "mfa_throttled", "too many invalid codes, try again later"))
+		return false
+	}
+	if err := verifySecondFactor(r.Context(), h.MFA, userID, code, ""); err != nil {
+		if errors.Is(err, models.ErrInvalidToken) {
+			writeError(w, r, problem.Unauthenticated("invalid code"))
+			return false
+		}
+		writeError(w, r, err)
+		return false
+	}
+	if err := h.Throttle.SucceedMFA(r.Context(), userID); err != nil {
+		slog.ErrorContext(r.Context(), "reset failed mfa attempts", "user_id", userID, "err", err)
+	}
+	return true
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+func verifySecondFactor(ctx context.Context, store *models.MFAStore, userID int, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		return store.UseRecoveryCode(ctx, userID, hashToken(normalizeRecoveryCode(recoveryCode)))
+	}
+
+	secret, enabled, err := store.TOTPSecret(ctx, userID)
+	if errors.Is(err, models.ErrMFANotEnrolled) || (err == nil && !enabled) {
+		return models.ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return models.ErrInvalidToken
+	}
+	return store.UseStep(ctx, userID, step)
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(enc.EncodeToString(b))
+		codes[i] = raw[:4] + "-" + raw[4:]
+		hashes[i] = hashToken(raw)
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
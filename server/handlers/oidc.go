@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"helpdesk/server/authn"
+	"helpdesk/server/jwtkeys"
+	"helpdesk/server/middleware"
+	"helpdesk/server/models"
+	"helpdesk/server/sso"
+)
+
+const (
+	oidcFlowTTL = 10 * time.Minute
+
+	// oidcStateCookie binds a flow to the browser that started it, so a
+	// callback carrying someone else's state is not accepted.
+	oidcStateCookie = "oidc_state"
+	oidcCookiePath  = "/api/auth/oidc"
+)
+
+type OIDCHandler struct {
+	Provider        *sso.Provider
+	Flows           *models.OIDCFlowStore
+	Users           *models.UserStore
+	MFA             *models.MFAStore
+	Keys            *jwtkeys.KeySet
+	AppURL          string
+	RedirectURL     string
+	MFAChallengeTTL time.Duration
+}
+
+// Login redirects the browser to the identity provider.
+func (h *OIDCHandler) Login(w http.ResponseWriter, r *http.Request) {
+	flow := models.OIDCFlow{
+		State:        randomHex(16),
+		Nonce:        randomHex(16),
+		CodeVerifier: oauth2.GenerateVerifier(),
+	}
+	if err := h.Flows.Create(r.Context(), flow, time.Now().Add(oidcFlowTTL)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, h.stateCookie(flow.State, int(oidcFlowTTL.Seconds())))
+	http.Redirect(w, r, h.Provider.AuthCodeURL(flow.State, flow.Nonce, flow.CodeVerifier, h.RedirectURL), http.StatusFound)
+}
+
+// Callback completes the flow started in the same browser, provisions or updates the local user and hands
+// the session token to the client in the URL fragment. Roles follow the IdP
+// groups when a group mapping is configured. Users who have to verify or
+// enroll a second factor get an MFA token instead, as with password login.
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	cookie, _ := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, h.stateCookie("", -1))
+	if e := q.Get("error"); e != "" {
+		slog.WarnContext(r.Context(), "oidc callback: provider returned error", "error", e, "description", q.Get("error_description"))
+		h.redirectError(w, r, "sso_denied")
+		return
+	}
+
+	if cookie == nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(q.Get("state"))) != 1 {
+		slog.WarnContext(r.Context(), "oidc callback: state does not match the browser's cookie")
+		h.redirectError(w, r, "sso_state_mismatch")
+		return
+	}
+
+	flow, err := h.Flows.Take(r.Context(), q.Get("state"))
+	if err != nil {
+		h.redirectError(w, r, "sso_expired")
+		return
+	}
+
+	identity, err := h.Provider.Exchange(r.Context(), q.Get("code"), flow.CodeVerifier, flow.Nonce, h.RedirectURL)
+	if errors.Is(err, sso.ErrEmailNotVerified) {
+		h.redirectError(w, r, "sso_email_unverified")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc callback", "err", err)
+		h.redirectError(w, r, "sso_failed")
+		return
+	}
+
+	user, err := authn.SyncUser(r.Context(), h.Users, identity, h.Provider.MapsRoles())
+	if errors.Is(err, authn.ErrLocalAccount) {
+		slog.WarnContext(r.Context(), "oidc callback: email belongs to a password account", "email", identity.Email)
+		h.redirectError(w, r, "sso_account_exists")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc callback: provision", "email", identity.Email, "err", err)
+		h.redirectError(w, r, "sso_failed")
+		return
+	}
+
+	token, purpose, err := loginToken(r.Context(), h.Keys, h.MFA, user, h.MFAChallengeTTL)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc callback: issue token", "user_id", user.ID, "err", err)
+		h.redirectError(w, r, "sso_failed")
+		return
+	}
+	fragment := url.Values{"token": {token}}
+	switch purpose {
+	case middleware.PurposeMFA:
+		fragment = url.Values{"mfa_token": {token}, "mfa": {"required"}}
+	case middleware.PurposeMFAEnroll:
+		fragment = url.Values{"mfa_token": {token}, "mfa": {"enroll"}}
+	}
+	http.Redirect(w, r, h.AppURL+"/#/oidc-callback?"+fragment.Encode(), http.StatusFound)
+}
+
+func (h *OIDCHandler) redirectError(w http.ResponseWriter, r *http.Request, code string) {
+	http.Redirect(w, r, h.AppURL+"/#/login?error="+code, http.StatusFound)
+}
+
+// stateCookie returns the cookie holding the state of a flow; a negative
+// maxAge deletes it.
+func (h *OIDCHandler) stateCookie(state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     oidcCookiePath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.AppURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
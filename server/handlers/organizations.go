@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"helpdesk/server/models"
+	"helpdesk/server/problem"
+)
+
+type OrganizationHandler struct {
+	Orgs *models.OrganizationStore
+}
+
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+type organizationRequest struct {
+	Name           string   `json:"name" validate:"required,max=128"`
+	Domains        []string `json:"domains"`
+	ShareByDefault *bool    `json:"share_by_default"`
+}
+
+// check normalizes the name and domains and applies the defaults.
+func (req *organizationRequest) check(r *http.Request, fields map[string]string) {
+	req.Name = strings.TrimSpace(req.Name)
+	seen := map[string]bool{}
+	for i, d := range req.Domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if !domainPattern.MatchString(d) || seen[d] {
+			fields["domains"] = "must be distinct domain names such as example.com"
+			break
+		}
+		seen[d] = true
+		req.Domains[i] = d
+	}
+	if req.Domains == nil {
+		req.Domains = []string{}
+	}
+	if req.ShareByDefault == nil {
+		share := true
+		req.ShareByDefault = &share
+	}
+}
+
+func (h *OrganizationHandler) List(w http.ResponseWriter, r *http.Request) {
+	orgs, err := h.Orgs.List(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if orgs == nil {
+		orgs = []*models.Organization{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orgs)
+}
+
+func (h *OrganizationHandler) Get(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+	org, err := h.Orgs.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+func (h *OrganizationHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req organizationRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	org, err := h.Orgs.Create(r.Context(), req.Name, req.Domains, *req.ShareByDefault)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+func (h *OrganizationHandler) Update(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+
+	var req organizationRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	org, err := h.Orgs.Update(r.Context(), id, req.Name, req.Domains, *req.ShareByDefault)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+func (h *OrganizationHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+
+	err = h.Orgs.Delete(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetMembership puts a user into an organization, optionally as manager, or
+// removes them from it with a null organization_id.
+func (h *OrganizationHandler) SetMembership(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+
+	var body struct {
+		OrganizationID *int `json:"organization_id"`
+		Manager        bool `json:"manager"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	err = h.Orgs.SetMembership(r.Context(), id, body.OrganizationID, body.Manager)
+	if errors.Is(err, models.ErrUnknownOrg) {
+		writeError(w, r, problem.Validation(map[string]string{"organization_id": err.Error()}))
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
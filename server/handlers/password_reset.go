@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"helpdesk/server/mail"
+)
+
+// RequestPasswordReset always answers 202 so that the response does not
+// reveal whether an account exists for the given email.
+func (h *AuthHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	// The mail goes out after the response, so the request must not cancel it.
+	go h.sendPasswordReset(context.WithoutCancel(r.Context()), body.Email)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *AuthHandler) sendPasswordReset(ctx context.Context, email string) {
+	user, err := h.Users.GetByEmail(ctx, email)
+	if err != nil {
+		return
+	}
+
+	token, tokenHash, err := newToken()
+	if err != nil {
+		slog.ErrorContext(ctx, "password reset", "user_id", user.ID, "err", err)
+		return
+	}
+	if err := h.Resets.Create(ctx, user.ID, tokenHash, time.Now().Add(h.PasswordResetTTL)); err != nil {
+		slog.ErrorContext(ctx, "password reset", "user_id", user.ID, "err", err)
+		return
+	}
+
+	err = h.Mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your helpdesk password",
+		Body: "Hello " + user.Username + ",\n\n" +
+			"Someone asked to reset the password of your helpdesk account. To choose a new one, open:\n" +
+			h.AppURL + "/#/reset-password?token=" + token + "\n\n" +
+			"The link can be used once and expires in " + h.PasswordResetTTL.String() + ". " +
+			"If you did not ask for this, ignore this message.\n",
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "password reset: send mail", "user_id", user.ID, "err", err)
+	}
+}
+
+func (h *AuthHandler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token       string `json:"token" validate:"required"`
+		NewPassword string `json:"new_password" validate:"required,password"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	_, err = h.Resets.Consume(r.Context(), hashToken(body.Token), string(hash))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
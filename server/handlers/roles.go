@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"helpdesk/server/models"
+)
+
+type RoleHandler struct {
+	Roles *models.RoleStore
+}
+
+type roleRequest struct {
+	Description string   `json:"description" validate:"max=255"`
+	Permissions []string `json:"permissions"`
+}
+
+// createRoleRequest adds the name, which Update takes from the path instead.
+type createRoleRequest struct {
+	Name models.Role `json:"name"`
+	roleRequest
+}
+
+func (req *createRoleRequest) check(r *http.Request, fields map[string]string) {
+	if !models.ValidRoleName(string(req.Name)) {
+		fields["name"] = "must be 2-64 lowercase letters, digits, '-' or '_', starting with a letter"
+	}
+	req.roleRequest.check(r, fields)
+}
+
+func (req *roleRequest) check(r *http.Request, fields map[string]string) {
+	if req.Permissions == nil {
+		req.Permissions = []string{}
+	}
+	for _, p := range req.Permissions {
+		if !models.ValidPermission(p) {
+			fields["permissions"] = "unknown permission " + p
+			break
+		}
+	}
+}
+
+func (h *RoleHandler) ListPermissions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.Permissions)
+}
+
+func (h *RoleHandler) List(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.Roles.List(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if roles == nil {
+		roles = []*models.RoleDefinition{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+func (h *RoleHandler) Get(w http.ResponseWriter, r *http.Request) {
+	role, err := h.Roles.Get(r.Context(), models.Role(r.PathValue("name")))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+func (h *RoleHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req createRoleRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	role, err := h.Roles.Create(r.Context(), req.Name, req.Description, req.Permissions)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(role)
+}
+
+func (h *RoleHandler) Update(w http.ResponseWriter, r *http.Request) {
+	var req roleRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	role, err := h.Roles.Update(r.Context(), models.Role(r.PathValue("name")), req.Description, req.Permissions)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+func (h *RoleHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	err := h.Roles.Delete(r.Context(), models.Role(r.PathValue("name")))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,28 +2,30 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 
 	"helpdesk/server/middleware"
 	"helpdesk/server/models"
+	"helpdesk/server/problem"
+	"helpdesk/server/validate"
 )
 
 type TicketHandler struct {
-	Tickets *models.TicketStore
+	Tickets        *models.TicketStore
+	Users          *models.UserStore
+	RequireIfMatch bool
 }
 
 func (h *TicketHandler) Create(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		Title       string                `json:"title"`
-		Description string                `json:"description"`
-		Priority    models.TicketPriority `json:"priority"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		jsonError(w, "invalid body", http.StatusBadRequest)
-		return
+		Title       string                `json:"title" validate:"required,max=255"`
+		Description string                `json:"description" validate:"required"`
+		Priority    models.TicketPriority `json:"priority" validate:"oneof=low medium high critical"`
+		Shared      *bool                 `json:"shared"`
 	}
-	if body.Title == "" || body.Description == "" {
-		jsonError(w, "title and description are required", http.StatusBadRequest)
+	if !decode(w, r, &body) {
 		return
 	}
 	if body.Priority == "" {
@@ -31,9 +33,9 @@ func (h *TicketHandler) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	authorID := middleware.UserIDFromCtx(r.Context())
-	ticket, err := h.Tickets.Create(body.Title, body.Description, body.Priority, authorID)
+	ticket, err := h.Tickets.Create(r.Context(), body.Title, body.Description, body.Priority, authorID, body.Shared)
 	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
@@ -43,17 +45,26 @@ func (h *TicketHandler) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *TicketHandler) List(w http.ResponseWriter, r *http.Request) {
-	role := middleware.RoleFromCtx(r.Context())
-	userID := middleware.UserIDFromCtx(r.Context())
+	var filter models.TicketFilter
+	if v := r.URL.Query().Get("organization_id"); v != "" {
+		orgID, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, r, problem.Invalid("invalid organization_id"))
+			return
+		}
+		filter.OrganizationID = &orgID
+	}
 
-	var authorFilter *int
-	if role == models.RoleUser {
-		authorFilter = &userID
+	viewer, err := ticketViewer(r, h.Users)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
+	filter.Viewer = viewer
 
-	tickets, err := h.Tickets.List(authorFilter)
+	tickets, err := h.Tickets.List(r.Context(), filter)
 	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	if tickets == nil {
@@ -67,106 +78,294 @@ func (h *TicketHandler) List(w http.ResponseWriter, r *http.Request) {
 func (h *TicketHandler) Get(w http.ResponseWriter, r *http.Request) {
 	id, err := pathID(r, "id")
 	if err != nil {
-		jsonError(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, problem.Invalid("invalid id"))
 		return
 	}
 
-	ticket, err := h.Tickets.GetByID(id)
+	ticket, err := h.Tickets.GetByID(r.Context(), id)
 	if err != nil {
-		jsonError(w, "ticket not found", http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
-	role := middleware.RoleFromCtx(r.Context())
-	userID := middleware.UserIDFromCtx(r.Context())
-	if role == models.RoleUser && ticket.AuthorID != userID {
-		jsonError(w, "forbidden", http.StatusForbidden)
+	if !canReadTicket(r, h.Users, ticket) {
+		writeError(w, r, problem.Forbidden("forbidden"))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ticket)
+	writeVersioned(w, http.StatusOK, ticket.Version, ticket)
 }
 
 func (h *TicketHandler) Update(w http.ResponseWriter, r *http.Request) {
+	ticket, version, ok := h.loadForWrite(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	var body struct {
+		Title       string                `json:"title" validate:"max=255"`
+		Description string                `json:"description"`
+		Priority    models.TicketPriority `json:"priority" validate:"oneof=low medium high critical"`
+		Status      models.TicketStatus   `json:"status" validate:"oneof=open in_progress resolved closed"`
+		AssignedTo  *int                  `json:"assigned_to"`
+		Shared      *bool                 `json:"shared"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+
+	var patch models.TicketPatch
+	if body.Title != "" {
+		patch.Title = &body.Title
+	}
+	if body.Description != "" {
+		patch.Description = &body.Description
+	}
+	if body.Priority != "" {
+		patch.Priority = &body.Priority
+	}
+	patch.Shared = body.Shared
+	if middleware.HasPermission(ctx, models.PermTicketUpdateAny) && body.Status != "" {
+		patch.Status = &body.Status
+	}
+	if middleware.HasPermission(ctx, models.PermTicketAssign) && !sameAssignee(body.AssignedTo, ticket.AssignedTo) {
+		patch.SetAssignee = true
+		patch.AssignedTo = body.AssignedTo
+	}
+
+	h.applyPatch(w, r, ticket, version, patch)
+}
+
+// Patch applies an RFC 7396 JSON Merge Patch: absent members are left
+// untouched and null clears the member where that is allowed.
+func (h *TicketHandler) Patch(w http.ResponseWriter, r *http.Request) {
+	ticket, version, ok := h.loadForWrite(w, r)
+	if !ok {
+		return
+	}
+	doc, ok := decodePatch(w, r)
+	if !ok {
+		return
+	}
+
+	patch, fields := parseTicketPatch(doc,
+		middleware.HasPermission(r.Context(), models.PermTicketUpdateAny),
+		middleware.HasPermission(r.Context(), models.PermTicketAssign))
+	if len(fields) > 0 {
+		writeError(w, r, problem.Validation(fields))
+		return
+	}
+
+	h.applyPatch(w, r, ticket, version, patch)
+}
+
+// loadForWrite fetches the ticket addressed by the request, checks that the
+// caller may edit it and resolves the version the write applies to.
+func (h *TicketHandler) loadForWrite(w http.ResponseWriter, r *http.Request) (*models.Ticket, int, bool) {
 	id, err := pathID(r, "id")
 	if err != nil {
-		jsonError(w, "invalid id", http.StatusBadRequest)
-		return
+		writeError(w, r, problem.Invalid("invalid id"))
+		return nil, 0, false
 	}
 
-	ticket, err := h.Tickets.GetByID(id)
+	ticket, err := h.Tickets.GetByID(r.Context(), id)
 	if err != nil {
-		jsonError(w, "ticket not found", http.StatusNotFound)
-		return
+		writeError(w, r, err)
+		return nil, 0, false
 	}
 
-	role := middleware.RoleFromCtx(r.Context())
 	userID := middleware.UserIDFromCtx(r.Context())
 
-	if role == models.RoleUser {
+	if !middleware.HasPermission(r.Context(), models.PermTicketUpdateAny) {
 		if ticket.AuthorID != userID {
-			jsonError(w, "forbidden", http.StatusForbidden)
-			return
+			writeError(w, r, problem.Forbidden("forbidden"))
+			return nil, 0, false
 		}
 		if ticket.Status != models.StatusOpen {
-			jsonError(w, "can only edit open tickets", http.StatusForbidden)
-			return
+			writeError(w, r, problem.Forbidden("can only edit open tickets"))
+			return nil, 0, false
 		}
 	}
 
-	var body struct {
-		Title       string                `json:"title"`
-		Description string                `json:"description"`
-		Priority    models.TicketPriority `json:"priority"`
-		Status      models.TicketStatus   `json:"status"`
-		AssignedTo  *int                  `json:"assigned_to"`
+	version, err := matchVersion(r, ticket.Version, h.RequireIfMatch)
+	if err != nil {
+		preconditionError(w, r, err, ticket.Version, ticket)
+		return nil, 0, false
 	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		jsonError(w, "invalid body", http.StatusBadRequest)
+	return ticket, version, true
+}
+
+func (h *TicketHandler) applyPatch(w http.ResponseWriter, r *http.Request, ticket *models.Ticket, version int, patch models.TicketPatch) {
+	if patch.Empty() {
+		writeVersioned(w, http.StatusOK, ticket.Version, ticket)
 		return
 	}
 
-	if body.Title == "" {
-		body.Title = ticket.Title
+	err := h.Tickets.Patch(r.Context(), ticket.ID, version, patch)
+	if errors.Is(err, models.ErrInvalidAssignee) {
+		writeError(w, r, problem.Validation(map[string]string{"assigned_to": err.Error()}))
+		return
 	}
-	if body.Description == "" {
-		body.Description = ticket.Description
+	if errors.Is(err, models.ErrVersionConflict) {
+		current, err := h.Tickets.GetByID(r.Context(), ticket.ID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		preconditionError(w, r, errPreconditionFailed, current.Version, current)
+		return
 	}
-	if body.Priority == "" {
-		body.Priority = ticket.Priority
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
-	if body.Status == "" {
-		body.Status = ticket.Status
+
+	updated, err := h.Tickets.GetByID(r.Context(), ticket.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
+	writeVersioned(w, http.StatusOK, updated.Version, updated)
+}
 
-	if role == models.RoleUser {
-		body.Status = ticket.Status
+// parseTicketPatch validates a merge patch. Status changes need canUpdateAny
+// and assignment needs canAssign.
+func parseTicketPatch(doc map[string]json.RawMessage, canUpdateAny, canAssign bool) (models.TicketPatch, map[string]string) {
+	var patch models.TicketPatch
+	fields := map[string]string{}
+
+	for name, raw := range doc {
+		isNull := string(raw) == "null"
+		switch name {
+		case "title", "description":
+			var v string
+			if isNull || json.Unmarshal(raw, &v) != nil || v == "" {
+				fields[name] = "must be a non-empty string"
+				continue
+			}
+			if name == "title" {
+				if msg := validate.Var(v, "max=255"); msg != "" {
+					fields[name] = msg
+					continue
+				}
+				patch.Title = &v
+			} else {
+				patch.Description = &v
+			}
+		case "priority":
+			var v models.TicketPriority
+			if isNull || json.Unmarshal(raw, &v) != nil || !v.Valid() {
+				fields[name] = "must be one of low, medium, high, critical"
+				continue
+			}
+			patch.Priority = &v
+		case "status":
+			if !canUpdateAny {
+				fields[name] = "not permitted for your role"
+				continue
+			}
+			var v models.TicketStatus
+			if isNull || json.Unmarshal(raw, &v) != nil || !v.Valid() {
+				fields[name] = "must be one of open, in_progress, resolved, closed"
+				continue
+			}
+			patch.Status = &v
+		case "shared":
+			var v bool
+			if isNull || json.Unmarshal(raw, &v) != nil {
+				fields[name] = "must be a boolean"
+				continue
+			}
+			patch.Shared = &v
+		case "assigned_to":
+			if !canAssign {
+				fields[name] = "not permitted for your role"
+				continue
+			}
+			var v *int
+			if json.Unmarshal(raw, &v) != nil {
+				fields[name] = "must be a user id or null"
+				continue
+			}
+			patch.SetAssignee = true
+			patch.AssignedTo = v
+		default:
+			fields[name] = "unknown field"
+		}
 	}
+	return patch, fields
+}
+
+// ticketViewer returns the visibility restriction for the caller, or nil if
+// they may read every ticket.
+func ticketViewer(r *http.Request, users *models.UserStore) (*models.Viewer, error) {
+	if middleware.HasPermission(r.Context(), models.PermTicketReadAny) {
+		return nil, nil
+	}
+	user, err := users.GetByID(r.Context(), middleware.UserIDFromCtx(r.Context()))
+	if err != nil {
+		return nil, err
+	}
+	return &models.Viewer{
+		UserID:         user.ID,
+		OrganizationID: user.OrganizationID,
+		OrgManager:     user.OrgManager,
+	}, nil
+}
 
-	if err := h.Tickets.Update(id, body.Title, body.Description, body.Priority, body.Status); err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+// canReadTicket reports whether the caller may see ticket and its comments.
+func canReadTicket(r *http.Request, users *models.UserStore, ticket *models.Ticket) bool {
+	viewer, err := ticketViewer(r, users)
+	return err == nil && viewer.CanSee(ticket)
+}
+
+func sameAssignee(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func (h *TicketHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+
+	if err := h.Tickets.Delete(r.Context(), id); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	if role != models.RoleUser && body.AssignedTo != ticket.AssignedTo {
-		h.Tickets.UpdateAssignee(id, body.AssignedTo)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TicketHandler) ListDeleted(w http.ResponseWriter, r *http.Request) {
+	tickets, err := h.Tickets.ListDeleted(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if tickets == nil {
+		tickets = []*models.Ticket{}
 	}
 
-	updated, _ := h.Tickets.GetByID(id)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(updated)
+	json.NewEncoder(w).Encode(tickets)
 }
 
-func (h *TicketHandler) Delete(w http.ResponseWriter, r *http.Request) {
+func (h *TicketHandler) Restore(w http.ResponseWriter, r *http.Request) {
 	id, err := pathID(r, "id")
 	if err != nil {
-		jsonError(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, problem.Invalid("invalid id"))
 		return
 	}
 
-	if err := h.Tickets.Delete(id); err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+	err = h.Tickets.Restore(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
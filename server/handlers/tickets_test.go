@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"helpdesk/server/models"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestParseTicketPatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		doc       string
+		updateAny bool
+		assign    bool
+		want      models.TicketPatch
+		fields    map[string]string
+	}{
+		{name: "empty", doc: `{}`},
+		{
+			name: "fields",
+			doc:  `{"title":"Printer","description":"Out of toner","priority":"high","shared":false}`,
+			want: models.TicketPatch{
+				Title:       ptr("Printer"),
+				Description: ptr("Out of toner"),
+				Priority:    ptr(models.PriorityHigh),
+				Shared:      ptr(false),
+			},
+		},
+		{
+			name:      "status",
+			doc:       `{"status":"resolved"}`,
+			updateAny: true,
+			want:      models.TicketPatch{Status: ptr(models.StatusResolved)},
+		},
+		{
+			name:   "status not permitted",
+			doc:    `{"status":"resolved"}`,
+			fields: map[string]string{"status": "not permitted for your role"},
+		},
+		{
+			name:   "assign",
+			doc:    `{"assigned_to":7}`,
+			assign: true,
+			want:   models.TicketPatch{SetAssignee: true, AssignedTo: ptr(7)},
+		},
+		{
+			name:   "null unassigns",
+			doc:    `{"assigned_to":null}`,
+			assign: true,
+			want:   models.TicketPatch{SetAssignee: true},
+		},
+		{
+			name:   "assign not permitted",
+			doc:    `{"assigned_to":null}`,
+			fields: map[string]string{"assigned_to": "not permitted for your role"},
+		},
+		{
+			name:   "assignee of the wrong type",
+			doc:    `{"assigned_to":"bob"}`,
+			assign: true,
+			fields: map[string]string{"assigned_to": "must be a user id or null"},
+		},
+		{
+			name: "null for fields that cannot be cleared",
+			doc:  `{"title":null,"description":null,"priority":null,"shared":null}`,
+			fields: map[string]string{
+				"title":       "must be a non-empty string",
+				"description": "must be a non-empty string",
+				"priority":    "must be one of low, medium, high, critical",
+				"shared":      "must be a boolean",
+			},
+		},
+		{
+			name:   "empty title",
+			doc:    `{"title":""}`,
+			fields: map[string]string{"title": "must be a non-empty string"},
+		},
+		{
+			name:   "long title",
+			doc:    `{"title":"` + strings.Repeat("a", 256) + `"}`,
+			fields: map[string]string{"title": "must be at most 255 characters"},
+		},
+		{
+			name:      "unknown values",
+			doc:       `{"priority":"urgent","status":"done"}`,
+			updateAny: true,
+			fields: map[string]string{
+				"priority": "must be one of low, medium, high, critical",
+				"status":   "must be one of open, in_progress, resolved, closed",
+			},
+		},
+		{
+			name:   "unknown field",
+			doc:    `{"id":5}`,
+			fields: map[string]string{"id": "unknown field"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tt.doc), &doc); err != nil {
+				t.Fatal(err)
+			}
+			patch, fields := parseTicketPatch(doc, tt.updateAny, tt.assign)
+			if tt.fields == nil {
+				tt.fields = map[string]string{}
+			}
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Fatalf("fields = %v, want %v", fields, tt.fields)
+			}
+			if len(tt.fields) == 0 && !reflect.DeepEqual(patch, tt.want) {
+				t.Errorf("patch = %+v, want %+v", patch, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodePatch(t *testing.T) {
+	tests := []struct {
+		body string
+		ok   bool
+	}{
+		{`{}`, true},
+		{`{"title":null}`, true},
+		{`null`, false},
+		{`[]`, false},
+		{`"title"`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PATCH", "/api/tickets/1", strings.NewReader(tt.body))
+		if _, ok := decodePatch(w, r); ok != tt.ok {
+			t.Errorf("decodePatch(%q) ok = %v, want %v", tt.body, ok, tt.ok)
+		}
+		if !tt.ok && w.Code != http.StatusBadRequest {
+			t.Errorf("decodePatch(%q) status = %d, want %d", tt.body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -1,21 +1,27 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
+	"helpdesk/server/middleware"
 	"helpdesk/server/models"
+	"helpdesk/server/problem"
 )
 
 type UserHandler struct {
-	Users *models.UserStore
+	Users          *models.UserStore
+	Roles          middleware.PermissionStore
+	RequireIfMatch bool
 }
 
 func (h *UserHandler) List(w http.ResponseWriter, r *http.Request) {
-	users, err := h.Users.List()
+	users, err := h.Users.List(r.Context())
 	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	if users == nil {
@@ -25,43 +31,149 @@ func (h *UserHandler) List(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(users)
 }
 
+func (h *UserHandler) Get(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+
+	user, err := h.Users.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeVersioned(w, http.StatusOK, user.Version, user)
+}
+
+// UpdateRole assigns a role to a user. Callers can neither grant a role nor
+// change the role of a user with permissions they do not hold themselves.
 func (h *UserHandler) UpdateRole(w http.ResponseWriter, r *http.Request) {
 	id, err := pathID(r, "id")
 	if err != nil {
-		jsonError(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, problem.Invalid("invalid id"))
 		return
 	}
 
 	var body struct {
-		Role models.Role `json:"role"`
+		Role models.Role `json:"role" validate:"required,max=64"`
+	}
+	if !decode(w, r, &body) {
+		return
+	}
+	if !h.holdsRole(w, r, body.Role, "role has permissions you do not have") {
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		jsonError(w, "invalid body", http.StatusBadRequest)
+
+	user, err := h.Users.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	if body.Role != models.RoleAdmin && body.Role != models.RoleOperator && body.Role != models.RoleUser {
-		jsonError(w, "invalid role", http.StatusBadRequest)
+	if !h.holdsRole(w, r, user.Role, "user has permissions you do not have") {
 		return
 	}
 
-	if err := h.Users.UpdateRole(id, body.Role); err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+	version, err := matchVersion(r, user.Version, h.RequireIfMatch)
+	if err != nil {
+		preconditionError(w, r, err, user.Version, user)
 		return
 	}
 
+	err = h.Users.UpdateRole(r.Context(), id, version, body.Role)
+	if errors.Is(err, models.ErrUnknownRole) {
+		writeError(w, r, problem.Invalid("invalid role"))
+		return
+	}
+	if errors.Is(err, models.ErrVersionConflict) {
+		current, err := h.Users.GetByID(r.Context(), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		preconditionError(w, r, errPreconditionFailed, current.Version, current)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(version+1))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+// holdsRole answers 403 with msg and returns false unless the caller holds
+// every permission of role.
+func (h *UserHandler) holdsRole(w http.ResponseWriter, r *http.Request, role models.Role, msg string) bool {
+	ok, err := holdsPermissions(r.Context(), h.Roles, role)
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	if !ok {
+		writeError(w, r, problem.Forbidden(msg))
+		return false
+	}
+	return true
+}
+
+// holdsPermissions reports whether the caller holds every permission of
+// role. Unknown roles grant nothing.
+func holdsPermissions(ctx context.Context, roles middleware.PermissionStore, role models.Role) (bool, error) {
+	perms, err := roles.Permissions(ctx, role)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range perms {
+		if !middleware.HasPermission(ctx, p) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 func (h *UserHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	id, err := pathID(r, "id")
 	if err != nil {
-		jsonError(w, "invalid id", http.StatusBadRequest)
+		writeError(w, r, problem.Invalid("invalid id"))
 		return
 	}
 
-	if err := h.Users.Delete(id); err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+	if err := h.Users.Delete(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) ListDeleted(w http.ResponseWriter, r *http.Request) {
+	users, err := h.Users.ListDeleted(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if users == nil {
+		users = []*models.User{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func (h *UserHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, r, problem.Invalid("invalid id"))
+		return
+	}
+
+	err = h.Users.Restore(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"helpdesk/server/middleware"
+	"helpdesk/server/models"
+)
+
+type rolePermissions map[models.Role][]string
+
+func (p rolePermissions) Permissions(_ context.Context, role models.Role) ([]string, error) {
+	return p[role], nil
+}
+
+var testRoles = rolePermissions{
+	models.RoleAdmin:    {models.PermUserManage, models.PermRoleManage, models.PermTicketDelete},
+	"user-manager":      {models.PermUserManage},
+	models.RoleOperator: {models.PermTicketReadAny},
+	models.RoleUser:     nil,
+}
+
+func withPermissions(ctx context.Context, perms ...string) context.Context {
+	set := map[string]struct{}{}
+	for _, p := range perms {
+		set[p] = struct{}{}
+	}
+	return context.WithValue(ctx, middleware.ContextPermissions, set)
+}
+
+func TestHoldsPermissions(t *testing.T) {
+	ctx := withPermissions(context.Background(), models.PermUserManage)
+	tests := []struct {
+		role models.Role
+		want bool
+	}{
+		{models.RoleUser, true},
+		{"user-manager", true},
+		{"unknown", true},
+		{models.RoleOperator, false},
+		{models.RoleAdmin, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.role), func(t *testing.T) {
+			got, err := holdsPermissions(ctx, testRoles, tt.role)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("holdsPermissions(%q) = %v, want %v", tt.role, got, tt.want)
+			}
+		})
+	}
+}
+
+// The escalation is refused before the target user is loaded, so the
+// handler needs no user store here.
+func TestUpdateRoleRejectsEscalation(t *testing.T) {
+	h := &UserHandler{Roles: testRoles}
+	for _, role := range []models.Role{models.RoleAdmin, models.RoleOperator} {
+		t.Run(string(role), func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/api/users/1/role", strings.NewReader(`{"role":"`+string(role)+`"}`))
+			r.SetPathValue("id", "1")
+			r = r.WithContext(withPermissions(r.Context(), models.PermUserManage))
+			w := httptest.NewRecorder()
+
+			h.UpdateRole(w, r)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d; response %s", w.Code, http.StatusForbidden, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"helpdesk/server/models"
+)
+
+// Purger hard-deletes soft-deleted rows once they are older than Retention.
+type Purger struct {
+	Tickets   *models.TicketStore
+	Comments  *models.CommentStore
+	Users     *models.UserStore
+	Retention time.Duration
+	Interval  time.Duration
+}
+
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.purge(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Purger) purge(ctx context.Context) {
+	cutoff := time.Now().Add(-p.Retention)
+
+	// Comments and tickets go first so that users they reference can be purged.
+	comments, err := p.Comments.Purge(ctx, cutoff)
+	if err != nil {
+		slog.ErrorContext(ctx, "purge comments", "err", err)
+	}
+	tickets, err := p.Tickets.Purge(ctx, cutoff)
+	if err != nil {
+		slog.ErrorContext(ctx, "purge tickets", "err", err)
+	}
+	users, err := p.Users.Purge(ctx, cutoff)
+	if err != nil {
+		slog.ErrorContext(ctx, "purge users", "err", err)
+	}
+
+	if comments+tickets+users > 0 {
+		slog.Info("purged soft-deleted rows",
+			"tickets", tickets, "comments", comments, "users", users, "cutoff", cutoff)
+	}
+}
@@ -0,0 +1,243 @@
+// Package jwtkeys holds the keys that sign and verify session tokens. With
+// RS256 or EdDSA the keys live in the database, rotate on a schedule and are
+// published as a JWKS; retired keys keep verifying tokens for a retention
+// period. HS256 uses the single shared JWT_SECRET and publishes nothing.
+package jwtkeys
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"helpdesk/server/config"
+	"helpdesk/server/models"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+
+	refreshInterval = 5 * time.Minute
+	minRefreshGap   = 10 * time.Second
+)
+
+type key struct {
+	id      string
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+type KeySet struct {
+	store     *models.SigningKeyStore
+	algorithm string
+	issuer    string
+	rotation  time.Duration
+	retention time.Duration
+
+	mu          sync.RWMutex
+	signing     *key
+	verifying   map[string]*key
+	lastRefresh time.Time
+}
+
+func New(store *models.SigningKeyStore, cfg *config.Config) (*KeySet, error) {
+	ks := &KeySet{
+		store:     store,
+		algorithm: cfg.JWTAlgorithm,
+		issuer:    cfg.JWTIssuer,
+		rotation:  cfg.JWTRotationInterval,
+		retention: cfg.JWTKeyRetention,
+	}
+
+	switch cfg.JWTAlgorithm {
+	case AlgHS256:
+		k := &key{id: "hs256", method: jwt.SigningMethodHS256, private: []byte(cfg.JWTSecret), public: []byte(cfg.JWTSecret)}
+		ks.signing = k
+		ks.verifying = map[string]*key{k.id: k}
+		return ks, nil
+	case AlgRS256, AlgEdDSA:
+		if err := ks.Refresh(context.Background()); err != nil {
+			return nil, err
+		}
+		return ks, nil
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", cfg.JWTAlgorithm)
+	}
+}
+
+func (ks *KeySet) Issuer() string { return ks.issuer }
+
+// Sign signs claims with the current key and names it in the kid header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.mu.RLock()
+	k := ks.signing
+	ks.mu.RUnlock()
+
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.id
+	return token.SignedString(k.private)
+}
+
+// Keyfunc resolves the verification key for a token by its kid header. An
+// unknown kid triggers a reload, since another replica may have rotated.
+func (ks *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	k := ks.lookup(kid)
+	if k == nil && ks.algorithm != AlgHS256 && ks.canRefresh() {
+		if err := ks.Refresh(context.Background()); err != nil {
+			slog.Error("reload signing keys", "err", err)
+		}
+		k = ks.lookup(kid)
+	}
+	if k == nil {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if t.Method.Alg() != k.method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return k.public, nil
+}
+
+func (ks *KeySet) lookup(kid string) *key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if ks.algorithm == AlgHS256 {
+		return ks.signing
+	}
+	return ks.verifying[kid]
+}
+
+func (ks *KeySet) canRefresh() bool {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return time.Since(ks.lastRefresh) > minRefreshGap
+}
+
+// Run reloads keys and rotates them when due until ctx is cancelled.
+func (ks *KeySet) Run(ctx context.Context) {
+	if ks.algorithm == AlgHS256 {
+		return
+	}
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ks.Refresh(ctx); err != nil {
+				slog.Error("refresh signing keys", "err", err)
+			}
+		}
+	}
+}
+
+// Refresh rotates the signing key if it is older than the rotation interval,
+// drops keys past retention and reloads the key set from the database.
+func (ks *KeySet) Refresh(ctx context.Context) error {
+	rows, err := ks.store.ListUsable(ctx, ks.algorithm, ks.retention)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 || rows[0].RetiredAt != nil || time.Since(rows[0].CreatedAt) > ks.rotation {
+		if err := ks.rotate(ctx); err != nil {
+			return err
+		}
+		if rows, err = ks.store.ListUsable(ctx, ks.algorithm, ks.retention); err != nil {
+			return err
+		}
+	}
+	if err := ks.store.DeleteRetired(ctx, time.Now().Add(-ks.retention)); err != nil {
+		return err
+	}
+
+	verifying := make(map[string]*key, len(rows))
+	var signing *key
+	for _, row := range rows {
+		k, err := parseKey(row)
+		if err != nil {
+			return err
+		}
+		verifying[k.id] = k
+		if signing == nil && row.RetiredAt == nil {
+			signing = k
+		}
+	}
+	if signing == nil {
+		return errors.New("no active signing key")
+	}
+
+	ks.mu.Lock()
+	ks.signing = signing
+	ks.verifying = verifying
+	ks.lastRefresh = time.Now()
+	ks.mu.Unlock()
+	return nil
+}
+
+func (ks *KeySet) rotate(ctx context.Context) error {
+	private, err := generate(ks.algorithm)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	rotated, err := ks.store.Rotate(ctx, &models.SigningKey{
+		ID:         hex.EncodeToString(id),
+		Algorithm:  ks.algorithm,
+		PrivateKey: der,
+	}, ks.rotation)
+	if err != nil {
+		return err
+	}
+	if rotated {
+		slog.Info("rotated signing key", "algorithm", ks.algorithm)
+	}
+	return nil
+}
+
+func generate(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case AlgRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case AlgEdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	}
+	return nil, fmt.Errorf("unsupported JWT algorithm %q", algorithm)
+}
+
+func parseKey(row *models.SigningKey) (*key, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(row.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse signing key %s: %w", row.ID, err)
+	}
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &key{id: row.ID, method: jwt.SigningMethodRS256, private: private, public: &private.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &key{id: row.ID, method: jwt.SigningMethodEdDSA, private: private, public: private.Public()}, nil
+	}
+	return nil, fmt.Errorf("signing key %s has unsupported type %T", row.ID, parsed)
+}
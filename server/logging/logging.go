@@ -0,0 +1,101 @@
+// Package logging configures the process-wide slog logger and carries
+// per-request attributes through the context.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// New returns a logger writing format ("text" or "json") at level ("debug",
+// "info", "warn" or "error") to w. Records logged with a request context
+// carry that request's ID and, once traced, its trace and span IDs.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("log format %q: must be text or json", format)
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	requestAttrsKey
+)
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// RequestAttrs collects attributes that handlers deeper in the chain learn
+// about a request, such as the authenticated user, for its access log line.
+type RequestAttrs struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+func WithRequestAttrs(ctx context.Context) (context.Context, *RequestAttrs) {
+	ra := &RequestAttrs{}
+	return context.WithValue(ctx, requestAttrsKey, ra), ra
+}
+
+func (ra *RequestAttrs) Attrs() []slog.Attr {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return append([]slog.Attr(nil), ra.attrs...)
+}
+
+// AddAttrs adds attributes to the access log line of the request in ctx.
+func AddAttrs(ctx context.Context, attrs ...slog.Attr) {
+	ra, _ := ctx.Value(requestAttrsKey).(*RequestAttrs)
+	if ra == nil {
+		return
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.attrs = append(ra.attrs, attrs...)
+}
+
+type contextHandler struct{ slog.Handler }
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
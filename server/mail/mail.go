@@ -0,0 +1,96 @@
+package mail
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"helpdesk/server/config"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers outgoing mail. Implementations must be safe for
+// concurrent use.
+type Sender interface {
+	Send(msg Message) error
+}
+
+func New(cfg *config.Config) (Sender, error) {
+	switch cfg.MailBackend {
+	case "", "log":
+		return LogSender{}, nil
+	case "file":
+		if err := os.MkdirAll(cfg.MailDir, 0o755); err != nil {
+			return nil, fmt.Errorf("create mail dir: %w", err)
+		}
+		return &FileSender{Dir: cfg.MailDir, From: cfg.MailFrom}, nil
+	case "smtp":
+		return &SMTPSender{
+			Addr:     net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+			Username: cfg.SMTPUser,
+			Password: cfg.SMTPPassword,
+			From:     cfg.MailFrom,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail backend %q", cfg.MailBackend)
+	}
+}
+
+// LogSender writes messages to the server log instead of delivering them.
+type LogSender struct{}
+
+func (LogSender) Send(msg Message) error {
+	slog.Info("mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// FileSender writes each message as an .eml file into Dir.
+type FileSender struct {
+	Dir  string
+	From string
+	seq  atomic.Int64
+}
+
+func (s *FileSender) Send(msg Message) error {
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().UTC().Format("20060102T150405.000"), s.seq.Add(1))
+	return os.WriteFile(filepath.Join(s.Dir, name), format(s.From, msg), 0o644)
+}
+
+type SMTPSender struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPSender) Send(msg Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, format(s.From, msg))
+}
+
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
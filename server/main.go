@@ -1,87 +1,261 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"helpdesk/server/authn"
 	"helpdesk/server/config"
 	"helpdesk/server/db"
 	"helpdesk/server/handlers"
+	"helpdesk/server/jobs"
+	"helpdesk/server/jwtkeys"
+	"helpdesk/server/logging"
+	"helpdesk/server/mail"
+	"helpdesk/server/metrics"
 	"helpdesk/server/middleware"
 	"helpdesk/server/models"
+	"helpdesk/server/openapi"
+	"helpdesk/server/ratelimit"
+	"helpdesk/server/sso"
+	"helpdesk/server/tenancy"
+	"helpdesk/server/tracing"
 )
 
 func main() {
 	cfg := config.Load()
+	logger, err := logging.New(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		log.Fatalf("configure logging: %v", err)
+	}
+	slog.SetDefault(logger)
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("configure tracing: %v", err)
+	}
+
+	models.QueryTimeout = cfg.QueryTimeout
+
+	migrator, err := db.ConnectMigrator(cfg)
+	if err != nil {
+		log.Fatalf("connect to DB as migration user: %v", err)
+	}
+	err = db.RunMigrations(migrator)
+	migrator.Close()
+	if err != nil {
+		log.Fatalf("run migrations: %v", err)
+	}
 
 	database, err := db.Connect(cfg)
 	if err != nil {
 		log.Fatalf("connect to DB: %v", err)
 	}
-	defer database.Close()
-
-	if err := db.RunMigrations(database); err != nil {
-		log.Printf("migrations warning (may already exist): %v", err)
+	if err := db.RequireRLS(database); err != nil {
+		log.Fatal(err)
 	}
 
-	userStore := models.NewUserStore(database)
-	ticketStore := models.NewTicketStore(database)
-	commentStore := models.NewCommentStore(database)
+	if len(os.Args) > 1 {
+		if os.Args[1] != "tenant" {
+			log.Fatalf("unknown command %q\n%s", os.Args[1], tenantUsage)
+		}
+		err := runTenantCommand(context.Background(), database, os.Args[2:])
+		database.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	authH := &handlers.AuthHandler{Users: userStore, JWTSecret: cfg.JWTSecret}
-	userH := &handlers.UserHandler{Users: userStore}
-	ticketH := &handlers.TicketHandler{Tickets: ticketStore}
-	commentH := &handlers.CommentHandler{Comments: commentStore, Tickets: ticketStore}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	authMW := middleware.Auth(cfg.JWTSecret)
-	adminOnly := middleware.RequireRole(models.RoleAdmin)
-	staffOnly := middleware.RequireRole(models.RoleAdmin, models.RoleOperator)
+	var workers sync.WaitGroup
+	runWorker := func(run func(context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(ctx)
+		}()
+	}
 
-	mux := http.NewServeMux()
+	keys, err := jwtkeys.New(models.NewSigningKeyStore(database), cfg)
+	if err != nil {
+		log.Fatalf("load signing keys: %v", err)
+	}
+	runWorker(keys.Run)
 
-	mux.HandleFunc("POST /api/auth/register", authH.Register)
-	mux.HandleFunc("POST /api/auth/login", authH.Login)
+	mailer, err := mail.New(cfg)
+	if err != nil {
+		log.Fatalf("configure mail: %v", err)
+	}
 
-	mux.Handle("GET /api/users",
-		authMW(adminOnly(http.HandlerFunc(userH.List))))
-	mux.Handle("PUT /api/users/{id}/role",
-		authMW(adminOnly(http.HandlerFunc(userH.UpdateRole))))
-	mux.Handle("DELETE /api/users/{id}",
-		authMW(adminOnly(http.HandlerFunc(userH.Delete))))
+	ips, err := middleware.NewIPResolver(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
+	if len(cfg.TrustedProxies) == 0 {
+		slog.Warn("TRUSTED_PROXIES is empty: X-Forwarded-For is ignored, so behind a proxy every client shares the proxy's address for rate limits and login throttling")
+	}
 
-	mux.Handle("POST /api/tickets",
-		authMW(http.HandlerFunc(ticketH.Create)))
-	mux.Handle("GET /api/tickets",
-		authMW(http.HandlerFunc(ticketH.List)))
-	mux.Handle("GET /api/tickets/{id}",
-		authMW(http.HandlerFunc(ticketH.Get)))
-	mux.Handle("PUT /api/tickets/{id}",
-		authMW(http.HandlerFunc(ticketH.Update)))
-	mux.Handle("DELETE /api/tickets/{id}",
-		authMW(adminOnly(http.HandlerFunc(ticketH.Delete))))
+	var oidcProvider *sso.Provider
+	if cfg.OIDCIssuer != "" {
+		oidcProvider, err = sso.New(ctx, cfg)
+		if err != nil {
+			log.Fatalf("configure OIDC: %v", err)
+		}
+	}
 
-	mux.Handle("POST /api/tickets/{id}/comments",
-		authMW(http.HandlerFunc(commentH.Create)))
-	mux.Handle("GET /api/tickets/{id}/comments",
-		authMW(http.HandlerFunc(commentH.List)))
-	mux.Handle("DELETE /api/comments/{id}",
-		authMW(staffOnly(http.HandlerFunc(commentH.Delete))))
+	// Background jobs work across all tenants on the system connection.
+	cleanup := authn.NewThrottle(models.NewLoginAttemptStore(database), nil, nil, cfg)
+	runWorker(cleanup.Run)
 
-	handler := corsMiddleware(mux)
+	if cfg.SoftDeleteRetentionDays > 0 {
+		purger := &jobs.Purger{
+			Tickets:   models.NewTicketStore(database),
+			Comments:  models.NewCommentStore(database),
+			Users:     models.NewUserStore(database),
+			Retention: time.Duration(cfg.SoftDeleteRetentionDays) * 24 * time.Hour,
+			Interval:  cfg.PurgeInterval,
+		}
+		runWorker(purger.Run)
+	}
 
-	log.Printf("server listening on :%s", cfg.ServerPort)
-	log.Fatal(http.ListenAndServe(":"+cfg.ServerPort, handler))
-}
+	// Rate limits are kept in Redis when configured so that they hold across
+	// replicas, else in memory per replica.
+	var limiter ratelimit.Store
+	if cfg.RateLimitRedisURL != "" {
+		redisLimiter, err := ratelimit.NewRedis(cfg.RateLimitRedisURL)
+		if err != nil {
+			log.Fatalf("invalid RATE_LIMIT_REDIS_URL: %v", err)
+		}
+		defer redisLimiter.Close()
+		limiter = redisLimiter
+	} else {
+		memoryLimiter := ratelimit.NewMemory()
+		runWorker(memoryLimiter.Run)
+		limiter = memoryLimiter
+	}
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
+	registry := tenancy.New(models.NewTenantStore(database), func(t *models.Tenant) (http.Handler, *sql.DB, error) {
+		tenantDB, err := db.ConnectTenant(cfg, t.ID)
+		if err != nil {
+			return nil, nil, err
 		}
-		next.ServeHTTP(w, r)
-	})
+		return newRouter(cfg.ForTenant(t.Slug), tenantDB, keys, mailer, ips, oidcProvider, ratelimit.Prefix(limiter, t.Slug)), tenantDB, nil
+	}, cfg)
+
+	promRegistry := prometheus.NewRegistry()
+	promRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.Pools(func() map[string]*sql.DB {
+			pools := registry.Pools()
+			pools["system"] = database
+			return pools
+		}),
+		&metrics.Business{
+			Stats: models.NewStatsStore(database),
+			SLA: map[models.TicketPriority]time.Duration{
+				models.PriorityCritical: cfg.SLACritical,
+				models.PriorityHigh:     cfg.SLAHigh,
+				models.PriorityMedium:   cfg.SLAMedium,
+				models.PriorityLow:      cfg.SLALow,
+			},
+		},
+	)
+	httpMetrics := metrics.NewHTTP(promRegistry)
+
+	// Metrics are served on a port of their own that the ingress does not
+	// route to.
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("GET "+cfg.MetricsPath, promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{}))
+	metricsServer := &http.Server{
+		Addr:              ":" + cfg.MetricsPort,
+		Handler:           metricsMux,
+		ReadHeaderTimeout: cfg.ServerReadTimeout,
+	}
+
+	// Probes bypass tenant routing and are kept out of the access log.
+	health := &handlers.HealthHandler{DB: database}
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", health.Live)
+	root.HandleFunc("GET /readyz", health.Ready)
+	// The API description is the same for every tenant.
+	root.Handle("GET /api/openapi.json", openapi.SpecHandler())
+	root.Handle("GET /api/docs/", openapi.UI("/api/docs/", "/api/openapi.json"))
+	root.Handle("/", middleware.RequestID(middleware.AccessLog(logger)(
+		middleware.Metrics(httpMetrics)(middleware.SecurityHeaders(cfg.HSTSMaxAge)(tracing.Middleware(registry))))))
+	server := &http.Server{
+		Addr:         ":" + cfg.ServerPort,
+		Handler:      root,
+		ReadTimeout:  cfg.ServerReadTimeout,
+		WriteTimeout: cfg.ServerWriteTimeout,
+		IdleTimeout:  cfg.ServerIdleTimeout,
+	}
+
+	for _, srv := range []*http.Server{server, metricsServer} {
+		go func() {
+			slog.Info("server listening", "addr", srv.Addr)
+			if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("serve %s: %v", srv.Addr, err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down")
+
+	// Fail readiness first and give the load balancer time to notice before
+	// the listener goes away.
+	health.Drain()
+	time.Sleep(cfg.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("drain requests", "err", err)
+	}
+	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("stop metrics server", "err", err)
+	}
+
+	workersDone := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-shutdownCtx.Done():
+		slog.Error("background jobs did not stop in time")
+	}
+
+	registry.Close()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("flush traces", "err", err)
+	}
+	if err := database.Close(); err != nil {
+		slog.Error("close DB", "err", err)
+	}
+	slog.Info("stopped")
 }
@@ -0,0 +1,149 @@
+// Package metrics defines the Prometheus metrics the server exports.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"helpdesk/server/models"
+)
+
+const namespace = "helpdesk"
+
+// HTTP counts requests and their latency by method, route pattern and status.
+type HTTP struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func NewHTTP(reg prometheus.Registerer) *HTTP {
+	m := &HTTP{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests served, by method, route pattern and status code.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests, by method and route pattern.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+	}
+	reg.MustRegister(m.requests, m.duration)
+	return m
+}
+
+func (m *HTTP) Observe(method, route string, status int, d time.Duration) {
+	m.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	m.duration.WithLabelValues(method, route).Observe(d.Seconds())
+}
+
+// Pools exports database/sql statistics of every connection pool returned by
+// the function it wraps, labelled with the pool's name.
+type Pools func() map[string]*sql.DB
+
+var (
+	poolOpenDesc = prometheus.NewDesc(namespace+"_db_open_connections",
+		"Established connections, in use and idle.", []string{"pool"}, nil)
+	poolInUseDesc = prometheus.NewDesc(namespace+"_db_in_use_connections",
+		"Connections currently in use.", []string{"pool"}, nil)
+	poolIdleDesc = prometheus.NewDesc(namespace+"_db_idle_connections",
+		"Idle connections.", []string{"pool"}, nil)
+	poolMaxOpenDesc = prometheus.NewDesc(namespace+"_db_max_open_connections",
+		"Maximum number of open connections, 0 for unlimited.", []string{"pool"}, nil)
+	poolWaitCountDesc = prometheus.NewDesc(namespace+"_db_wait_count_total",
+		"Connections waited for.", []string{"pool"}, nil)
+	poolWaitDurationDesc = prometheus.NewDesc(namespace+"_db_wait_duration_seconds_total",
+		"Time spent waiting for a connection.", []string{"pool"}, nil)
+	poolClosedDesc = prometheus.NewDesc(namespace+"_db_closed_connections_total",
+		"Connections closed because of the idle or lifetime limits.", []string{"pool"}, nil)
+)
+
+func (p Pools) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolOpenDesc
+	ch <- poolInUseDesc
+	ch <- poolIdleDesc
+	ch <- poolMaxOpenDesc
+	ch <- poolWaitCountDesc
+	ch <- poolWaitDurationDesc
+	ch <- poolClosedDesc
+}
+
+func (p Pools) Collect(ch chan<- prometheus.Metric) {
+	for name, db := range p() {
+		s := db.Stats()
+		ch <- prometheus.MustNewConstMetric(poolOpenDesc, prometheus.GaugeValue, float64(s.OpenConnections), name)
+		ch <- prometheus.MustNewConstMetric(poolInUseDesc, prometheus.GaugeValue, float64(s.InUse), name)
+		ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(s.Idle), name)
+		ch <- prometheus.MustNewConstMetric(poolMaxOpenDesc, prometheus.GaugeValue, float64(s.MaxOpenConnections), name)
+		ch <- prometheus.MustNewConstMetric(poolWaitCountDesc, prometheus.CounterValue, float64(s.WaitCount), name)
+		ch <- prometheus.MustNewConstMetric(poolWaitDurationDesc, prometheus.CounterValue, s.WaitDuration.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(poolClosedDesc, prometheus.CounterValue,
+			float64(s.MaxIdleClosed+s.MaxIdleTimeClosed+s.MaxLifetimeClosed), name)
+	}
+}
+
+// Business computes ticket and comment figures of every tenant at scrape
+// time.
+type Business struct {
+	Stats *models.StatsStore
+	// SLA is the resolution target of each priority.
+	SLA map[models.TicketPriority]time.Duration
+}
+
+var (
+	ticketsDesc = prometheus.NewDesc(namespace+"_tickets",
+		"Tickets that are not deleted, by status and priority.", []string{"tenant", "status", "priority"}, nil)
+	unassignedDesc = prometheus.NewDesc(namespace+"_tickets_unassigned",
+		"Open and in-progress tickets without an assignee.", []string{"tenant"}, nil)
+	slaBreachesDesc = prometheus.NewDesc(namespace+"_tickets_sla_breached",
+		"Open and in-progress tickets older than the SLA target of their priority.", []string{"tenant"}, nil)
+	commentsDesc = prometheus.NewDesc(namespace+"_comments_last_hour",
+		"Comments written in the last hour.", []string{"tenant"}, nil)
+)
+
+func (b *Business) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ticketsDesc
+	ch <- unassignedDesc
+	ch <- slaBreachesDesc
+	ch <- commentsDesc
+}
+
+func (b *Business) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	tickets, err := b.Stats.TicketCounts(ctx)
+	if err != nil {
+		slog.Error("collect ticket counts", "err", err)
+	}
+	for _, c := range tickets {
+		ch <- prometheus.MustNewConstMetric(ticketsDesc, prometheus.GaugeValue, float64(c.Count),
+			c.Tenant, string(c.Status), string(c.Priority))
+	}
+
+	collectTenantCounts(ch, unassignedDesc, "unassigned tickets", func() ([]models.TenantCount, error) {
+		return b.Stats.Unassigned(ctx)
+	})
+	collectTenantCounts(ch, slaBreachesDesc, "SLA breaches", func() ([]models.TenantCount, error) {
+		return b.Stats.SLABreaches(ctx, b.SLA)
+	})
+	collectTenantCounts(ch, commentsDesc, "comments", func() ([]models.TenantCount, error) {
+		return b.Stats.CommentsSince(ctx, time.Now().Add(-time.Hour))
+	})
+}
+
+func collectTenantCounts(ch chan<- prometheus.Metric, desc *prometheus.Desc, what string, count func() ([]models.TenantCount, error)) {
+	counts, err := count()
+	if err != nil {
+		slog.Error("collect "+what, "err", err)
+		return
+	}
+	for _, c := range counts {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(c.Count), c.Tenant)
+	}
+}
@@ -2,65 +2,232 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 
+	"helpdesk/server/logging"
 	"helpdesk/server/models"
+	"helpdesk/server/problem"
+	"helpdesk/server/tenancy"
 )
 
 type contextKey string
 
 const (
-	ContextUserID   contextKey = "user_id"
-	ContextUserRole contextKey = "user_role"
+	ContextUserID       contextKey = "user_id"
+	ContextUserRole     contextKey = "user_role"
+	ContextPermissions  contextKey = "permissions"
+	ContextAPIKey       contextKey = "api_key"
+	ContextImpersonator contextKey = "impersonator_id"
+)
+
+// Token purposes. Session tokens carry no purpose; the others are only
+// accepted by the endpoints of the login step they belong to.
+const (
+	PurposeSession   = ""
+	PurposeMFA       = "mfa"
+	PurposeMFAEnroll = "mfa_enroll"
 )
 
 type Claims struct {
-	UserID int         `json:"user_id"`
-	Role   models.Role `json:"role"`
+	UserID         int         `json:"user_id"`
+	Role           models.Role `json:"role"`
+	SessionVersion int         `json:"sv,omitempty"`
+	// TenantID binds the token to the tenant that issued it.
+	TenantID int    `json:"tid"`
+	Purpose  string `json:"purpose,omitempty"`
+	// ImpersonatorID is the admin acting as UserID, if any.
+	ImpersonatorID int `json:"impersonator_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func Auth(secret string) func(http.Handler) http.Handler {
+// SessionStore reports the current session version and role of an active
+// user. Tokens carrying an older version have been revoked.
+type SessionStore interface {
+	Session(ctx context.Context, userID int) (int, models.Role, error)
+}
+
+// APIKeyStore resolves a plaintext API key presented as a bearer credential.
+type APIKeyStore interface {
+	Authenticate(ctx context.Context, key string) (*models.APIKey, error)
+}
+
+// PermissionStore returns the permissions a role currently grants.
+type PermissionStore interface {
+	Permissions(ctx context.Context, role models.Role) ([]string, error)
+}
+
+// KeySource resolves the key that verifies a token, typically by its kid.
+type KeySource interface {
+	Keyfunc(t *jwt.Token) (interface{}, error)
+	Issuer() string
+}
+
+// ParseToken verifies the signature, issuer and expiry of a token and checks
+// that it has not been revoked or issued by another tenant. The role in the returned claims is the
+// user's current one, not the one the token was issued with.
+func ParseToken(ctx context.Context, keys KeySource, sessions SessionStore, tokenStr string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, keys.Keyfunc,
+		jwt.WithIssuer(keys.Issuer()), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	if claims.TenantID != tenancy.TenantID(ctx) {
+		return nil, errors.New("token was issued by another tenant")
+	}
+
+	current, role, err := sessions.Session(ctx, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if current != claims.SessionVersion {
+		return nil, errors.New("session has been revoked")
+	}
+	claims.Role = role
+	if claims.ImpersonatorID != 0 {
+		if _, _, err := sessions.Session(ctx, claims.ImpersonatorID); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// Auth accepts a session JWT or a personal API key as the bearer credential.
+// API keys are then limited to the routes allowed by RequireScope.
+func Auth(keys KeySource, sessions SessionStore, apiKeys APIKeyStore, perms PermissionStore) func(http.Handler) http.Handler {
+	sessionAuth := authenticate(keys, sessions, perms, PurposeSession)
+	return func(next http.Handler) http.Handler {
+		withSession := sessionAuth(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := extractAPIKey(r)
+			if key == "" {
+				withSession.ServeHTTP(w, r)
+				return
+			}
+
+			apiKey, err := apiKeys.Authenticate(r.Context(), key)
+			if err != nil && interrupted(r, err) {
+				problem.Write(w, r, err)
+				return
+			}
+			if err != nil {
+				problem.Write(w, r, problem.Unauthenticated("unauthorized"))
+				return
+			}
+
+			ctx, err := withIdentity(r.Context(), perms, apiKey.UserID, apiKey.Role)
+			if err != nil {
+				problem.Write(w, r, err)
+				return
+			}
+			ctx = context.WithValue(ctx, ContextAPIKey, apiKey)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// MFAEnrollment authenticates either a session token or the enrollment token
+// handed out at login to users whose role requires MFA but who have not set
+// it up yet.
+func MFAEnrollment(keys KeySource, sessions SessionStore, perms PermissionStore) func(http.Handler) http.Handler {
+	return authenticate(keys, sessions, perms, PurposeSession, PurposeMFAEnroll)
+}
+
+func authenticate(keys KeySource, sessions SessionStore, perms PermissionStore, purposes ...string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			tokenStr := extractToken(r)
 			if tokenStr == "" {
-				http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+				problem.Write(w, r, problem.Unauthenticated("unauthorized"))
 				return
 			}
 
-			claims := &Claims{}
-			token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
-				if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, jwt.ErrSignatureInvalid
-				}
-				return []byte(secret), nil
-			})
-			if err != nil || !token.Valid {
-				http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			claims, err := ParseToken(r.Context(), keys, sessions, tokenStr)
+			if err != nil && interrupted(r, err) {
+				problem.Write(w, r, err)
+				return
+			}
+			if err != nil || !hasPurpose(claims, purposes) {
+				problem.Write(w, r, problem.Unauthenticated("unauthorized"))
 				return
 			}
 
-			ctx := context.WithValue(r.Context(), ContextUserID, claims.UserID)
-			ctx = context.WithValue(ctx, ContextUserRole, claims.Role)
+			ctx, err := withIdentity(r.Context(), perms, claims.UserID, claims.Role)
+			if err != nil {
+				problem.Write(w, r, err)
+				return
+			}
+			if claims.ImpersonatorID != 0 {
+				logging.AddAttrs(ctx, slog.Int("impersonator_id", claims.ImpersonatorID))
+				ctx = context.WithValue(ctx, ContextImpersonator, claims.ImpersonatorID)
+			}
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-func RequireRole(roles ...models.Role) func(http.Handler) http.Handler {
-	allowed := make(map[models.Role]struct{}, len(roles))
-	for _, r := range roles {
-		allowed[r] = struct{}{}
+// withIdentity stores the user, their role and the role's current
+// permissions in ctx. Callers pass the role read from the database on this
+// request, and permissions are looked up on every request too, so both role
+// assignments and role edits apply immediately on all replicas.
+func withIdentity(ctx context.Context, perms PermissionStore, userID int, role models.Role) (context.Context, error) {
+	granted, err := perms.Permissions(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]struct{}, len(granted))
+	for _, p := range granted {
+		set[p] = struct{}{}
+	}
+	logging.AddAttrs(ctx, slog.Int("user_id", userID), slog.String("role", string(role)))
+	ctx = context.WithValue(ctx, ContextUserID, userID)
+	ctx = context.WithValue(ctx, ContextUserRole, role)
+	ctx = context.WithValue(ctx, ContextPermissions, set)
+	return ctx, nil
+}
+
+func hasPurpose(claims *Claims, purposes []string) bool {
+	for _, p := range purposes {
+		if claims.Purpose == p {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission lets the request through if the user's role grants at
+// least one of the permissions.
+func RequirePermission(perms ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range perms {
+				if HasPermission(r.Context(), p) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			problem.Write(w, r, problem.Forbidden("forbidden"))
+		})
 	}
+}
+
+// RequireScope lets API keys through only if they carry one of the scopes.
+// The admin scope grants every scope, and a key without scopes is let through
+// nowhere. Session tokens are not restricted.
+func RequireScope(scopes ...string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			role, _ := r.Context().Value(ContextUserRole).(models.Role)
-			if _, ok := allowed[role]; !ok {
-				http.Error(w, `{"error":"forbidden"}`, http.StatusForbidden)
+			key := APIKeyFromCtx(r.Context())
+			if key != nil && !keyHasScope(key, scopes) {
+				problem.Write(w, r, problem.New(problem.KindForbidden, "insufficient_scope", "insufficient scope"))
 				return
 			}
 			next.ServeHTTP(w, r)
@@ -68,16 +235,85 @@ func RequireRole(roles ...models.Role) func(http.Handler) http.Handler {
 	}
 }
 
+// RequireSession rejects API keys and impersonation, for account management
+// routes that only the user, interactively signed in, may call.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if APIKeyFromCtx(r.Context()) != nil {
+			problem.Write(w, r, problem.New(problem.KindForbidden, "session_required", "not available to api keys"))
+			return
+		}
+		if ImpersonatorIDFromCtx(r.Context()) != 0 {
+			problem.Write(w, r, problem.New(problem.KindForbidden, "session_required", "not available while impersonating"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func keyHasScope(key *models.APIKey, scopes []string) bool {
+	for _, have := range key.Scopes {
+		if have == models.ScopeAdmin {
+			return true
+		}
+		for _, want := range scopes {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func UserIDFromCtx(ctx context.Context) int {
 	id, _ := ctx.Value(ContextUserID).(int)
 	return id
 }
 
+// ImpersonatorIDFromCtx returns the admin behind an impersonated request, or
+// 0 when the user is acting for themselves.
+func ImpersonatorIDFromCtx(ctx context.Context) int {
+	id, _ := ctx.Value(ContextImpersonator).(int)
+	return id
+}
+
+// ActorIDFromCtx returns the user really making the request: the
+// impersonator if there is one, otherwise the authenticated user.
+func ActorIDFromCtx(ctx context.Context) int {
+	if id := ImpersonatorIDFromCtx(ctx); id != 0 {
+		return id
+	}
+	return UserIDFromCtx(ctx)
+}
+
 func RoleFromCtx(ctx context.Context) models.Role {
 	role, _ := ctx.Value(ContextUserRole).(models.Role)
 	return role
 }
 
+func HasPermission(ctx context.Context, perm string) bool {
+	set, _ := ctx.Value(ContextPermissions).(map[string]struct{})
+	_, ok := set[perm]
+	return ok
+}
+
+// APIKeyFromCtx returns the API key the request was authenticated with, or
+// nil for session tokens.
+func APIKeyFromCtx(ctx context.Context) *models.APIKey {
+	key, _ := ctx.Value(ContextAPIKey).(*models.APIKey)
+	return key
+}
+
+func extractAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token := extractToken(r); models.IsAPIKey(token) {
+		return token
+	}
+	return ""
+}
+
 func extractToken(r *http.Request) string {
 	header := r.Header.Get("Authorization")
 	if strings.HasPrefix(header, "Bearer ") {
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPResolver finds the client address of a request. X-Forwarded-For is only
+// believed for hops that come from one of the trusted proxy networks.
+type IPResolver struct {
+	Trusted []netip.Prefix
+}
+
+func NewIPResolver(cidrs []string) (*IPResolver, error) {
+	res := &IPResolver{}
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(c)
+			if addrErr != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", c, err)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		res.Trusted = append(res.Trusted, p.Masked())
+	}
+	return res, nil
+}
+
+func (res *IPResolver) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !res.trusted(host) {
+		return host
+	}
+
+	// Walk X-Forwarded-For from the nearest hop and stop at the first
+	// address that is not one of our proxies.
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !res.trusted(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+func (res *IPResolver) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range res.Trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,15 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"helpdesk/server/problem"
+)
+
+// interrupted reports whether err means that the request could not be
+// finished in time, as opposed to the credentials being refused.
+func interrupted(r *http.Request, err error) bool {
+	return errors.Is(err, context.Canceled) || r.Context().Err() != nil || problem.IsTimeout(err)
+}
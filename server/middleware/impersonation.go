@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"helpdesk/server/models"
+	"helpdesk/server/problem"
+)
+
+// Auditor records security relevant events.
+type Auditor interface {
+	Record(ctx context.Context, e *models.AuditEntry) error
+}
+
+// Impersonation keeps impersonated requests read-only and records every one
+// of them, allowed or not, in the audit log. It must run after Auth.
+func Impersonation(audit Auditor, ips *IPResolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actorID := ImpersonatorIDFromCtx(r.Context())
+			if actorID == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(rec, r)
+			default:
+				rec.status = http.StatusForbidden
+				problem.Write(w, r, problem.New(problem.KindForbidden, "impersonation_read_only", "impersonation is read-only"))
+			}
+
+			targetID := UserIDFromCtx(r.Context())
+			if err := audit.Record(r.Context(), &models.AuditEntry{
+				Action:       models.AuditImpersonatedRequest,
+				ActorID:      &actorID,
+				TargetUserID: &targetID,
+				IP:           ips.ClientIP(r),
+				Details: map[string]string{
+					"method": r.Method,
+					"path":   r.URL.Path,
+					"status": strconv.Itoa(rec.status),
+				},
+			}); err != nil {
+				slog.ErrorContext(r.Context(), "audit impersonated request", "err", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"helpdesk/server/metrics"
+)
+
+// Metrics records every request in m under the route pattern it matched.
+func Metrics(m *metrics.HTTP) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			r, route := trackRoute(r)
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(rec, r)
+
+			m.Observe(r.Method, routeName(*route), rec.status, time.Since(start))
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"helpdesk/server/problem"
+	"helpdesk/server/ratelimit"
+)
+
+// RateLimit allows each client rate requests to the routes it wraps. Clients
+// are told apart by user once authenticated and by address otherwise, with
+// name keeping the buckets of different limits apart. Every response carries
+// the RateLimit-* headers; requests over the limit get 429. When the store
+// fails the request is let through rather than the API taken down with it.
+func RateLimit(store ratelimit.Store, name string, rate ratelimit.Rate, ips *IPResolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !rate.Enabled() {
+			return next
+		}
+		policy := fmt.Sprintf("%d;w=%d", rate.Requests, int(rate.Period.Seconds()))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := name + ":ip:" + ips.ClientIP(r)
+			if id := ActorIDFromCtx(r.Context()); id != 0 {
+				key = name + ":user:" + strconv.Itoa(id)
+			}
+
+			res, err := store.Take(r.Context(), key, rate)
+			if err != nil {
+				slog.WarnContext(r.Context(), "rate limit", "key", key, "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("RateLimit-Policy", policy)
+			h.Set("RateLimit-Limit", strconv.Itoa(rate.Requests))
+			h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("RateLimit-Reset", seconds(res.Reset))
+			if !res.Allowed {
+				h.Set("Retry-After", seconds(res.RetryAfter))
+				problem.Write(w, r, problem.New(problem.KindRateLimited, "rate_limited", "rate limit exceeded"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// MaxBytes caps request bodies at n bytes. Bodies declared larger are
+// refused with 413 up front; others fail to read past the limit.
+func MaxBytes(n int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				problem.Write(w, r, problem.New(problem.KindTooLarge, "body_too_large", "request body too large"))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
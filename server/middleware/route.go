@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+type routeKey struct{}
+
+// MatchedRoute wraps a ServeMux and reports the pattern it matched to the
+// middleware further out. Those see an earlier copy of the request, on which
+// the mux does not set Pattern.
+func MatchedRoute(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+			*route = r.Pattern
+		}
+	})
+}
+
+// trackRoute makes the pattern matched by MatchedRoute available through the
+// returned pointer once the request has been served.
+func trackRoute(r *http.Request) (*http.Request, *string) {
+	if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+		return r, route
+	}
+	route := new(string)
+	return r.WithContext(context.WithValue(r.Context(), routeKey{}, route)), route
+}
+
+func routeName(route string) string {
+	if route == "" {
+		return "unmatched"
+	}
+	return route
+}
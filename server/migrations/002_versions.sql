@@ -0,0 +1,3 @@
+ALTER TABLE tickets  ADD COLUMN version INT NOT NULL DEFAULT 1;
+ALTER TABLE comments ADD COLUMN version INT NOT NULL DEFAULT 1;
+ALTER TABLE users    ADD COLUMN version INT NOT NULL DEFAULT 1;
@@ -0,0 +1,17 @@
+ALTER TABLE users    ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE tickets  ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE comments ADD COLUMN deleted_at TIMESTAMPTZ;
+
+ALTER TABLE tickets
+    DROP CONSTRAINT tickets_author_id_fkey,
+    ADD CONSTRAINT tickets_author_id_fkey
+        FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE RESTRICT;
+
+ALTER TABLE comments
+    DROP CONSTRAINT comments_user_id_fkey,
+    ADD CONSTRAINT comments_user_id_fkey
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE RESTRICT;
+
+CREATE INDEX users_deleted_at_idx    ON users (deleted_at)    WHERE deleted_at IS NOT NULL;
+CREATE INDEX tickets_deleted_at_idx  ON tickets (deleted_at)  WHERE deleted_at IS NOT NULL;
+CREATE INDEX comments_deleted_at_idx ON comments (deleted_at) WHERE deleted_at IS NOT NULL;
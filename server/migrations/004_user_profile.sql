@@ -0,0 +1,9 @@
+ALTER TABLE users
+    ADD COLUMN display_name               VARCHAR(128),
+    ADD COLUMN timezone                   VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    ADD COLUMN locale                     VARCHAR(16) NOT NULL DEFAULT 'en',
+    ADD COLUMN notification_prefs         JSONB NOT NULL DEFAULT '{}',
+    ADD COLUMN pending_email              VARCHAR(128),
+    ADD COLUMN pending_email_token_hash   TEXT,
+    ADD COLUMN pending_email_expires_at   TIMESTAMPTZ,
+    ADD COLUMN session_version            INT NOT NULL DEFAULT 0;
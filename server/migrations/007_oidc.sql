@@ -0,0 +1,8 @@
+CREATE TABLE oidc_flows (
+    state         TEXT PRIMARY KEY,
+    nonce         TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    expires_at    TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE users ADD COLUMN external_subject TEXT UNIQUE;
@@ -0,0 +1,14 @@
+CREATE TABLE api_keys (
+    id            SERIAL PRIMARY KEY,
+    user_id       INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name          VARCHAR(64) NOT NULL,
+    prefix        VARCHAR(16) NOT NULL UNIQUE,
+    key_hash      TEXT NOT NULL,
+    scopes        TEXT[] NOT NULL DEFAULT '{}',
+    expires_at    TIMESTAMPTZ,
+    last_used_at  TIMESTAMPTZ,
+    revoked_at    TIMESTAMPTZ,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
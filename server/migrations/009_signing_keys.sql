@@ -0,0 +1,9 @@
+CREATE TABLE signing_keys (
+    kid          TEXT PRIMARY KEY,
+    algorithm    TEXT NOT NULL,
+    private_key  BYTEA NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    retired_at   TIMESTAMPTZ
+);
+
+CREATE INDEX signing_keys_algorithm_idx ON signing_keys (algorithm, created_at DESC);
@@ -0,0 +1,18 @@
+CREATE TABLE login_attempts (
+    key              VARCHAR(320) PRIMARY KEY,
+    failures         INT NOT NULL DEFAULT 0,
+    last_failure_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    locked_until     TIMESTAMPTZ
+);
+
+CREATE TABLE audit_log (
+    id              SERIAL PRIMARY KEY,
+    action          VARCHAR(64) NOT NULL,
+    actor_id        INT REFERENCES users(id) ON DELETE SET NULL,
+    target_user_id  INT REFERENCES users(id) ON DELETE SET NULL,
+    ip              VARCHAR(64) NOT NULL DEFAULT '',
+    details         JSONB NOT NULL DEFAULT '{}',
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
@@ -0,0 +1,34 @@
+CREATE TABLE roles (
+    name         VARCHAR(64) PRIMARY KEY,
+    description  TEXT NOT NULL DEFAULT '',
+    permissions  TEXT[] NOT NULL DEFAULT '{}',
+    builtin      BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO roles (name, description, permissions, builtin) VALUES
+    ('admin', 'Full access', ARRAY[
+        'ticket.read.any', 'ticket.update.any', 'ticket.assign', 'ticket.delete',
+        'comment.update.any', 'comment.delete', 'user.manage', 'role.manage',
+        'security.manage', 'audit.view', 'trash.manage', 'report.view'
+    ], TRUE),
+    ('operator', 'Works on tickets', ARRAY[
+        'ticket.read.any', 'ticket.update.any', 'ticket.assign', 'comment.delete', 'report.view'
+    ], TRUE),
+    ('user', 'Files and follows their own tickets', '{}', TRUE);
+
+CREATE TRIGGER roles_updated_at
+    BEFORE UPDATE ON roles
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at();
+
+ALTER TABLE users ALTER COLUMN role DROP DEFAULT;
+ALTER TABLE users ALTER COLUMN role TYPE VARCHAR(64) USING role::text;
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'user';
+ALTER TABLE users ADD CONSTRAINT users_role_fkey FOREIGN KEY (role) REFERENCES roles(name);
+
+ALTER TABLE mfa_required_roles ALTER COLUMN role TYPE VARCHAR(64) USING role::text;
+ALTER TABLE mfa_required_roles ADD CONSTRAINT mfa_required_roles_role_fkey
+    FOREIGN KEY (role) REFERENCES roles(name) ON DELETE CASCADE;
+
+DROP TYPE user_role;
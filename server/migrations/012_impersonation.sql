@@ -0,0 +1,2 @@
+UPDATE roles SET permissions = array_append(permissions, 'user.impersonate')
+WHERE name = 'admin' AND NOT 'user.impersonate' = ANY(permissions);
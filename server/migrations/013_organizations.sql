@@ -0,0 +1,53 @@
+CREATE TABLE organizations (
+    id                SERIAL PRIMARY KEY,
+    name              VARCHAR(128) NOT NULL UNIQUE,
+    share_by_default  BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE organization_domains (
+    domain           VARCHAR(255) PRIMARY KEY,
+    organization_id  INT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE
+);
+
+CREATE INDEX organization_domains_organization_id_idx ON organization_domains (organization_id);
+
+ALTER TABLE users
+    ADD COLUMN organization_id INT REFERENCES organizations(id) ON DELETE SET NULL,
+    ADD COLUMN org_manager     BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE tickets
+    ADD COLUMN organization_id INT REFERENCES organizations(id) ON DELETE SET NULL,
+    ADD COLUMN shared          BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX tickets_organization_id_idx ON tickets (organization_id) WHERE deleted_at IS NULL;
+
+-- New users join the organization that owns their email domain. Changing
+-- the email moves the user to the organization of the new domain, or out
+-- of any organization, and drops manager rights.
+CREATE OR REPLACE FUNCTION assign_organization_by_domain()
+RETURNS TRIGGER AS $$
+DECLARE
+    domain_org INT;
+BEGIN
+    SELECT organization_id INTO domain_org FROM organization_domains
+    WHERE domain = lower(split_part(NEW.email, '@', 2));
+
+    IF TG_OP = 'INSERT' THEN
+        NEW.organization_id = COALESCE(NEW.organization_id, domain_org);
+    ELSIF NEW.email IS DISTINCT FROM OLD.email THEN
+        NEW.organization_id = domain_org;
+        IF NEW.organization_id IS DISTINCT FROM OLD.organization_id THEN
+            NEW.org_manager = FALSE;
+        END IF;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_organization
+    BEFORE INSERT OR UPDATE OF email ON users
+    FOR EACH ROW EXECUTE FUNCTION assign_organization_by_domain();
+
+UPDATE roles SET permissions = array_append(permissions, 'org.manage')
+WHERE name = 'admin' AND NOT 'org.manage' = ANY(permissions);
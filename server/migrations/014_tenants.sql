@@ -0,0 +1,111 @@
+CREATE TABLE tenants (
+    id          SERIAL PRIMARY KEY,
+    slug        VARCHAR(63) NOT NULL UNIQUE,
+    name        VARCHAR(128) NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO tenants (id, slug, name) VALUES (1, 'default', 'Default');
+SELECT setval('tenants_id_seq', 1);
+
+-- Tenant connections are opened with app.tenant_id set; the connection used
+-- for migrations, provisioning and background jobs sets app.all_tenants.
+CREATE FUNCTION current_tenant_id() RETURNS INT AS $$
+    SELECT NULLIF(current_setting('app.tenant_id', true), '')::int
+$$ LANGUAGE sql STABLE;
+
+CREATE FUNCTION all_tenants() RETURNS BOOLEAN AS $$
+    SELECT COALESCE(current_setting('app.all_tenants', true), '') = 'on'
+$$ LANGUAGE sql STABLE;
+
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY[
+        'users', 'tickets', 'comments', 'password_resets', 'mfa_recovery_codes',
+        'mfa_required_roles', 'oidc_flows', 'api_keys', 'login_attempts', 'audit_log',
+        'roles', 'organizations', 'organization_domains'
+    ] LOOP
+        EXECUTE format('ALTER TABLE %I ADD COLUMN tenant_id INT NOT NULL DEFAULT 1 REFERENCES tenants(id)', t);
+        EXECUTE format('ALTER TABLE %I ALTER COLUMN tenant_id SET DEFAULT current_tenant_id()', t);
+        EXECUTE format('CREATE INDEX %I ON %I (tenant_id)', t || '_tenant_id_idx', t);
+        EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t);
+        EXECUTE format('ALTER TABLE %I FORCE ROW LEVEL SECURITY', t);
+        EXECUTE format(
+            'CREATE POLICY tenant_isolation ON %I
+                 USING (all_tenants() OR tenant_id = current_tenant_id())
+                 WITH CHECK (all_tenants() OR tenant_id = current_tenant_id())', t);
+    END LOOP;
+END $$;
+
+-- Names only need to be unique within a tenant.
+ALTER TABLE users
+    DROP CONSTRAINT users_email_key,
+    DROP CONSTRAINT users_username_key,
+    DROP CONSTRAINT users_external_subject_key,
+    ADD CONSTRAINT users_email_key UNIQUE (tenant_id, email),
+    ADD CONSTRAINT users_username_key UNIQUE (tenant_id, username),
+    ADD CONSTRAINT users_external_subject_key UNIQUE (tenant_id, external_subject);
+
+ALTER TABLE organizations
+    DROP CONSTRAINT organizations_name_key,
+    ADD CONSTRAINT organizations_name_key UNIQUE (tenant_id, name);
+
+ALTER TABLE organization_domains
+    DROP CONSTRAINT organization_domains_pkey,
+    ADD PRIMARY KEY (tenant_id, domain);
+
+ALTER TABLE login_attempts
+    DROP CONSTRAINT login_attempts_pkey,
+    ADD PRIMARY KEY (tenant_id, key);
+
+ALTER TABLE users DROP CONSTRAINT users_role_fkey;
+ALTER TABLE mfa_required_roles
+    DROP CONSTRAINT mfa_required_roles_role_fkey,
+    DROP CONSTRAINT mfa_required_roles_pkey;
+ALTER TABLE roles
+    DROP CONSTRAINT roles_pkey,
+    ADD PRIMARY KEY (tenant_id, name);
+ALTER TABLE users ADD CONSTRAINT users_role_fkey
+    FOREIGN KEY (tenant_id, role) REFERENCES roles(tenant_id, name);
+ALTER TABLE mfa_required_roles
+    ADD PRIMARY KEY (tenant_id, role),
+    ADD CONSTRAINT mfa_required_roles_role_fkey
+        FOREIGN KEY (tenant_id, role) REFERENCES roles(tenant_id, name) ON DELETE CASCADE;
+
+CREATE OR REPLACE FUNCTION assign_organization_by_domain()
+RETURNS TRIGGER AS $$
+DECLARE
+    domain_org INT;
+BEGIN
+    SELECT organization_id INTO domain_org FROM organization_domains
+    WHERE tenant_id = NEW.tenant_id AND domain = lower(split_part(NEW.email, '@', 2));
+
+    IF TG_OP = 'INSERT' THEN
+        NEW.organization_id = COALESCE(NEW.organization_id, domain_org);
+    ELSIF NEW.email IS DISTINCT FROM OLD.email THEN
+        NEW.organization_id = domain_org;
+        IF NEW.organization_id IS DISTINCT FROM OLD.organization_id THEN
+            NEW.org_manager = FALSE;
+        END IF;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- seed_tenant_roles creates the built-in roles of a new tenant. Keep it in
+-- step with migrations that change the built-in permissions.
+CREATE FUNCTION seed_tenant_roles(tid INT) RETURNS VOID AS $$
+    INSERT INTO roles (tenant_id, name, description, permissions, builtin) VALUES
+        (tid, 'admin', 'Full access', ARRAY[
+            'ticket.read.any', 'ticket.update.any', 'ticket.assign', 'ticket.delete',
+            'comment.update.any', 'comment.delete', 'user.manage', 'role.manage',
+            'security.manage', 'audit.view', 'trash.manage', 'report.view',
+            'user.impersonate', 'org.manage'
+        ], TRUE),
+        (tid, 'operator', 'Works on tickets', ARRAY[
+            'ticket.read.any', 'ticket.update.any', 'ticket.assign', 'comment.delete', 'report.view'
+        ], TRUE),
+        (tid, 'user', 'Files and follows their own tickets', '{}', TRUE)
+$$ LANGUAGE sql;
@@ -0,0 +1,22 @@
+-- helpdesk_app is the role the server connects as. It is neither a superuser
+-- nor exempt from row-level security, so the tenant policies apply to every
+-- query it runs; the server refuses to start as a role that bypasses them.
+-- Migrations run as the owner of the schema (DB_MIGRATION_USER). The role's
+-- password is set when the database is provisioned, not here.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'helpdesk_app') THEN
+        CREATE ROLE helpdesk_app LOGIN;
+    END IF;
+END $$;
+ALTER ROLE helpdesk_app NOSUPERUSER NOBYPASSRLS NOCREATEDB NOCREATEROLE;
+
+GRANT USAGE ON SCHEMA public TO helpdesk_app;
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO helpdesk_app;
+GRANT USAGE, SELECT, UPDATE ON ALL SEQUENCES IN SCHEMA public TO helpdesk_app;
+
+-- Tables and sequences of later migrations are granted as they are created.
+ALTER DEFAULT PRIVILEGES IN SCHEMA public
+    GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO helpdesk_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public
+    GRANT USAGE, SELECT, UPDATE ON SEQUENCES TO helpdesk_app;
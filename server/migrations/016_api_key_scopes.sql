@@ -0,0 +1,7 @@
+-- Keys without scopes used to act with the full rights of their owner. Keys
+-- now need at least one scope and an unscoped key is let through nowhere, so
+-- the existing ones are revoked rather than left dead but listed as active.
+UPDATE api_keys SET revoked_at = NOW() WHERE scopes = '{}' AND revoked_at IS NULL;
+
+ALTER TABLE api_keys ALTER COLUMN scopes DROP DEFAULT;
+ALTER TABLE api_keys ADD CONSTRAINT api_keys_scopes_not_empty CHECK (cardinality(scopes) > 0 OR revoked_at IS NOT NULL);
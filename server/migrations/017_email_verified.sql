@@ -0,0 +1,24 @@
+-- Users join the organization of their email domain only once they have
+-- shown they own the address: by confirming it, or by signing in through a
+-- provider that vouches for it. Until then organization_id stays NULL.
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE users SET email_verified = TRUE WHERE external_subject IS NOT NULL;
+
+-- The domain only fills in a missing organization. A membership that is
+-- already set, possibly by an admin, is kept when the email changes, and so
+-- are manager rights.
+CREATE OR REPLACE FUNCTION assign_organization_by_domain()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.email_verified AND NEW.organization_id IS NULL THEN
+        SELECT organization_id INTO NEW.organization_id FROM organization_domains
+        WHERE tenant_id = NEW.tenant_id AND domain = lower(split_part(NEW.email, '@', 2));
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER users_organization ON users;
+CREATE TRIGGER users_organization
+    BEFORE INSERT OR UPDATE OF email, email_verified ON users
+    FOR EACH ROW EXECUTE FUNCTION assign_organization_by_domain();
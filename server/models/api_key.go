@@ -0,0 +1,198 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"helpdesk/server/problem"
+)
+
+// API keys look like hdk_<prefix>_<secret>. The prefix is stored in clear
+// text to find the key; only a SHA-256 hash of the whole key is kept.
+const apiKeyTag = "hdk"
+
+const (
+	ScopeTicketsRead   = "tickets:read"
+	ScopeTicketsWrite  = "tickets:write"
+	ScopeCommentsWrite = "comments:write"
+	ScopeAdmin         = "admin"
+)
+
+var ErrInvalidAPIKey = problem.New(problem.KindUnauthenticated, "invalid_api_key", "invalid api key")
+
+func ValidScope(s string) bool {
+	switch s {
+	case ScopeTicketsRead, ScopeTicketsWrite, ScopeCommentsWrite, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// IsAPIKey reports whether a bearer credential has the API key format
+// rather than being a JWT.
+func IsAPIKey(s string) bool {
+	return strings.HasPrefix(s, apiKeyTag+"_")
+}
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	// Role is the owner's current role, filled in by Authenticate.
+	Role Role `json:"-"`
+}
+
+type APIKeyStore struct{ DB *sql.DB }
+
+func NewAPIKeyStore(db *sql.DB) *APIKeyStore { return &APIKeyStore{DB: db} }
+
+// Create generates a key for the user and returns its metadata together with
+// the plaintext key, which cannot be recovered later.
+func (s *APIKeyStore) Create(ctx context.Context, userID int, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error) {
+	ctx, end := begin(ctx, "APIKeyStore.Create")
+	defer end()
+
+	prefixBytes := make([]byte, 4)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, "", err
+	}
+	prefix := hex.EncodeToString(prefixBytes)
+	key := apiKeyTag + "_" + prefix + "_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	if scopes == nil {
+		scopes = []string{}
+	}
+	k := &APIKey{}
+	err := s.DB.QueryRowContext(ctx,
+		`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at`,
+		userID, name, prefix, hashAPIKey(key), pq.Array(scopes), expiresAt,
+	).Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.ExpiresAt,
+		&k.LastUsedAt, &k.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return k, key, nil
+}
+
+func (s *APIKeyStore) ListByUser(ctx context.Context, userID int) ([]*APIKey, error) {
+	ctx, end := begin(ctx, "APIKeyStore.ListByUser")
+	defer end()
+
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at
+		 FROM api_keys
+		 WHERE user_id=$1 AND revoked_at IS NULL
+		 ORDER BY created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		k := &APIKey{}
+		if err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, pq.Array(&k.Scopes),
+			&k.ExpiresAt, &k.LastUsedAt, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *APIKeyStore) Revoke(ctx context.Context, userID, id int) error {
+	ctx, end := begin(ctx, "APIKeyStore.Revoke")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE api_keys SET revoked_at=NOW() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL`,
+		id, userID,
+	)
+	if err != nil {
+		return err
+	}
+	return notFound(checkAffected(res), "api key")
+}
+
+// revokeAPIKeys revokes every key of a user within tx, for changes to the
+// user's credentials that should also lock out whoever may have held them.
+func revokeAPIKeys(ctx context.Context, tx *sql.Tx, userID int) error {
+	_, err := tx.ExecContext(ctx,
+		`UPDATE api_keys SET revoked_at=NOW() WHERE user_id=$1 AND revoked_at IS NULL`, userID,
+	)
+	return err
+}
+
+// Authenticate resolves a plaintext key to an active, unexpired key of an
+// active user and records its use.
+func (s *APIKeyStore) Authenticate(ctx context.Context, key string) (*APIKey, error) {
+	ctx, end := begin(ctx, "APIKeyStore.Authenticate")
+	defer end()
+
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyTag {
+		return nil, ErrInvalidAPIKey
+	}
+
+	k := &APIKey{}
+	var keyHash string
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT k.id, k.user_id, k.name, k.prefix, k.scopes, k.expires_at, k.last_used_at,
+		        k.created_at, k.key_hash, u.role
+		 FROM api_keys k
+		 JOIN users u ON u.id = k.user_id
+		 WHERE k.prefix=$1 AND k.revoked_at IS NULL
+		   AND (k.expires_at IS NULL OR k.expires_at > NOW())
+		   AND u.deleted_at IS NULL`,
+		parts[1],
+	).Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.ExpiresAt,
+		&k.LastUsedAt, &k.CreatedAt, &keyHash, &k.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(keyHash), []byte(hashAPIKey(key))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+
+	// Only write last_used_at about once a minute per key.
+	if _, err := s.DB.ExecContext(ctx,
+		`UPDATE api_keys SET last_used_at=NOW()
+		 WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`,
+		k.ID,
+	); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
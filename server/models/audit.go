@@ -0,0 +1,84 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const (
+	AuditLoginLockout = "login.lockout"
+	AuditLoginUnlock  = "login.unlock"
+
+	AuditImpersonationStart  = "impersonation.start"
+	AuditImpersonatedRequest = "impersonation.request"
+)
+
+type AuditEntry struct {
+	ID           int               `json:"id"`
+	Action       string            `json:"action"`
+	ActorID      *int              `json:"actor_id"`
+	TargetUserID *int              `json:"target_user_id"`
+	IP           string            `json:"ip"`
+	Details      map[string]string `json:"details"`
+	CreatedAt    time.Time         `json:"created_at"`
+}
+
+type AuditStore struct{ DB *sql.DB }
+
+func NewAuditStore(db *sql.DB) *AuditStore { return &AuditStore{DB: db} }
+
+func (s *AuditStore) Record(ctx context.Context, e *AuditEntry) error {
+	ctx, end := begin(ctx, "AuditStore.Record")
+	defer end()
+
+	details := e.Details
+	if details == nil {
+		details = map[string]string{}
+	}
+	b, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.ExecContext(ctx,
+		`INSERT INTO audit_log (action, actor_id, target_user_id, ip, details)
+		 VALUES ($1, $2, $3, $4, $5::jsonb)`,
+		e.Action, e.ActorID, e.TargetUserID, e.IP, string(b),
+	)
+	return err
+}
+
+// List returns the most recent entries first, optionally only those with
+// the given action.
+func (s *AuditStore) List(ctx context.Context, action string, limit int) ([]*AuditEntry, error) {
+	ctx, end := begin(ctx, "AuditStore.List")
+	defer end()
+
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, action, actor_id, target_user_id, ip, details, created_at
+		 FROM audit_log
+		 WHERE $1 = '' OR action = $1
+		 ORDER BY id DESC LIMIT $2`,
+		action, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*AuditEntry
+	for rows.Next() {
+		e := &AuditEntry{}
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.Action, &e.ActorID, &e.TargetUserID, &e.IP,
+			&details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(details, &e.Details); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
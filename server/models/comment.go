@@ -1,47 +1,84 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"time"
 )
 
 type Comment struct {
-	ID        int       `json:"id"`
-	TicketID  int       `json:"ticket_id"`
-	UserID    int       `json:"user_id"`
-	Username  string    `json:"username"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int        `json:"id"`
+	TicketID  int        `json:"ticket_id"`
+	UserID    int        `json:"user_id"`
+	Username  string     `json:"username"`
+	Content   string     `json:"content"`
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
+const commentSelect = `SELECT c.id, c.ticket_id, c.user_id, u.username, c.content, c.version,
+                              c.created_at, c.deleted_at
+                       FROM comments c
+                       JOIN users u ON u.id = c.user_id`
+
 type CommentStore struct{ DB *sql.DB }
 
 func NewCommentStore(db *sql.DB) *CommentStore { return &CommentStore{DB: db} }
 
-func (s *CommentStore) Create(ticketID, userID int, content string) (*Comment, error) {
+func (s *CommentStore) Create(ctx context.Context, ticketID, userID int, content string) (*Comment, error) {
+	ctx, end := begin(ctx, "CommentStore.Create")
+	defer end()
+
 	c := &Comment{}
-	err := s.DB.QueryRow(
+	err := s.DB.QueryRowContext(ctx,
 		`INSERT INTO comments (ticket_id, user_id, content)
 		 VALUES ($1, $2, $3)
-		 RETURNING id, ticket_id, user_id, content, created_at`,
+		 RETURNING id, ticket_id, user_id, content, version, created_at`,
 		ticketID, userID, content,
-	).Scan(&c.ID, &c.TicketID, &c.UserID, &c.Content, &c.CreatedAt)
+	).Scan(&c.ID, &c.TicketID, &c.UserID, &c.Content, &c.Version, &c.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
-	s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, c.UserID).Scan(&c.Username)
+	s.DB.QueryRowContext(ctx, `SELECT username FROM users WHERE id=$1`, c.UserID).Scan(&c.Username)
+	return c, nil
+}
+
+func (s *CommentStore) GetByID(ctx context.Context, id int) (*Comment, error) {
+	ctx, end := begin(ctx, "CommentStore.GetByID")
+	defer end()
+
+	c := &Comment{}
+	err := s.DB.QueryRowContext(ctx,
+		commentSelect+` WHERE c.id=$1 AND c.deleted_at IS NULL`,
+		id,
+	).Scan(&c.ID, &c.TicketID, &c.UserID, &c.Username, &c.Content, &c.Version,
+		&c.CreatedAt, &c.DeletedAt)
+	if err != nil {
+		return nil, notFound(err, "comment")
+	}
 	return c, nil
 }
 
-func (s *CommentStore) ListByTicket(ticketID int) ([]*Comment, error) {
-	rows, err := s.DB.Query(
-		`SELECT c.id, c.ticket_id, c.user_id, u.username, c.content, c.created_at
-		 FROM comments c
-		 JOIN users u ON u.id = c.user_id
-		 WHERE c.ticket_id=$1
-		 ORDER BY c.created_at ASC`,
+func (s *CommentStore) ListByTicket(ctx context.Context, ticketID int) ([]*Comment, error) {
+	ctx, end := begin(ctx, "CommentStore.ListByTicket")
+	defer end()
+
+	return s.query(ctx,
+		commentSelect+` WHERE c.ticket_id=$1 AND c.deleted_at IS NULL ORDER BY c.created_at ASC`,
 		ticketID,
 	)
+}
+
+func (s *CommentStore) ListDeleted(ctx context.Context) ([]*Comment, error) {
+	ctx, end := begin(ctx, "CommentStore.ListDeleted")
+	defer end()
+
+	return s.query(ctx, commentSelect+` WHERE c.deleted_at IS NOT NULL ORDER BY c.deleted_at DESC`)
+}
+
+func (s *CommentStore) query(ctx context.Context, query string, args ...interface{}) ([]*Comment, error) {
+	rows, err := s.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +87,8 @@ func (s *CommentStore) ListByTicket(ticketID int) ([]*Comment, error) {
 	var comments []*Comment
 	for rows.Next() {
 		c := &Comment{}
-		if err := rows.Scan(&c.ID, &c.TicketID, &c.UserID, &c.Username, &c.Content, &c.CreatedAt); err != nil {
+		if err := rows.Scan(&c.ID, &c.TicketID, &c.UserID, &c.Username, &c.Content, &c.Version,
+			&c.CreatedAt, &c.DeletedAt); err != nil {
 			return nil, err
 		}
 		comments = append(comments, c)
@@ -58,7 +96,55 @@ func (s *CommentStore) ListByTicket(ticketID int) ([]*Comment, error) {
 	return comments, rows.Err()
 }
 
-func (s *CommentStore) Delete(id int) error {
-	_, err := s.DB.Exec(`DELETE FROM comments WHERE id=$1`, id)
-	return err
+func (s *CommentStore) Update(ctx context.Context, id, version int, content string) error {
+	ctx, end := begin(ctx, "CommentStore.Update")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE comments SET content=$1, version=version+1
+		 WHERE id=$2 AND version=$3 AND deleted_at IS NULL`,
+		content, id, version,
+	)
+	if err != nil {
+		return err
+	}
+	return checkVersioned(res)
+}
+
+func (s *CommentStore) Delete(ctx context.Context, id int) error {
+	ctx, end := begin(ctx, "CommentStore.Delete")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE comments SET deleted_at=NOW() WHERE id=$1 AND deleted_at IS NULL`, id,
+	)
+	if err != nil {
+		return err
+	}
+	return notFound(checkAffected(res), "comment")
+}
+
+func (s *CommentStore) Restore(ctx context.Context, id int) error {
+	ctx, end := begin(ctx, "CommentStore.Restore")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE comments SET deleted_at=NULL WHERE id=$1 AND deleted_at IS NOT NULL`, id,
+	)
+	if err != nil {
+		return err
+	}
+	return notFound(checkAffected(res), "deleted comment")
+}
+
+// Purge permanently removes comments that were soft-deleted before cutoff.
+func (s *CommentStore) Purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, end := begin(ctx, "CommentStore.Purge")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM comments WHERE deleted_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
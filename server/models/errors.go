@@ -0,0 +1,74 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+
+	"helpdesk/server/problem"
+)
+
+var (
+	ErrVersionConflict = problem.Conflict("version_conflict", "version conflict")
+	ErrEmailTaken      = problem.Conflict("email_taken", "email is already in use")
+	ErrUsernameTaken   = problem.Conflict("username_taken", "username is already in use")
+)
+
+func checkVersioned(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+func checkAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// notFound reports a lookup of what that found no row as a NotFound
+// problem, which still matches sql.ErrNoRows.
+func notFound(err error, what string) error {
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	e := problem.NotFound(what)
+	e.Err = err
+	return e
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// userConflict maps a unique violation on users to the field that clashed.
+func userConflict(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err
+	}
+	switch pqErr.Constraint {
+	case "users_email_key":
+		return ErrEmailTaken
+	case "users_username_key":
+		return ErrUsernameTaken
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LoginAttempt counts recent failed logins for one key, such as an account
+// email or a client IP.
+type LoginAttempt struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+type LoginAttemptStore struct{ DB *sql.DB }
+
+func NewLoginAttemptStore(db *sql.DB) *LoginAttemptStore { return &LoginAttemptStore{DB: db} }
+
+const loginAttemptColumns = `key, failures, last_failure_at, locked_until`
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryAttempts(ctx context.Context, db querier, q string, args ...interface{}) ([]*LoginAttempt, error) {
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []*LoginAttempt
+	for rows.Next() {
+		a := &LoginAttempt{}
+		if err := rows.Scan(&a.Key, &a.Failures, &a.LastFailureAt, &a.LockedUntil); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+func (s *LoginAttemptStore) ListLocked(ctx context.Context) ([]*LoginAttempt, error) {
+	ctx, end := begin(ctx, "LoginAttemptStore.ListLocked")
+	defer end()
+
+	return queryAttempts(ctx, s.DB,
+		`SELECT `+loginAttemptColumns+` FROM login_attempts
+		 WHERE locked_until > NOW() ORDER BY locked_until DESC`,
+	)
+}
+
+// Attempt records an attempt against keys in one transaction. The counters
+// stay locked until it commits, so concurrent attempts take turns and each
+// sees the ones before it. check is given every counter, a missing one with
+// no failures, and says whether it holds the attempt back and whether its
+// key is to be locked for lockout. Unless a counter holds it back, the
+// attempt counts as a failure against all keys; the count starts over when
+// the last failure is older than window. Attempt returns the counters as
+// they are afterwards.
+func (s *LoginAttemptStore) Attempt(ctx context.Context, keys []string, window, lockout time.Duration,
+	check func(a *LoginAttempt) (hold, lock bool)) ([]*LoginAttempt, error) {
+	ctx, end := begin(ctx, "LoginAttemptStore.Attempt")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO login_attempts (key, failures, last_failure_at)
+		 SELECT unnest($1::text[]), 0, NOW()
+		 ON CONFLICT (tenant_id, key) DO NOTHING`,
+		pq.Array(keys),
+	); err != nil {
+		return nil, err
+	}
+	// Locking in key order keeps concurrent attempts from deadlocking.
+	attempts, err := queryAttempts(ctx, tx,
+		`SELECT key,
+		        CASE WHEN last_failure_at < NOW() - $2 * INTERVAL '1 second' THEN 0 ELSE failures END,
+		        last_failure_at, locked_until
+		 FROM login_attempts WHERE key = ANY($1) ORDER BY key FOR UPDATE`,
+		pq.Array(keys), window.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	held := false
+	var locks []string
+	for _, a := range attempts {
+		hold, lock := check(a)
+		held = held || hold || lock
+		if lock {
+			locks = append(locks, a.Key)
+		}
+	}
+	if len(locks) > 0 {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE login_attempts SET locked_until = NOW() + $2 * INTERVAL '1 second' WHERE key = ANY($1)`,
+			pq.Array(locks), lockout.Seconds(),
+		); err != nil {
+			return nil, err
+		}
+	}
+	if !held {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE login_attempts SET
+			     failures = CASE
+			         WHEN last_failure_at < NOW() - $2 * INTERVAL '1 second' THEN 1
+			         ELSE failures + 1
+			     END,
+			     last_failure_at = NOW()
+			 WHERE key = ANY($1)`,
+			pq.Array(keys), window.Seconds(),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	attempts, err = queryAttempts(ctx, tx,
+		`SELECT `+loginAttemptColumns+` FROM login_attempts WHERE key = ANY($1) ORDER BY key`,
+		pq.Array(keys),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return attempts, tx.Commit()
+}
+
+// Refund takes back an attempt counted against key by Attempt.
+func (s *LoginAttemptStore) Refund(ctx context.Context, key string) error {
+	ctx, end := begin(ctx, "LoginAttemptStore.Refund")
+	defer end()
+
+	_, err := s.DB.ExecContext(ctx,
+		`UPDATE login_attempts SET failures = GREATEST(failures - 1, 0) WHERE key=$1`, key,
+	)
+	return err
+}
+
+// Reset clears the failures and any lock on key.
+func (s *LoginAttemptStore) Reset(ctx context.Context, key string) error {
+	ctx, end := begin(ctx, "LoginAttemptStore.Reset")
+	defer end()
+
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM login_attempts WHERE key=$1`, key)
+	return err
+}
+
+// DeleteStale removes unlocked entries whose last failure is before cutoff.
+func (s *LoginAttemptStore) DeleteStale(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, end := begin(ctx, "LoginAttemptStore.DeleteStale")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`DELETE FROM login_attempts
+		 WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until <= NOW())`,
+		cutoff,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,223 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"helpdesk/server/problem"
+)
+
+var ErrMFANotEnrolled = problem.Conflict("mfa_not_enrolled", "two-factor authentication is not set up")
+
+type MFAStore struct{ DB *sql.DB }
+
+func NewMFAStore(db *sql.DB) *MFAStore { return &MFAStore{DB: db} }
+
+// TOTPSecret returns the user's TOTP secret, which may still be pending
+// verification, and whether TOTP is enabled.
+func (s *MFAStore) TOTPSecret(ctx context.Context, userID int) (string, bool, error) {
+	ctx, end := begin(ctx, "MFAStore.TOTPSecret")
+	defer end()
+
+	var secret sql.NullString
+	var enabled bool
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT totp_secret, totp_enabled FROM users WHERE id=$1 AND deleted_at IS NULL`, userID,
+	).Scan(&secret, &enabled)
+	if err != nil {
+		return "", false, err
+	}
+	if !secret.Valid {
+		return "", false, ErrMFANotEnrolled
+	}
+	return secret.String, enabled, nil
+}
+
+// StartEnrollment stores a pending secret. An already enabled secret is
+// left in place until the new one is verified.
+func (s *MFAStore) StartEnrollment(ctx context.Context, userID int, secret string) error {
+	ctx, end := begin(ctx, "MFAStore.StartEnrollment")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET totp_secret=$1, totp_last_step=NULL
+		 WHERE id=$2 AND deleted_at IS NULL AND NOT totp_enabled`,
+		secret, userID,
+	)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+// Enable turns on TOTP and replaces the user's recovery codes.
+func (s *MFAStore) Enable(ctx context.Context, userID int, codeHashes []string) error {
+	ctx, end := begin(ctx, "MFAStore.Enable")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE users SET totp_enabled=TRUE, version=version+1 WHERE id=$1`, userID,
+	); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *MFAStore) Disable(ctx context.Context, userID int) error {
+	ctx, end := begin(ctx, "MFAStore.Disable")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE users SET totp_secret=NULL, totp_enabled=FALSE, totp_last_step=NULL,
+		                  version=version+1
+		 WHERE id=$1`,
+		userID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id=$1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *MFAStore) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	ctx, end := begin(ctx, "MFAStore.ReplaceRecoveryCodes")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id=$1`, userID); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, h,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseStep records that the code for the given time step has been used. It
+// fails with ErrInvalidToken if that step, or a later one, was used before.
+func (s *MFAStore) UseStep(ctx context.Context, userID int, step int64) error {
+	ctx, end := begin(ctx, "MFAStore.UseStep")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET totp_last_step=$1
+		 WHERE id=$2 AND (totp_last_step IS NULL OR totp_last_step < $1)`,
+		step, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(res); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (s *MFAStore) UseRecoveryCode(ctx context.Context, userID int, codeHash string) error {
+	ctx, end := begin(ctx, "MFAStore.UseRecoveryCode")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE mfa_recovery_codes SET used_at=NOW()
+		 WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL`,
+		userID, codeHash,
+	)
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(res); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (s *MFAStore) RequiredRoles(ctx context.Context) ([]Role, error) {
+	ctx, end := begin(ctx, "MFAStore.RequiredRoles")
+	defer end()
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT role FROM mfa_required_roles ORDER BY role`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var r Role
+		if err := rows.Scan(&r); err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+func (s *MFAStore) SetRequiredRoles(ctx context.Context, roles []Role) error {
+	ctx, end := begin(ctx, "MFAStore.SetRequiredRoles")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_required_roles`); err != nil {
+		return err
+	}
+	for _, r := range roles {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO mfa_required_roles (role) VALUES ($1) ON CONFLICT DO NOTHING`, r,
+		); err != nil {
+			if isForeignKeyViolation(err) {
+				return ErrUnknownRole
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *MFAStore) RoleRequiresMFA(ctx context.Context, role Role) (bool, error) {
+	ctx, end := begin(ctx, "MFAStore.RoleRequiresMFA")
+	defer end()
+
+	var required bool
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM mfa_required_roles WHERE role=$1)`, role,
+	).Scan(&required)
+	return required, err
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// OIDCFlow holds the per-login secrets of an authorization code flow between
+// the redirect to the identity provider and its callback.
+type OIDCFlow struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+type OIDCFlowStore struct{ DB *sql.DB }
+
+func NewOIDCFlowStore(db *sql.DB) *OIDCFlowStore { return &OIDCFlowStore{DB: db} }
+
+func (s *OIDCFlowStore) Create(ctx context.Context, f OIDCFlow, expiresAt time.Time) error {
+	ctx, end := begin(ctx, "OIDCFlowStore.Create")
+	defer end()
+
+	if _, err := s.DB.ExecContext(ctx, `DELETE FROM oidc_flows WHERE expires_at < NOW()`); err != nil {
+		return err
+	}
+	_, err := s.DB.ExecContext(ctx,
+		`INSERT INTO oidc_flows (state, nonce, code_verifier, expires_at) VALUES ($1, $2, $3, $4)`,
+		f.State, f.Nonce, f.CodeVerifier, expiresAt,
+	)
+	return err
+}
+
+// Take returns the flow for state and deletes it, so that every state can
+// be redeemed only once.
+func (s *OIDCFlowStore) Take(ctx context.Context, state string) (*OIDCFlow, error) {
+	ctx, end := begin(ctx, "OIDCFlowStore.Take")
+	defer end()
+
+	f := &OIDCFlow{}
+	err := s.DB.QueryRowContext(ctx,
+		`DELETE FROM oidc_flows WHERE state=$1 AND expires_at > NOW()
+		 RETURNING state, nonce, code_verifier`,
+		state,
+	).Scan(&f.State, &f.Nonce, &f.CodeVerifier)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,215 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"helpdesk/server/problem"
+)
+
+var (
+	ErrOrgNameTaken = problem.Conflict("organization_name_taken", "organization name is already in use")
+	ErrDomainTaken  = problem.Conflict("domain_taken", "domain already belongs to another organization")
+	ErrUnknownOrg   = problem.New(problem.KindInvalid, "unknown_organization", "unknown organization")
+)
+
+type Organization struct {
+	ID             int       `json:"id"`
+	Name           string    `json:"name"`
+	Domains        []string  `json:"domains"`
+	ShareByDefault bool      `json:"share_by_default"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type OrganizationStore struct{ DB *sql.DB }
+
+func NewOrganizationStore(db *sql.DB) *OrganizationStore { return &OrganizationStore{DB: db} }
+
+const organizationSelect = `SELECT o.id, o.name, o.share_by_default, o.created_at,
+                                   ARRAY(SELECT domain FROM organization_domains d
+                                         WHERE d.organization_id = o.id ORDER BY domain)
+                            FROM organizations o`
+
+func scanOrganization(row rowScanner) (*Organization, error) {
+	o := &Organization{}
+	err := row.Scan(&o.ID, &o.Name, &o.ShareByDefault, &o.CreatedAt, pq.Array(&o.Domains))
+	if err != nil {
+		return nil, err
+	}
+	if o.Domains == nil {
+		o.Domains = []string{}
+	}
+	return o, nil
+}
+
+func (s *OrganizationStore) List(ctx context.Context) ([]*Organization, error) {
+	ctx, end := begin(ctx, "OrganizationStore.List")
+	defer end()
+
+	rows, err := s.DB.QueryContext(ctx, organizationSelect+` ORDER BY o.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []*Organization
+	for rows.Next() {
+		o, err := scanOrganization(rows)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+func (s *OrganizationStore) GetByID(ctx context.Context, id int) (*Organization, error) {
+	ctx, end := begin(ctx, "OrganizationStore.GetByID")
+	defer end()
+
+	o, err := scanOrganization(s.DB.QueryRowContext(ctx, organizationSelect+` WHERE o.id=$1`, id))
+	return o, notFound(err, "organization")
+}
+
+func (s *OrganizationStore) Create(ctx context.Context, name string, domains []string, shareByDefault bool) (*Organization, error) {
+	ctx, end := begin(ctx, "OrganizationStore.Create")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO organizations (name, share_by_default) VALUES ($1, $2) RETURNING id`,
+		name, shareByDefault,
+	).Scan(&id)
+	if isUniqueViolation(err) {
+		return nil, ErrOrgNameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := setDomains(ctx, tx, id, domains); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetByID(ctx, id)
+}
+
+func (s *OrganizationStore) Update(ctx context.Context, id int, name string, domains []string, shareByDefault bool) (*Organization, error) {
+	ctx, end := begin(ctx, "OrganizationStore.Update")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE organizations SET name=$1, share_by_default=$2 WHERE id=$3`,
+		name, shareByDefault, id,
+	)
+	if isUniqueViolation(err) {
+		return nil, ErrOrgNameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAffected(res); err != nil {
+		return nil, notFound(err, "organization")
+	}
+	if err := setDomains(ctx, tx, id, domains); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetByID(ctx, id)
+}
+
+// setDomains replaces the organization's domains and pulls in existing users
+// of those domains that are not in any organization yet.
+func setDomains(ctx context.Context, tx *sql.Tx, id int, domains []string) error {
+	for i, d := range domains {
+		domains[i] = strings.ToLower(d)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM organization_domains WHERE organization_id=$1`, id); err != nil {
+		return err
+	}
+	for _, d := range domains {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO organization_domains (domain, organization_id) VALUES ($1, $2)
+			 ON CONFLICT (tenant_id, domain) DO NOTHING`,
+			d, id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	var owned int
+	if err := tx.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM organization_domains WHERE organization_id=$1`, id,
+	).Scan(&owned); err != nil {
+		return err
+	}
+	if owned != len(domains) {
+		return ErrDomainTaken
+	}
+
+	_, err := tx.ExecContext(ctx,
+		`UPDATE users SET organization_id=$1
+		 WHERE organization_id IS NULL AND lower(split_part(email, '@', 2)) = ANY($2)`,
+		id, pq.Array(domains),
+	)
+	return err
+}
+
+func (s *OrganizationStore) Delete(ctx context.Context, id int) error {
+	ctx, end := begin(ctx, "OrganizationStore.Delete")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM organizations WHERE id=$1`, id)
+	if err != nil {
+		return err
+	}
+	return notFound(checkAffected(res), "organization")
+}
+
+// SetMembership moves a user into an organization, or out of any when orgID
+// is nil. Only members can be managers.
+func (s *OrganizationStore) SetMembership(ctx context.Context, userID int, orgID *int, manager bool) error {
+	ctx, end := begin(ctx, "OrganizationStore.SetMembership")
+	defer end()
+
+	if orgID != nil {
+		// Checked here rather than left to the foreign key, which would
+		// also accept another tenant's organization.
+		if _, err := s.GetByID(ctx, *orgID); errors.Is(err, sql.ErrNoRows) {
+			return ErrUnknownOrg
+		} else if err != nil {
+			return err
+		}
+	}
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET organization_id=$1, org_manager=$2 AND $1::int IS NOT NULL
+		 WHERE id=$3 AND deleted_at IS NULL`,
+		orgID, manager, userID,
+	)
+	if err != nil {
+		return err
+	}
+	return notFound(checkAffected(res), "user")
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type PasswordResetStore struct{ DB *sql.DB }
+
+func NewPasswordResetStore(db *sql.DB) *PasswordResetStore { return &PasswordResetStore{DB: db} }
+
+func (s *PasswordResetStore) Create(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	ctx, end := begin(ctx, "PasswordResetStore.Create")
+	defer end()
+
+	_, err := s.DB.ExecContext(ctx,
+		`INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		userID, tokenHash, expiresAt,
+	)
+	return err
+}
+
+// Consume redeems an unused, unexpired reset token: it sets the new password,
+// revokes the user's sessions and API keys and invalidates every other
+// outstanding token.
+func (s *PasswordResetStore) Consume(ctx context.Context, tokenHash, passwordHash string) (int, error) {
+	ctx, end := begin(ctx, "PasswordResetStore.Consume")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx,
+		`UPDATE password_resets SET used_at=NOW()
+		 WHERE token_hash=$1 AND used_at IS NULL AND expires_at > NOW()
+		 RETURNING user_id`,
+		tokenHash,
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE users SET password_hash=$1, session_version=session_version+1
+		 WHERE id=$2 AND deleted_at IS NULL`,
+		passwordHash, userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkAffected(res); err != nil {
+		return 0, ErrInvalidToken
+	}
+	if err := revokeAPIKeys(ctx, tx, userID); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE password_resets SET used_at=NOW() WHERE user_id=$1 AND used_at IS NULL`,
+		userID,
+	); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"helpdesk/server/problem"
+)
+
+var ErrInvalidToken = problem.New(problem.KindInvalid, "invalid_token", "invalid or expired token")
+
+// NotificationPrefs maps a notification kind (e.g. "ticket_updated") to
+// whether the user wants to receive it.
+type NotificationPrefs map[string]bool
+
+func (p *NotificationPrefs) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("notification prefs: unexpected type %T", src)
+	}
+	return json.Unmarshal(b, p)
+}
+
+func (p NotificationPrefs) Value() (driver.Value, error) {
+	if p == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(p)
+	return string(b), err
+}
+
+// ProfilePatch describes a self-service profile update. Nil fields are left
+// untouched; SetDisplayName with a nil DisplayName clears it.
+type ProfilePatch struct {
+	SetDisplayName    bool
+	DisplayName       *string
+	Timezone          *string
+	Locale            *string
+	NotificationPrefs NotificationPrefs
+}
+
+func (s *UserStore) UpdateProfile(ctx context.Context, id int, p ProfilePatch) error {
+	ctx, end := begin(ctx, "UserStore.UpdateProfile")
+	defer end()
+
+	var sets []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s=$%d", column, len(args)))
+	}
+	if p.SetDisplayName {
+		set("display_name", p.DisplayName)
+	}
+	if p.Timezone != nil {
+		set("timezone", *p.Timezone)
+	}
+	if p.Locale != nil {
+		set("locale", *p.Locale)
+	}
+	if p.NotificationPrefs != nil {
+		args = append(args, p.NotificationPrefs)
+		sets = append(sets, fmt.Sprintf("notification_prefs=notification_prefs || $%d::jsonb", len(args)))
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	sets = append(sets, "version=version+1")
+	args = append(args, id)
+
+	res, err := s.DB.ExecContext(ctx,
+		fmt.Sprintf(`UPDATE users SET %s WHERE id=$%d AND deleted_at IS NULL`,
+			strings.Join(sets, ", "), len(args)),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+// SetPendingEmail records an email change that takes effect once the token
+// whose hash is given has been confirmed.
+func (s *UserStore) SetPendingEmail(ctx context.Context, id int, email, tokenHash string, expiresAt time.Time) error {
+	ctx, end := begin(ctx, "UserStore.SetPendingEmail")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users
+		 SET pending_email=$1, pending_email_token_hash=$2, pending_email_expires_at=$3
+		 WHERE id=$4 AND deleted_at IS NULL`,
+		email, tokenHash, expiresAt, id,
+	)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+// ConfirmEmail makes the pending email the verified address of the user,
+// which also lets the user join the organization of its domain.
+func (s *UserStore) ConfirmEmail(ctx context.Context, id int, tokenHash string) error {
+	ctx, end := begin(ctx, "UserStore.ConfirmEmail")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users
+		 SET email=pending_email, email_verified=TRUE, pending_email=NULL,
+		     pending_email_token_hash=NULL, pending_email_expires_at=NULL,
+		     version=version+1
+		 WHERE id=$1 AND deleted_at IS NULL
+		   AND pending_email_token_hash=$2 AND pending_email_expires_at > NOW()`,
+		id, tokenHash,
+	)
+	if isUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(res); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// ChangePassword stores a new password hash, bumps the session version,
+// which invalidates every token issued before the change, and revokes the
+// user's API keys.
+func (s *UserStore) ChangePassword(ctx context.Context, id int, passwordHash string) (int, error) {
+	ctx, end := begin(ctx, "UserStore.ChangePassword")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var sessionVersion int
+	err = tx.QueryRowContext(ctx,
+		`UPDATE users SET password_hash=$1, session_version=session_version+1
+		 WHERE id=$2 AND deleted_at IS NULL
+		 RETURNING session_version`,
+		passwordHash, id,
+	).Scan(&sessionVersion)
+	if err != nil {
+		return 0, err
+	}
+	if err := revokeAPIKeys(ctx, tx, id); err != nil {
+		return 0, err
+	}
+	return sessionVersion, tx.Commit()
+}
+
+// RevokeSessions bumps the session version, which invalidates every token
+// issued to the user so far.
+func (s *UserStore) RevokeSessions(ctx context.Context, id int) error {
+	ctx, end := begin(ctx, "UserStore.RevokeSessions")
+	defer end()
+
+	_, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET session_version=session_version+1 WHERE id=$1 AND deleted_at IS NULL`, id,
+	)
+	return err
+}
+
+// Session returns the current session version and role of an active user.
+func (s *UserStore) Session(ctx context.Context, id int) (int, Role, error) {
+	ctx, end := begin(ctx, "UserStore.Session")
+	defer end()
+
+	var (
+		sessionVersion int
+		role           Role
+	)
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT session_version, role FROM users WHERE id=$1 AND deleted_at IS NULL`, id,
+	).Scan(&sessionVersion, &role)
+	return sessionVersion, role, err
+}
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+
+	"helpdesk/server/problem"
+)
+
+// Permissions that roles are built from.
+const (
+	PermTicketReadAny    = "ticket.read.any"
+	PermTicketUpdateAny  = "ticket.update.any"
+	PermTicketAssign     = "ticket.assign"
+	PermTicketDelete     = "ticket.delete"
+	PermCommentUpdateAny = "comment.update.any"
+	PermCommentDelete    = "comment.delete"
+	PermUserManage       = "user.manage"
+	PermUserImpersonate  = "user.impersonate"
+	PermRoleManage       = "role.manage"
+	PermOrgManage        = "org.manage"
+	PermSecurityManage   = "security.manage"
+	PermAuditView        = "audit.view"
+	PermTrashManage      = "trash.manage"
+	PermReportView       = "report.view"
+)
+
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+var Permissions = []Permission{
+	{PermTicketReadAny, "See every ticket and its comments, not just your own"},
+	{PermTicketUpdateAny, "Edit and change the status of any ticket; be assigned tickets"},
+	{PermTicketAssign, "Assign tickets"},
+	{PermTicketDelete, "Delete tickets"},
+	{PermCommentUpdateAny, "Edit other users' comments"},
+	{PermCommentDelete, "Delete comments"},
+	{PermUserManage, "List, edit, delete and unlock users"},
+	{PermUserImpersonate, "View the application as another user, read-only"},
+	{PermRoleManage, "Create and edit roles"},
+	{PermOrgManage, "Create organizations and manage their members"},
+	{PermSecurityManage, "Change security policies such as required MFA"},
+	{PermAuditView, "Read the audit log"},
+	{PermTrashManage, "List and restore deleted items"},
+	{PermReportView, "View reports"},
+}
+
+func ValidPermission(p string) bool {
+	for _, known := range Permissions {
+		if known.Name == p {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ErrBuiltinRole = problem.Conflict("builtin_role", "built-in role cannot be changed")
+	ErrRoleInUse   = problem.Conflict("role_in_use", "role is still assigned to users")
+	ErrRoleExists  = problem.Conflict("role_exists", "role already exists")
+	ErrUnknownRole = problem.New(problem.KindInvalid, "unknown_role", "unknown role")
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,63}$`)
+
+func ValidRoleName(name string) bool {
+	return roleNamePattern.MatchString(name)
+}
+
+// RoleDefinition is a named set of permissions that users can be given.
+type RoleDefinition struct {
+	Name        Role      `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	Builtin     bool      `json:"builtin"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type RoleStore struct{ DB *sql.DB }
+
+func NewRoleStore(db *sql.DB) *RoleStore { return &RoleStore{DB: db} }
+
+const roleColumns = `name, description, permissions, builtin, created_at, updated_at`
+
+func scanRole(row rowScanner) (*RoleDefinition, error) {
+	r := &RoleDefinition{}
+	err := row.Scan(&r.Name, &r.Description, pq.Array(&r.Permissions), &r.Builtin,
+		&r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if r.Permissions == nil {
+		r.Permissions = []string{}
+	}
+	return r, nil
+}
+
+func (s *RoleStore) List(ctx context.Context) ([]*RoleDefinition, error) {
+	ctx, end := begin(ctx, "RoleStore.List")
+	defer end()
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+roleColumns+` FROM roles ORDER BY builtin DESC, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*RoleDefinition
+	for rows.Next() {
+		r, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+func (s *RoleStore) Get(ctx context.Context, name Role) (*RoleDefinition, error) {
+	ctx, end := begin(ctx, "RoleStore.Get")
+	defer end()
+
+	r, err := scanRole(s.DB.QueryRowContext(ctx, `SELECT `+roleColumns+` FROM roles WHERE name=$1`, name))
+	return r, notFound(err, "role")
+}
+
+// Exists reports whether name is a defined role.
+func (s *RoleStore) Exists(ctx context.Context, name Role) (bool, error) {
+	ctx, end := begin(ctx, "RoleStore.Exists")
+	defer end()
+
+	var exists bool
+	err := s.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name=$1)`, name).Scan(&exists)
+	return exists, err
+}
+
+// Permissions returns the permissions granted by role, or none if the role
+// does not exist.
+func (s *RoleStore) Permissions(ctx context.Context, role Role) ([]string, error) {
+	ctx, end := begin(ctx, "RoleStore.Permissions")
+	defer end()
+
+	var perms []string
+	err := s.DB.QueryRowContext(ctx, `SELECT permissions FROM roles WHERE name=$1`, role).Scan(pq.Array(&perms))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return perms, err
+}
+
+func (s *RoleStore) Create(ctx context.Context, name Role, description string, permissions []string) (*RoleDefinition, error) {
+	ctx, end := begin(ctx, "RoleStore.Create")
+	defer end()
+
+	r, err := scanRole(s.DB.QueryRowContext(ctx,
+		`INSERT INTO roles (name, description, permissions) VALUES ($1, $2, $3)
+		 RETURNING `+roleColumns,
+		name, description, pq.Array(permissions),
+	))
+	if isUniqueViolation(err) {
+		return nil, ErrRoleExists
+	}
+	return r, err
+}
+
+// Update replaces the description and permissions of a role. The admin role
+// is fixed so that an administrator cannot lock everyone out.
+func (s *RoleStore) Update(ctx context.Context, name Role, description string, permissions []string) (*RoleDefinition, error) {
+	ctx, end := begin(ctx, "RoleStore.Update")
+	defer end()
+
+	if name == RoleAdmin {
+		return nil, ErrBuiltinRole
+	}
+	r, err := scanRole(s.DB.QueryRowContext(ctx,
+		`UPDATE roles SET description=$2, permissions=$3 WHERE name=$1
+		 RETURNING `+roleColumns,
+		name, description, pq.Array(permissions),
+	))
+	return r, notFound(err, "role")
+}
+
+// Delete removes a custom role that no user, including deleted ones, has.
+func (s *RoleStore) Delete(ctx context.Context, name Role) error {
+	ctx, end := begin(ctx, "RoleStore.Delete")
+	defer end()
+
+	var builtin bool
+	err := s.DB.QueryRowContext(ctx, `SELECT builtin FROM roles WHERE name=$1`, name).Scan(&builtin)
+	if err != nil {
+		return notFound(err, "role")
+	}
+	if builtin {
+		return ErrBuiltinRole
+	}
+
+	_, err = s.DB.ExecContext(ctx, `DELETE FROM roles WHERE name=$1`, name)
+	if isForeignKeyViolation(err) {
+		return ErrRoleInUse
+	}
+	return err
+}
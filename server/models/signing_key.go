@@ -0,0 +1,105 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SigningKey is a JWT signing key shared by all replicas. PrivateKey holds
+// the PKCS #8 DER encoding.
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey []byte
+	CreatedAt  time.Time
+	RetiredAt  *time.Time
+}
+
+type SigningKeyStore struct{ DB *sql.DB }
+
+func NewSigningKeyStore(db *sql.DB) *SigningKeyStore { return &SigningKeyStore{DB: db} }
+
+// ListUsable returns the keys of the algorithm that are still accepted for
+// verification, newest first. The first non-retired key signs new tokens.
+func (s *SigningKeyStore) ListUsable(ctx context.Context, algorithm string, retention time.Duration) ([]*SigningKey, error) {
+	ctx, end := begin(ctx, "SigningKeyStore.ListUsable")
+	defer end()
+
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT kid, algorithm, private_key, created_at, retired_at
+		 FROM signing_keys
+		 WHERE algorithm=$1 AND (retired_at IS NULL OR retired_at > $2)
+		 ORDER BY created_at DESC`,
+		algorithm, time.Now().Add(-retention),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*SigningKey
+	for rows.Next() {
+		k := &SigningKey{}
+		if err := rows.Scan(&k.ID, &k.Algorithm, &k.PrivateKey, &k.CreatedAt, &k.RetiredAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Rotate makes k the signing key and retires the previous ones, unless
+// another replica already rotated within maxAge. It reports whether k was
+// stored.
+func (s *SigningKeyStore) Rotate(ctx context.Context, k *SigningKey, maxAge time.Duration) (bool, error) {
+	ctx, end := begin(ctx, "SigningKeyStore.Rotate")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('signing_keys'))`); err != nil {
+		return false, err
+	}
+
+	var fresh bool
+	if err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (
+		     SELECT 1 FROM signing_keys
+		     WHERE algorithm=$1 AND retired_at IS NULL AND created_at > $2
+		 )`,
+		k.Algorithm, time.Now().Add(-maxAge),
+	).Scan(&fresh); err != nil {
+		return false, err
+	}
+	if fresh {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE signing_keys SET retired_at=NOW() WHERE algorithm=$1 AND retired_at IS NULL`,
+		k.Algorithm,
+	); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO signing_keys (kid, algorithm, private_key) VALUES ($1, $2, $3)`,
+		k.ID, k.Algorithm, k.PrivateKey,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// DeleteRetired removes keys retired before cutoff.
+func (s *SigningKeyStore) DeleteRetired(ctx context.Context, cutoff time.Time) error {
+	ctx, end := begin(ctx, "SigningKeyStore.DeleteRetired")
+	defer end()
+
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM signing_keys WHERE retired_at < $1`, cutoff)
+	return err
+}
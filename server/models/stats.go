@@ -0,0 +1,131 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TicketCount is the number of live tickets of a tenant with a given status
+// and priority.
+type TicketCount struct {
+	Tenant   string
+	Status   TicketStatus
+	Priority TicketPriority
+	Count    int
+}
+
+// TenantCount is a per-tenant count.
+type TenantCount struct {
+	Tenant string
+	Count  int
+}
+
+// StatsStore computes the figures exported as metrics. It must be given a
+// connection that sees all tenants.
+type StatsStore struct{ DB *sql.DB }
+
+func NewStatsStore(db *sql.DB) *StatsStore { return &StatsStore{DB: db} }
+
+func (s *StatsStore) TicketCounts(ctx context.Context) ([]TicketCount, error) {
+	ctx, end := begin(ctx, "StatsStore.TicketCounts")
+	defer end()
+
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT n.slug, t.status, t.priority, count(*)
+		 FROM tickets t JOIN tenants n ON n.id = t.tenant_id
+		 WHERE t.deleted_at IS NULL
+		 GROUP BY n.slug, t.status, t.priority`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []TicketCount
+	for rows.Next() {
+		var c TicketCount
+		if err := rows.Scan(&c.Tenant, &c.Status, &c.Priority, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// Unassigned counts open and in-progress tickets nobody is assigned to.
+func (s *StatsStore) Unassigned(ctx context.Context) ([]TenantCount, error) {
+	ctx, end := begin(ctx, "StatsStore.Unassigned")
+	defer end()
+
+	return s.tenantCounts(ctx,
+		`SELECT n.slug, count(*)
+		 FROM tickets t JOIN tenants n ON n.id = t.tenant_id
+		 WHERE t.deleted_at IS NULL AND t.assigned_to IS NULL
+		   AND t.status IN ('open', 'in_progress')
+		 GROUP BY n.slug`,
+	)
+}
+
+// SLABreaches counts open and in-progress tickets older than the resolution
+// target of their priority. Priorities without a positive target never
+// breach.
+func (s *StatsStore) SLABreaches(ctx context.Context, targets map[TicketPriority]time.Duration) ([]TenantCount, error) {
+	ctx, end := begin(ctx, "StatsStore.SLABreaches")
+	defer end()
+
+	var priorities []string
+	var seconds []int64
+	for p, d := range targets {
+		if d <= 0 {
+			continue
+		}
+		priorities = append(priorities, string(p))
+		seconds = append(seconds, int64(d.Seconds()))
+	}
+	return s.tenantCounts(ctx,
+		`SELECT n.slug, count(*)
+		 FROM tickets t
+		 JOIN tenants n ON n.id = t.tenant_id
+		 JOIN unnest($1::text[], $2::bigint[]) AS sla(priority, seconds)
+		   ON sla.priority = t.priority::text
+		 WHERE t.deleted_at IS NULL AND t.status IN ('open', 'in_progress')
+		   AND t.created_at < NOW() - sla.seconds * INTERVAL '1 second'
+		 GROUP BY n.slug`,
+		pq.Array(priorities), pq.Array(seconds),
+	)
+}
+
+// CommentsSince counts comments written after since.
+func (s *StatsStore) CommentsSince(ctx context.Context, since time.Time) ([]TenantCount, error) {
+	ctx, end := begin(ctx, "StatsStore.CommentsSince")
+	defer end()
+
+	return s.tenantCounts(ctx,
+		`SELECT n.slug, count(*)
+		 FROM comments c JOIN tenants n ON n.id = c.tenant_id
+		 WHERE c.deleted_at IS NULL AND c.created_at > $1
+		 GROUP BY n.slug`,
+		since,
+	)
+}
+
+func (s *StatsStore) tenantCounts(ctx context.Context, query string, args ...interface{}) ([]TenantCount, error) {
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []TenantCount
+	for rows.Next() {
+		var c TenantCount
+		if err := rows.Scan(&c.Tenant, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"time"
+
+	"helpdesk/server/problem"
+)
+
+var ErrTenantExists = problem.Conflict("tenant_exists", "tenant already exists")
+
+var tenantSlugPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidTenantSlug reports whether slug can be used as a tenant's subdomain.
+func ValidTenantSlug(slug string) bool {
+	return tenantSlugPattern.MatchString(slug)
+}
+
+type Tenant struct {
+	ID        int       `json:"id"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TenantStore manages tenants. It must be given a connection that sees all
+// tenants, as provisioning writes rows on behalf of the new tenant.
+type TenantStore struct{ DB *sql.DB }
+
+func NewTenantStore(db *sql.DB) *TenantStore { return &TenantStore{DB: db} }
+
+func (s *TenantStore) List(ctx context.Context) ([]*Tenant, error) {
+	ctx, end := begin(ctx, "TenantStore.List")
+	defer end()
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT id, slug, name, created_at FROM tenants ORDER BY slug`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []*Tenant
+	for rows.Next() {
+		t := &Tenant{}
+		if err := rows.Scan(&t.ID, &t.Slug, &t.Name, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+func (s *TenantStore) GetBySlug(ctx context.Context, slug string) (*Tenant, error) {
+	ctx, end := begin(ctx, "TenantStore.GetBySlug")
+	defer end()
+
+	t := &Tenant{}
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT id, slug, name, created_at FROM tenants WHERE slug=$1`, slug,
+	).Scan(&t.ID, &t.Slug, &t.Name, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Provision creates a tenant together with its built-in roles.
+func (s *TenantStore) Provision(ctx context.Context, slug, name string) (*Tenant, error) {
+	ctx, end := begin(ctx, "TenantStore.Provision")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	t := &Tenant{}
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO tenants (slug, name) VALUES ($1, $2) RETURNING id, slug, name, created_at`,
+		slug, name,
+	).Scan(&t.ID, &t.Slug, &t.Name, &t.CreatedAt)
+	if isUniqueViolation(err) {
+		return nil, ErrTenantExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT seed_tenant_roles($1)`, t.ID); err != nil {
+		return nil, err
+	}
+	return t, tx.Commit()
+}
+
+// tenantTables lists the tenant's tables in an order in which their rows can
+// be deleted without violating foreign keys.
+var tenantTables = []string{
+	"audit_log", "login_attempts", "api_keys", "oidc_flows", "password_resets",
+	"mfa_recovery_codes", "mfa_required_roles", "comments", "tickets", "users",
+	"organization_domains", "organizations", "roles",
+}
+
+// Deprovision deletes a tenant and all of its data.
+func (s *TenantStore) Deprovision(ctx context.Context, slug string) error {
+	ctx, end := begin(ctx, "TenantStore.Deprovision")
+	defer end()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM tenants WHERE slug=$1 FOR UPDATE`, slug).Scan(&id); err != nil {
+		return err
+	}
+	for _, table := range tenantTables {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE tenant_id=$1`, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tenants WHERE id=$1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
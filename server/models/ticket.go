@@ -1,8 +1,14 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
+
+	"helpdesk/server/problem"
 )
 
 type TicketStatus string
@@ -20,6 +26,24 @@ const (
 	PriorityCritical TicketPriority = "critical"
 )
 
+var ErrInvalidAssignee = problem.New(problem.KindInvalid, "invalid_assignee", "assignee must be an existing staff user")
+
+func (s TicketStatus) Valid() bool {
+	switch s {
+	case StatusOpen, StatusInProgress, StatusResolved, StatusClosed:
+		return true
+	}
+	return false
+}
+
+func (p TicketPriority) Valid() bool {
+	switch p {
+	case PriorityLow, PriorityMedium, PriorityHigh, PriorityCritical:
+		return true
+	}
+	return false
+}
+
 type Ticket struct {
 	ID           int            `json:"id"`
 	Title        string         `json:"title"`
@@ -30,45 +54,152 @@ type Ticket struct {
 	AuthorName   string         `json:"author_name"`
 	AssignedTo   *int           `json:"assigned_to"`
 	AssigneeName *string        `json:"assignee_name"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
+	// OrganizationID is the author's organization when the ticket was filed.
+	OrganizationID *int `json:"organization_id"`
+	// Shared makes the ticket visible to the whole organization.
+	Shared    bool       `json:"shared"`
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// TicketPatch describes a partial ticket update. Nil fields are left
+// untouched; SetAssignee with a nil AssignedTo clears the assignee.
+type TicketPatch struct {
+	Title       *string
+	Description *string
+	Priority    *TicketPriority
+	Status      *TicketStatus
+	SetAssignee bool
+	AssignedTo  *int
+	Shared      *bool
+}
+
+func (p TicketPatch) Empty() bool {
+	return p.Title == nil && p.Description == nil && p.Priority == nil &&
+		p.Status == nil && !p.SetAssignee && p.Shared == nil
+}
+
+// Viewer restricts ticket queries to what a user without the
+// ticket.read.any permission may see: their own tickets, and their
+// organization's tickets when shared or when they manage the organization.
+type Viewer struct {
+	UserID         int
+	OrganizationID *int
+	OrgManager     bool
+}
+
+func (v *Viewer) CanSee(t *Ticket) bool {
+	if v == nil || t.AuthorID == v.UserID {
+		return true
+	}
+	return v.OrganizationID != nil && t.OrganizationID != nil &&
+		*v.OrganizationID == *t.OrganizationID && (t.Shared || v.OrgManager)
+}
+
+// TicketFilter selects tickets for List. A nil Viewer sees every ticket.
+type TicketFilter struct {
+	Viewer         *Viewer
+	OrganizationID *int
 }
 
 type TicketStore struct{ DB *sql.DB }
 
 func NewTicketStore(db *sql.DB) *TicketStore { return &TicketStore{DB: db} }
 
-func (s *TicketStore) Create(title, description string, priority TicketPriority, authorID int) (*Ticket, error) {
+// Create files a ticket in the author's organization. A nil shared uses the
+// organization's default.
+func (s *TicketStore) Create(ctx context.Context, title, description string, priority TicketPriority, authorID int, shared *bool) (*Ticket, error) {
+	ctx, end := begin(ctx, "TicketStore.Create")
+	defer end()
+
 	t := &Ticket{}
-	err := s.DB.QueryRow(
-		`INSERT INTO tickets (title, description, priority, author_id)
-		 VALUES ($1, $2, $3, $4)
-		 RETURNING id, title, description, status, priority, author_id, assigned_to, created_at, updated_at`,
-		title, description, priority, authorID,
+	err := s.DB.QueryRowContext(ctx,
+		`INSERT INTO tickets (title, description, priority, author_id, organization_id, shared)
+		 SELECT $1, $2, $3, u.id, u.organization_id, COALESCE($5, o.share_by_default, FALSE)
+		 FROM users u LEFT JOIN organizations o ON o.id = u.organization_id
+		 WHERE u.id = $4
+		 RETURNING id, title, description, status, priority, author_id, assigned_to,
+		           organization_id, shared, version, created_at, updated_at`,
+		title, description, priority, authorID, shared,
 	).Scan(&t.ID, &t.Title, &t.Description, &t.Status, &t.Priority,
-		&t.AuthorID, &t.AssignedTo, &t.CreatedAt, &t.UpdatedAt)
+		&t.AuthorID, &t.AssignedTo, &t.OrganizationID, &t.Shared, &t.Version, &t.CreatedAt, &t.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
-	s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, t.AuthorID).Scan(&t.AuthorName)
+	s.DB.QueryRowContext(ctx, `SELECT username FROM users WHERE id=$1`, t.AuthorID).Scan(&t.AuthorName)
 	return t, nil
 }
 
-func (s *TicketStore) GetByID(id int) (*Ticket, error) {
+func (s *TicketStore) GetByID(ctx context.Context, id int) (*Ticket, error) {
+	ctx, end := begin(ctx, "TicketStore.GetByID")
+	defer end()
+
+	t, err := scanTicket(s.DB.QueryRowContext(ctx, ticketSelect+` WHERE t.id=$1 AND t.deleted_at IS NULL`, id))
+	return t, notFound(err, "ticket")
+}
+
+func (s *TicketStore) List(ctx context.Context, f TicketFilter) ([]*Ticket, error) {
+	ctx, end := begin(ctx, "TicketStore.List")
+	defer end()
+
+	query := ticketSelect + ` WHERE t.deleted_at IS NULL`
+	var args []interface{}
+	if v := f.Viewer; v != nil {
+		args = append(args, v.UserID, v.OrganizationID, v.OrgManager)
+		query += ` AND (t.author_id=$1 OR (t.organization_id=$2 AND (t.shared OR $3)))`
+	}
+	if f.OrganizationID != nil {
+		args = append(args, *f.OrganizationID)
+		query += fmt.Sprintf(" AND t.organization_id=$%d", len(args))
+	}
+	query += " ORDER BY t.created_at DESC"
+	return s.query(ctx, query, args...)
+}
+
+func (s *TicketStore) ListDeleted(ctx context.Context) ([]*Ticket, error) {
+	ctx, end := begin(ctx, "TicketStore.ListDeleted")
+	defer end()
+
+	return s.query(ctx, ticketSelect+` WHERE t.deleted_at IS NOT NULL ORDER BY t.deleted_at DESC`)
+}
+
+func (s *TicketStore) query(ctx context.Context, query string, args ...interface{}) ([]*Ticket, error) {
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tickets []*Ticket
+	for rows.Next() {
+		t, err := scanTicket(rows)
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, t)
+	}
+	return tickets, rows.Err()
+}
+
+const ticketSelect = `SELECT t.id, t.title, t.description, t.status, t.priority,
+                             t.author_id, u.username, t.assigned_to,
+                             (SELECT username FROM users WHERE id=t.assigned_to),
+                             t.organization_id, t.shared, t.version, t.created_at, t.updated_at, t.deleted_at
+                      FROM tickets t
+                      JOIN users u ON u.id = t.author_id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTicket(row rowScanner) (*Ticket, error) {
 	t := &Ticket{}
 	var assigneeName sql.NullString
-	err := s.DB.QueryRow(
-		`SELECT t.id, t.title, t.description, t.status, t.priority,
-		        t.author_id, u.username, t.assigned_to,
-		        (SELECT username FROM users WHERE id=t.assigned_to),
-		        t.created_at, t.updated_at
-		 FROM tickets t
-		 JOIN users u ON u.id = t.author_id
-		 WHERE t.id=$1`,
-		id,
-	).Scan(&t.ID, &t.Title, &t.Description, &t.Status, &t.Priority,
+	err := row.Scan(&t.ID, &t.Title, &t.Description, &t.Status, &t.Priority,
 		&t.AuthorID, &t.AuthorName, &t.AssignedTo, &assigneeName,
-		&t.CreatedAt, &t.UpdatedAt)
+		&t.OrganizationID, &t.Shared, &t.Version, &t.CreatedAt, &t.UpdatedAt, &t.DeletedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -78,57 +209,114 @@ func (s *TicketStore) GetByID(id int) (*Ticket, error) {
 	return t, nil
 }
 
-func (s *TicketStore) List(authorID *int) ([]*Ticket, error) {
-	query := `SELECT t.id, t.title, t.description, t.status, t.priority,
-	                 t.author_id, u.username, t.assigned_to,
-	                 (SELECT username FROM users WHERE id=t.assigned_to),
-	                 t.created_at, t.updated_at
-	          FROM tickets t
-	          JOIN users u ON u.id = t.author_id`
-	args := []interface{}{}
-	if authorID != nil {
-		query += " WHERE t.author_id=$1"
-		args = append(args, *authorID)
-	}
-	query += " ORDER BY t.created_at DESC"
+// Patch applies p to the ticket in a single transaction, provided the ticket
+// is still at the given version.
+func (s *TicketStore) Patch(ctx context.Context, id, version int, p TicketPatch) error {
+	ctx, end := begin(ctx, "TicketStore.Patch")
+	defer end()
 
-	rows, err := s.DB.Query(query, args...)
+	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var tickets []*Ticket
-	for rows.Next() {
-		t := &Ticket{}
-		var assigneeName sql.NullString
-		if err := rows.Scan(&t.ID, &t.Title, &t.Description, &t.Status, &t.Priority,
-			&t.AuthorID, &t.AuthorName, &t.AssignedTo, &assigneeName,
-			&t.CreatedAt, &t.UpdatedAt); err != nil {
-			return nil, err
+	if p.SetAssignee && p.AssignedTo != nil {
+		var canWork bool
+		err := tx.QueryRowContext(ctx,
+			`SELECT $2 = ANY(r.permissions)
+			 FROM users u JOIN roles r ON r.name = u.role
+			 WHERE u.id=$1 AND u.deleted_at IS NULL
+			 FOR SHARE OF u`,
+			*p.AssignedTo, PermTicketUpdateAny,
+		).Scan(&canWork)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidAssignee
 		}
-		if assigneeName.Valid {
-			t.AssigneeName = &assigneeName.String
+		if err != nil {
+			return err
+		}
+		if !canWork {
+			return ErrInvalidAssignee
 		}
-		tickets = append(tickets, t)
 	}
-	return tickets, rows.Err()
+
+	var sets []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s=$%d", column, len(args)))
+	}
+	if p.Title != nil {
+		set("title", *p.Title)
+	}
+	if p.Description != nil {
+		set("description", *p.Description)
+	}
+	if p.Priority != nil {
+		set("priority", *p.Priority)
+	}
+	if p.Status != nil {
+		set("status", *p.Status)
+	}
+	if p.SetAssignee {
+		set("assigned_to", p.AssignedTo)
+	}
+	if p.Shared != nil {
+		set("shared", *p.Shared)
+	}
+	sets = append(sets, "version=version+1")
+	args = append(args, id, version)
+
+	res, err := tx.ExecContext(ctx,
+		fmt.Sprintf(`UPDATE tickets SET %s WHERE id=$%d AND version=$%d AND deleted_at IS NULL`,
+			strings.Join(sets, ", "), len(args)-1, len(args)),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	if err := checkVersioned(res); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *TicketStore) UpdateAssignee(id int, assigneeID *int) error {
-	_, err := s.DB.Exec(`UPDATE tickets SET assigned_to=$1 WHERE id=$2`, assigneeID, id)
-	return err
+func (s *TicketStore) Delete(ctx context.Context, id int) error {
+	ctx, end := begin(ctx, "TicketStore.Delete")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE tickets SET deleted_at=NOW() WHERE id=$1 AND deleted_at IS NULL`, id,
+	)
+	if err != nil {
+		return err
+	}
+	return notFound(checkAffected(res), "ticket")
 }
 
-func (s *TicketStore) Update(id int, title, description string, priority TicketPriority, status TicketStatus) error {
-	_, err := s.DB.Exec(
-		`UPDATE tickets SET title=$1, description=$2, priority=$3, status=$4 WHERE id=$5`,
-		title, description, priority, status, id,
+func (s *TicketStore) Restore(ctx context.Context, id int) error {
+	ctx, end := begin(ctx, "TicketStore.Restore")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE tickets SET deleted_at=NULL WHERE id=$1 AND deleted_at IS NOT NULL`, id,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	return notFound(checkAffected(res), "deleted ticket")
 }
 
-func (s *TicketStore) Delete(id int) error {
-	_, err := s.DB.Exec(`DELETE FROM tickets WHERE id=$1`, id)
-	return err
+// Purge permanently removes tickets, and with them their comments, that were
+// soft-deleted before cutoff.
+func (s *TicketStore) Purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, end := begin(ctx, "TicketStore.Purge")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM tickets WHERE deleted_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+// QueryTimeout bounds the time a single store call may spend in the
+// database. Zero disables it. It is meant to be set once at startup.
+var QueryTimeout = 10 * time.Second
+
+// tracer records a span for every store method. SQL statements get child
+// spans of their own from the instrumented driver.
+var tracer = otel.Tracer("helpdesk/server/models")
+
+// begin starts the span of a store method and applies QueryTimeout to the
+// context its queries run with. The returned function ends both.
+func begin(ctx context.Context, name string) (context.Context, func()) {
+	ctx, span := tracer.Start(ctx, name)
+	if QueryTimeout <= 0 {
+		return ctx, func() { span.End() }
+	}
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	return ctx, func() {
+		cancel()
+		span.End()
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"time"
 )
@@ -14,45 +15,112 @@ const (
 )
 
 type User struct {
-	ID           int       `json:"id"`
-	Username     string    `json:"username"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"`
-	Role         Role      `json:"role"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           int        `json:"id"`
+	Username     string     `json:"username"`
+	Email        string     `json:"email"`
+	PasswordHash string     `json:"-"`
+	Role         Role       `json:"role"`
+	Version      int        `json:"version"`
+	CreatedAt    time.Time  `json:"created_at"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+
+	DisplayName       *string           `json:"display_name"`
+	Timezone          string            `json:"timezone"`
+	Locale            string            `json:"locale"`
+	NotificationPrefs NotificationPrefs `json:"notification_prefs"`
+	PendingEmail      *string           `json:"pending_email,omitempty"`
+	EmailVerified     bool              `json:"email_verified"`
+	MFAEnabled        bool              `json:"mfa_enabled"`
+	OrganizationID    *int              `json:"organization_id"`
+	OrgManager        bool              `json:"org_manager"`
+	SessionVersion    int               `json:"-"`
+	TenantID          int               `json:"-"`
 }
 
 type UserStore struct{ DB *sql.DB }
 
 func NewUserStore(db *sql.DB) *UserStore { return &UserStore{DB: db} }
 
-func (s *UserStore) Create(username, email, passwordHash string, role Role) (*User, error) {
-	u := &User{}
-	err := s.DB.QueryRow(
+func (s *UserStore) Create(ctx context.Context, username, email, passwordHash string, role Role) (*User, error) {
+	ctx, end := begin(ctx, "UserStore.Create")
+	defer end()
+
+	u, err := scanUser(s.DB.QueryRowContext(ctx,
 		`INSERT INTO users (username, email, password_hash, role)
 		 VALUES ($1, $2, $3, $4)
-		 RETURNING id, username, email, role, created_at`,
+		 RETURNING `+userColumns,
 		username, email, passwordHash, role,
-	).Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.CreatedAt)
-	return u, err
+	))
+	return u, userConflict(err)
 }
 
-func (s *UserStore) GetByEmail(email string) (*User, error) {
-	u := &User{}
-	err := s.DB.QueryRow(
-		`SELECT id, username, email, password_hash, role, created_at FROM users WHERE email=$1`,
-		email,
-	).Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash, &u.Role, &u.CreatedAt)
+// CreateExternal provisions a user that signs in through an external
+// identity provider. It has no usable local password, and its email counts
+// as verified since the provider vouches for it.
+func (s *UserStore) CreateExternal(ctx context.Context, username, email, subject string, role Role) (*User, error) {
+	ctx, end := begin(ctx, "UserStore.CreateExternal")
+	defer end()
+
+	u, err := scanUser(s.DB.QueryRowContext(ctx,
+		`INSERT INTO users (username, email, password_hash, role, external_subject, email_verified)
+		 VALUES ($1, $2, '', $3, $4, TRUE)
+		 RETURNING `+userColumns,
+		username, email, role, subject,
+	))
+	return u, userConflict(err)
+}
+
+func (s *UserStore) GetByExternalSubject(ctx context.Context, subject string) (*User, error) {
+	ctx, end := begin(ctx, "UserStore.GetByExternalSubject")
+	defer end()
+
+	return scanUser(s.DB.QueryRowContext(ctx, userSelect+` WHERE external_subject=$1 AND deleted_at IS NULL`, subject))
+}
+
+func (s *UserStore) LinkExternalSubject(ctx context.Context, id int, subject string) error {
+	ctx, end := begin(ctx, "UserStore.LinkExternalSubject")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET external_subject=$1, email_verified=TRUE WHERE id=$2 AND deleted_at IS NULL`, subject, id,
+	)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return u, nil
+	return checkAffected(res)
 }
 
-func (s *UserStore) List() ([]*User, error) {
-	rows, err := s.DB.Query(
-		`SELECT id, username, email, role, created_at FROM users ORDER BY id`,
-	)
+func (s *UserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, end := begin(ctx, "UserStore.GetByEmail")
+	defer end()
+
+	return scanUser(s.DB.QueryRowContext(ctx, userSelect+` WHERE email=$1 AND deleted_at IS NULL`, email))
+}
+
+func (s *UserStore) GetByID(ctx context.Context, id int) (*User, error) {
+	ctx, end := begin(ctx, "UserStore.GetByID")
+	defer end()
+
+	u, err := scanUser(s.DB.QueryRowContext(ctx, userSelect+` WHERE id=$1 AND deleted_at IS NULL`, id))
+	return u, notFound(err, "user")
+}
+
+func (s *UserStore) List(ctx context.Context) ([]*User, error) {
+	ctx, end := begin(ctx, "UserStore.List")
+	defer end()
+
+	return s.query(ctx, userSelect+` WHERE deleted_at IS NULL ORDER BY id`)
+}
+
+func (s *UserStore) ListDeleted(ctx context.Context) ([]*User, error) {
+	ctx, end := begin(ctx, "UserStore.ListDeleted")
+	defer end()
+
+	return s.query(ctx, userSelect+` WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC`)
+}
+
+func (s *UserStore) query(ctx context.Context, query string, args ...interface{}) ([]*User, error) {
+	rows, err := s.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -60,8 +128,8 @@ func (s *UserStore) List() ([]*User, error) {
 
 	var users []*User
 	for rows.Next() {
-		u := &User{}
-		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.CreatedAt); err != nil {
+		u, err := scanUser(rows)
+		if err != nil {
 			return nil, err
 		}
 		users = append(users, u)
@@ -69,12 +137,84 @@ func (s *UserStore) List() ([]*User, error) {
 	return users, rows.Err()
 }
 
-func (s *UserStore) UpdateRole(id int, role Role) error {
-	_, err := s.DB.Exec(`UPDATE users SET role=$1 WHERE id=$2`, role, id)
-	return err
+const userColumns = `id, username, email, password_hash, role, version, created_at, deleted_at,
+                     display_name, timezone, locale, notification_prefs, pending_email,
+                     email_verified, session_version, totp_enabled, organization_id, org_manager, tenant_id`
+
+const userSelect = `SELECT ` + userColumns + ` FROM users`
+
+func scanUser(row rowScanner) (*User, error) {
+	u := &User{}
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash, &u.Role, &u.Version,
+		&u.CreatedAt, &u.DeletedAt, &u.DisplayName, &u.Timezone, &u.Locale,
+		&u.NotificationPrefs, &u.PendingEmail, &u.EmailVerified, &u.SessionVersion, &u.MFAEnabled,
+		&u.OrganizationID, &u.OrgManager, &u.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *UserStore) UpdateRole(ctx context.Context, id, version int, role Role) error {
+	ctx, end := begin(ctx, "UserStore.UpdateRole")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET role=$1, version=version+1
+		 WHERE id=$2 AND version=$3 AND deleted_at IS NULL`,
+		role, id, version,
+	)
+	if isForeignKeyViolation(err) {
+		return ErrUnknownRole
+	}
+	if err != nil {
+		return err
+	}
+	return checkVersioned(res)
+}
+
+// Delete deactivates the user. Their tickets and comments stay attributed.
+func (s *UserStore) Delete(ctx context.Context, id int) error {
+	ctx, end := begin(ctx, "UserStore.Delete")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET deleted_at=NOW() WHERE id=$1 AND deleted_at IS NULL`, id,
+	)
+	if err != nil {
+		return err
+	}
+	return notFound(checkAffected(res), "user")
+}
+
+func (s *UserStore) Restore(ctx context.Context, id int) error {
+	ctx, end := begin(ctx, "UserStore.Restore")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET deleted_at=NULL WHERE id=$1 AND deleted_at IS NOT NULL`, id,
+	)
+	if err != nil {
+		return err
+	}
+	return notFound(checkAffected(res), "deleted user")
 }
 
-func (s *UserStore) Delete(id int) error {
-	_, err := s.DB.Exec(`DELETE FROM users WHERE id=$1`, id)
-	return err
+// Purge permanently removes users deactivated before cutoff who no longer
+// author any tickets or comments.
+func (s *UserStore) Purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, end := begin(ctx, "UserStore.Purge")
+	defer end()
+
+	res, err := s.DB.ExecContext(ctx,
+		`DELETE FROM users u
+		 WHERE u.deleted_at < $1
+		   AND NOT EXISTS (SELECT 1 FROM tickets WHERE author_id=u.id)
+		   AND NOT EXISTS (SELECT 1 FROM comments WHERE user_id=u.id)`,
+		cutoff,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
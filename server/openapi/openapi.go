@@ -0,0 +1,474 @@
+// Package openapi describes the HTTP API as an OpenAPI 3.1 document and
+// serves it together with Swagger UI. Response schemas are generated from
+// the model types, so the document follows their JSON encoding.
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"helpdesk/server/jwtkeys"
+	"helpdesk/server/models"
+	"helpdesk/server/problem"
+)
+
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Servers    []Server            `json:"servers"`
+	Tags       []Tag               `json:"tags"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+type Tag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem maps lower-case HTTP methods to their operations.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	Tags        []string              `json:"tags"`
+	Summary     string                `json:"summary"`
+	OperationID string                `json:"operationId"`
+	Parameters  []*Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security"`
+}
+
+type Parameter struct {
+	Ref         string `json:"$ref,omitempty"`
+	Name        string `json:"name,omitempty"`
+	In          string `json:"in,omitempty"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	Schema      Schema `json:"schema,omitempty"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Ref         string               `json:"$ref,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Headers     map[string]Header    `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Header struct {
+	Description string `json:"description,omitempty"`
+	Schema      Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas         map[string]Schema         `json:"schemas"`
+	Responses       map[string]*Response      `json:"responses"`
+	Parameters      map[string]*Parameter     `json:"parameters"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// Schema is a JSON Schema 2020-12 object.
+type Schema map[string]any
+
+func ref(name string) Schema { return Schema{"$ref": "#/components/schemas/" + name} }
+
+func arrayOf(items Schema) Schema { return Schema{"type": "array", "items": items} }
+
+// namedTypes lists the types that get a schema of their own. Fields of these
+// types refer to that schema instead of repeating it.
+var namedTypes = []struct {
+	name string
+	v    any
+}{
+	{"Ticket", models.Ticket{}},
+	{"User", models.User{}},
+	{"Comment", models.Comment{}},
+	{"APIKey", models.APIKey{}},
+	{"Organization", models.Organization{}},
+	{"Role", models.RoleDefinition{}},
+	{"AuditEntry", models.AuditEntry{}},
+	{"LoginLock", models.LoginAttempt{}},
+	{"Permission", models.Permission{}},
+	{"JWKS", jwtkeys.JWKS{}},
+	{"Problem", problem.Details{}},
+}
+
+// enums lists the values of the string types that only take a fixed set.
+var enums = map[reflect.Type][]string{
+	reflect.TypeOf(models.TicketStatus("")): {
+		string(models.StatusOpen), string(models.StatusInProgress),
+		string(models.StatusResolved), string(models.StatusClosed),
+	},
+	reflect.TypeOf(models.TicketPriority("")): {
+		string(models.PriorityLow), string(models.PriorityMedium),
+		string(models.PriorityHigh), string(models.PriorityCritical),
+	},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// generator derives schemas from Go types the way encoding/json encodes them.
+type generator struct {
+	names map[reflect.Type]string
+}
+
+func (g *generator) schema(t reflect.Type) Schema {
+	if name, ok := g.names[t]; ok {
+		return ref(name)
+	}
+	switch {
+	case t == timeType:
+		return Schema{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		s := g.schema(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return Schema{"oneOf": []Schema{s, {"type": "null"}}}
+		}
+		s["type"] = []any{s["type"], "null"}
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		s := Schema{"type": "string"}
+		if values, ok := enums[t]; ok {
+			s["enum"] = values
+		}
+		return s
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return arrayOf(g.schema(t.Elem()))
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.object(t)
+	}
+	return Schema{}
+}
+
+func (g *generator) object(t reflect.Type) Schema {
+	props := Schema{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	s := Schema{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+var (
+	specOnce sync.Once
+	spec     *Document
+)
+
+// Spec returns the document. It is built on first use and must not be
+// modified.
+func Spec() *Document {
+	specOnce.Do(func() { spec = build() })
+	return spec
+}
+
+func build() *Document {
+	g := &generator{names: map[reflect.Type]string{}}
+	for _, m := range namedTypes {
+		g.names[reflect.TypeOf(m.v)] = m.name
+	}
+	schemas := map[string]Schema{}
+	for _, m := range namedTypes {
+		schemas[m.name] = g.object(reflect.TypeOf(m.v))
+	}
+	schemas["Problem"]["properties"].(Schema)["code"] = Schema{
+		"type":        "string",
+		"description": "Stable identifier of the error. The responses list the codes each status can carry.",
+	}
+	for name, s := range requestSchemas {
+		schemas[name] = s
+	}
+	for name, s := range responseSchemas {
+		schemas[name] = s
+	}
+
+	doc := &Document{
+		OpenAPI: "3.1.0",
+		Info: Info{
+			Title:   "Helpdesk API",
+			Version: "1.0.0",
+			Description: "The tenant is chosen by the subdomain of the request or, where configured, " +
+				"by the tenant header; requests without either go to the default tenant. " +
+				"Errors are reported as RFC 7807 problem details.",
+		},
+		Servers: []Server{{URL: "/"}},
+		Tags:    tags,
+		Paths:   map[string]PathItem{},
+		Components: Components{
+			Schemas:         schemas,
+			Responses:       errorResponses(),
+			Parameters:      parameters,
+			SecuritySchemes: securitySchemes,
+		},
+	}
+	for _, rt := range routes {
+		method, path, ok := strings.Cut(rt.pattern, " ")
+		if !ok {
+			panic("openapi: route without method: " + rt.pattern)
+		}
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = PathItem{}
+		}
+		doc.Paths[path][strings.ToLower(method)] = rt.operation(method, path)
+	}
+	return doc
+}
+
+// Patterns returns the routes the document describes, in the form they are
+// registered with http.ServeMux.
+func Patterns() []string {
+	patterns := make([]string, len(routes))
+	for i, rt := range routes {
+		patterns[i] = rt.pattern
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+var pathParam = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+func (rt *route) operation(method, path string) *Operation {
+	op := &Operation{
+		Tags:        []string{rt.tag},
+		Summary:     rt.summary,
+		OperationID: rt.id,
+		Responses:   map[string]*Response{},
+		Security:    rt.access.security(),
+	}
+	for _, m := range pathParam.FindAllStringSubmatch(path, -1) {
+		op.Parameters = append(op.Parameters, &Parameter{Ref: "#/components/parameters/" + m[1]})
+	}
+	op.Parameters = append(op.Parameters, rt.query...)
+	if rt.conditional {
+		op.Parameters = append(op.Parameters, &Parameter{Ref: "#/components/parameters/If-Match"})
+	}
+
+	if rt.body != nil {
+		contentType := "application/json"
+		if method == http.MethodPatch {
+			contentType = "application/merge-patch+json"
+		}
+		op.RequestBody = &RequestBody{Required: true, Content: map[string]MediaType{contentType: {Schema: rt.body}}}
+	}
+
+	status := rt.status
+	if status == 0 {
+		status = http.StatusOK
+		if rt.result == nil {
+			status = http.StatusNoContent
+		}
+	}
+	success := &Response{Description: http.StatusText(status)}
+	if status == http.StatusFound {
+		success.Description = "Redirect to the identity provider or back to the app"
+		success.Headers = map[string]Header{"Location": {Schema: Schema{"type": "string", "format": "uri"}}}
+	}
+	if rt.result != nil {
+		mediaType := rt.mediaType
+		if mediaType == "" {
+			mediaType = "application/json"
+		}
+		success.Content = map[string]MediaType{mediaType: {Schema: rt.result}}
+	}
+	if rt.versioned {
+		success.Headers = map[string]Header{"ETag": etagHeader}
+	}
+	op.Responses[strconv.Itoa(status)] = success
+
+	for _, code := range rt.errors() {
+		op.Responses[strconv.Itoa(code)] = &Response{Ref: "#/components/responses/" + strconv.Itoa(code)}
+	}
+	if rt.conditional {
+		current := rt.current
+		if current == nil {
+			current = rt.result
+		}
+		op.Responses["412"] = &Response{
+			Description: "The If-Match header does not match; the body is the current version",
+			Headers:     map[string]Header{"ETag": etagHeader},
+			Content:     map[string]MediaType{"application/json": {Schema: current}},
+		}
+	}
+	return op
+}
+
+// errors lists the error statuses a route can answer with, following from
+// how it is authenticated, what it takes and what it addresses.
+func (rt *route) errors() []int {
+	codes := map[int]bool{}
+	if rt.access != open {
+		codes[http.StatusTooManyRequests] = true
+		codes[http.StatusGatewayTimeout] = true
+	}
+	if rt.access > public {
+		codes[http.StatusUnauthorized] = true
+		codes[http.StatusForbidden] = true
+	}
+	if rt.body != nil {
+		codes[http.StatusBadRequest] = true
+		codes[http.StatusRequestEntityTooLarge] = true
+		codes[http.StatusUnprocessableEntity] = true
+	}
+	if len(rt.query) > 0 {
+		codes[http.StatusBadRequest] = true
+	}
+	if strings.Contains(rt.pattern, "{") {
+		codes[http.StatusBadRequest] = true
+		codes[http.StatusNotFound] = true
+	}
+	if rt.conditional {
+		codes[http.StatusPreconditionRequired] = true
+	}
+	for _, c := range rt.extra {
+		codes[c] = true
+	}
+	list := make([]int, 0, len(codes))
+	for c := range codes {
+		list = append(list, c)
+	}
+	sort.Ints(list)
+	return append(list, 500)
+}
+
+var etagHeader = Header{Description: "Version of the resource, for If-Match", Schema: Schema{"type": "string"}}
+
+// errorCodes lists the problem codes that can come with each status.
+var errorCodes = map[int][]string{
+	http.StatusBadRequest: {"invalid_request", "invalid_token", "invalid_assignee",
+		"unknown_organization", "unknown_role"},
+	http.StatusUnauthorized: {"unauthenticated", "invalid_api_key"},
+	http.StatusForbidden: {"forbidden", "insufficient_scope", "session_required",
+		"impersonation_read_only"},
+	http.StatusNotFound: {"not_found", "unknown_tenant"},
+	http.StatusConflict: {"conflict", "version_conflict", "email_taken", "username_taken",
+		"mfa_enabled", "mfa_not_enrolled", "organization_name_taken", "domain_taken",
+		"builtin_role", "role_in_use", "role_exists"},
+	http.StatusRequestEntityTooLarge: {"body_too_large"},
+	http.StatusUnprocessableEntity:   {"validation_failed"},
+	http.StatusPreconditionRequired:  {"if_match_required"},
+	http.StatusTooManyRequests:       {"rate_limited", "login_throttled", "mfa_throttled"},
+	http.StatusInternalServerError:   {"internal_error"},
+	http.StatusServiceUnavailable:    {"authentication_unavailable"},
+	http.StatusGatewayTimeout:        {"timeout"},
+}
+
+func errorResponses() map[string]*Response {
+	responses := map[string]*Response{}
+	for status, codes := range errorCodes {
+		resp := &Response{
+			Description: fmt.Sprintf("%s; code is one of %s", http.StatusText(status), strings.Join(codes, ", ")),
+			Content:     map[string]MediaType{"application/problem+json": {Schema: ref("Problem")}},
+		}
+		if status == http.StatusTooManyRequests {
+			resp.Headers = map[string]Header{
+				"Retry-After": {Description: "Seconds until the next request is allowed", Schema: Schema{"type": "integer"}},
+			}
+		}
+		responses[strconv.Itoa(status)] = resp
+	}
+	return responses
+}
+
+var parameters = map[string]*Parameter{
+	"id":       {Name: "id", In: "path", Required: true, Schema: Schema{"type": "integer"}},
+	"name":     {Name: "name", In: "path", Required: true, Schema: Schema{"type": "string"}},
+	"If-Match": {Name: "If-Match", In: "header", Description: "ETag of the version the change applies to; required if the server enforces conditional writes", Schema: Schema{"type": "string"}},
+}
+
+var securitySchemes = map[string]SecurityScheme{
+	"bearer": {
+		Type: "http", Scheme: "bearer", BearerFormat: "JWT",
+		Description: "Session token from login, or the MFA token where a route says so",
+	},
+	"apiKey": {
+		Type: "apiKey", In: "header", Name: "X-API-Key",
+		Description: "Personal API key, limited to its scopes",
+	},
+}
+
+// access is how a route authenticates its caller.
+type access int
+
+const (
+	// open routes are neither authenticated nor rate limited.
+	open access = iota
+	// public routes are limited per client address.
+	public
+	// token accepts session tokens and API keys.
+	token
+	// session accepts session tokens only.
+	session
+	// enrollment also accepts the token issued to users who must set up MFA.
+	enrollment
+)
+
+func (a access) security() []map[string][]string {
+	switch a {
+	case token:
+		return []map[string][]string{{"bearer": {}}, {"apiKey": {}}}
+	case session, enrollment:
+		return []map[string][]string{{"bearer": {}}}
+	}
+	return []map[string][]string{}
+}
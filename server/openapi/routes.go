@@ -0,0 +1,367 @@
+package openapi
+
+import (
+	"net/http"
+	"reflect"
+
+	"helpdesk/server/models"
+	"helpdesk/server/validate"
+)
+
+// route describes one pattern registered with http.ServeMux.
+type route struct {
+	pattern string
+	id      string
+	tag     string
+	summary string
+	access  access
+	query   []*Parameter
+	body    Schema
+	// status is the success status, 200 or, without a result, 204 if unset.
+	status int
+	result Schema
+	// mediaType is the type of result, application/json if unset.
+	mediaType string
+	// versioned responses carry an ETag; conditional writes take If-Match
+	// and answer 412 with current, or result if unset.
+	current     Schema
+	versioned   bool
+	conditional bool
+	extra       []int
+}
+
+var tags = []Tag{
+	{Name: "auth", Description: "Registration, login and password reset"},
+	{Name: "me", Description: "The caller's profile, credentials and API keys"},
+	{Name: "tickets"},
+	{Name: "comments"},
+	{Name: "users", Description: "User administration"},
+	{Name: "admin", Description: "Organizations, roles, security policies, audit log and trash"},
+	{Name: "meta", Description: "Probes, signing keys and this document"},
+}
+
+func query(name, description string, schema Schema) *Parameter {
+	return &Parameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+var routes = []*route{
+	{pattern: "GET /healthz", id: "live", tag: "meta", summary: "Liveness probe", access: open, result: ref("Health")},
+	{pattern: "GET /readyz", id: "ready", tag: "meta", summary: "Readiness probe; 503 while the database is unreachable or the server drains",
+		access: open, result: ref("Health"), extra: []int{http.StatusServiceUnavailable}},
+	{pattern: "GET /api/openapi.json", id: "getOpenAPI", tag: "meta", summary: "This document", access: open,
+		result: Schema{"type": "object"}},
+	{pattern: "GET /api/docs/", id: "getDocs", tag: "meta", summary: "Swagger UI for this document", access: open,
+		result: Schema{"type": "string"}, mediaType: "text/html"},
+	{pattern: "GET /.well-known/jwks.json", id: "getJWKS", tag: "meta", summary: "Public keys that verify issued tokens",
+		access: open, result: ref("JWKS")},
+
+	{pattern: "POST /api/auth/register", id: "register", tag: "auth", summary: "Create an account with the user role, log in and mail a link that confirms the email",
+		access: public, body: ref("Registration"), status: http.StatusCreated, result: ref("LoginResult"),
+		extra: []int{http.StatusConflict}},
+	{pattern: "POST /api/auth/login", id: "login", tag: "auth",
+		summary: "Log in with email and password; answers with an MFA token when a second factor is due",
+		access:  public, body: ref("Login"), result: ref("LoginResult"), extra: []int{http.StatusServiceUnavailable}},
+	{pattern: "POST /api/auth/mfa", id: "verifyMFA", tag: "auth", summary: "Exchange an MFA token and a TOTP or recovery code for a session token",
+		access: public, body: ref("MFAVerification"), result: ref("Session")},
+	{pattern: "GET /api/auth/oidc/login", id: "oidcLogin", tag: "auth", summary: "Start single sign-on, if configured",
+		access: public, status: http.StatusFound},
+	{pattern: "GET /api/auth/oidc/callback", id: "oidcCallback", tag: "auth",
+		summary: "Complete single sign-on and redirect to the app with a session token, or an MFA token when a second factor is due", access: public,
+		query: []*Parameter{
+			query("state", "State issued by the login route; must match the oidc_state cookie it set", Schema{"type": "string"}),
+			query("code", "Authorization code", Schema{"type": "string"}),
+			query("error", "Error reported by the identity provider", Schema{"type": "string"}),
+		},
+		status: http.StatusFound},
+	{pattern: "POST /api/auth/password-reset", id: "requestPasswordReset", tag: "auth",
+		summary: "Mail a password reset link; accepted whether or not the account exists",
+		access:  public, body: ref("PasswordResetRequest"), status: http.StatusAccepted},
+	{pattern: "POST /api/auth/password-reset/confirm", id: "confirmPasswordReset", tag: "auth", summary: "Set a new password with a reset token",
+		access: public, body: ref("PasswordResetConfirmation")},
+
+	{pattern: "GET /api/me", id: "getMe", tag: "me", summary: "The caller's profile", access: token,
+		result: ref("User"), versioned: true},
+	{pattern: "PATCH /api/me", id: "updateMe", tag: "me", summary: "Update the profile; a new email takes effect once confirmed, the unverified current one gets a new link",
+		access: session, body: ref("ProfilePatch"), result: ref("User"), versioned: true},
+	{pattern: "POST /api/me/email/confirm", id: "confirmEmail", tag: "me", summary: "Confirm the pending email address",
+		access: session, body: ref("Token"), result: ref("User"), versioned: true, extra: []int{http.StatusConflict}},
+	{pattern: "POST /api/me/password", id: "changePassword", tag: "me", summary: "Change the password and revoke other sessions and all API keys",
+		access: session, body: ref("PasswordChange"), result: ref("Session")},
+	{pattern: "POST /api/me/mfa/totp", id: "enrollTOTP", tag: "me", summary: "Start TOTP enrollment",
+		access: enrollment, result: ref("TOTPEnrollment"), extra: []int{http.StatusConflict}},
+	{pattern: "POST /api/me/mfa/totp/verify", id: "verifyTOTP", tag: "me", summary: "Enable TOTP with a first code",
+		access: enrollment, body: ref("Code"), result: ref("TOTPActivation"), extra: []int{http.StatusConflict}},
+	{pattern: "DELETE /api/me/mfa/totp", id: "disableTOTP", tag: "me", summary: "Disable TOTP",
+		access: session, body: ref("MFADisable")},
+	{pattern: "POST /api/me/mfa/recovery-codes", id: "regenerateRecoveryCodes", tag: "me", summary: "Replace all recovery codes",
+		access: session, body: ref("Code"), result: ref("RecoveryCodes")},
+	{pattern: "POST /api/me/api-keys", id: "createAPIKey", tag: "me", summary: "Issue an API key; the key is only shown in this response",
+		access: session, body: ref("APIKeyCreation"), status: http.StatusCreated, result: ref("APIKeyWithSecret")},
+	{pattern: "GET /api/me/api-keys", id: "listAPIKeys", tag: "me", summary: "The caller's API keys",
+		access: session, result: arrayOf(ref("APIKey"))},
+	{pattern: "DELETE /api/me/api-keys/{id}", id: "revokeAPIKey", tag: "me", summary: "Revoke an API key", access: session},
+
+	{pattern: "GET /api/users", id: "listUsers", tag: "users", summary: "All users", access: token, result: arrayOf(ref("User"))},
+	{pattern: "GET /api/users/{id}", id: "getUser", tag: "users", summary: "A user", access: token,
+		result: ref("User"), versioned: true},
+	{pattern: "PUT /api/users/{id}/role", id: "updateUserRole", tag: "users", summary: "Change a user's role; the caller must hold every permission of the old and the new role", access: token,
+		body: ref("RoleAssignment"), result: ref("Status"), current: ref("User"), conditional: true, versioned: true},
+	{pattern: "DELETE /api/users/{id}", id: "deleteUser", tag: "users", summary: "Move a user to the trash", access: token},
+
+	{pattern: "POST /api/tickets", id: "createTicket", tag: "tickets", summary: "File a ticket", access: token,
+		body: ref("TicketCreation"), status: http.StatusCreated, result: ref("Ticket")},
+	{pattern: "GET /api/tickets", id: "listTickets", tag: "tickets", summary: "The tickets visible to the caller", access: token,
+		query:  []*Parameter{query("organization_id", "Only tickets of this organization", Schema{"type": "integer"})},
+		result: arrayOf(ref("Ticket"))},
+	{pattern: "GET /api/tickets/{id}", id: "getTicket", tag: "tickets", summary: "A ticket", access: token,
+		result: ref("Ticket"), versioned: true},
+	{pattern: "PUT /api/tickets/{id}", id: "updateTicket", tag: "tickets", summary: "Update a ticket; empty fields are left unchanged",
+		access: token, body: ref("TicketUpdate"), result: ref("Ticket"), versioned: true, conditional: true},
+	{pattern: "PATCH /api/tickets/{id}", id: "patchTicket", tag: "tickets", summary: "Apply a JSON Merge Patch to a ticket",
+		access: token, body: ref("TicketPatch"), result: ref("Ticket"), versioned: true, conditional: true},
+	{pattern: "DELETE /api/tickets/{id}", id: "deleteTicket", tag: "tickets", summary: "Move a ticket to the trash", access: token},
+
+	{pattern: "POST /api/tickets/{id}/comments", id: "createComment", tag: "comments", summary: "Comment on a ticket", access: token,
+		body: ref("CommentContent"), status: http.StatusCreated, result: ref("Comment")},
+	{pattern: "GET /api/tickets/{id}/comments", id: "listComments", tag: "comments", summary: "The comments of a ticket", access: token,
+		result: arrayOf(ref("Comment"))},
+	{pattern: "PUT /api/comments/{id}", id: "updateComment", tag: "comments", summary: "Edit a comment", access: token,
+		body: ref("CommentContent"), result: ref("Comment"), versioned: true, conditional: true},
+	{pattern: "DELETE /api/comments/{id}", id: "deleteComment", tag: "comments", summary: "Move a comment to the trash", access: token},
+
+	{pattern: "GET /api/admin/deleted/users", id: "listDeletedUsers", tag: "admin", summary: "Users in the trash", access: token,
+		result: arrayOf(ref("User"))},
+	{pattern: "POST /api/admin/deleted/users/{id}/restore", id: "restoreUser", tag: "admin", summary: "Restore a user", access: token},
+	{pattern: "GET /api/admin/deleted/tickets", id: "listDeletedTickets", tag: "admin", summary: "Tickets in the trash", access: token,
+		result: arrayOf(ref("Ticket"))},
+	{pattern: "POST /api/admin/deleted/tickets/{id}/restore", id: "restoreTicket", tag: "admin", summary: "Restore a ticket", access: token},
+	{pattern: "GET /api/admin/deleted/comments", id: "listDeletedComments", tag: "admin", summary: "Comments in the trash", access: token,
+		result: arrayOf(ref("Comment"))},
+	{pattern: "POST /api/admin/deleted/comments/{id}/restore", id: "restoreComment", tag: "admin", summary: "Restore a comment", access: token},
+
+	{pattern: "GET /api/admin/mfa-policy", id: "getMFAPolicy", tag: "admin", summary: "The roles that must use MFA", access: token,
+		result: ref("MFAPolicy")},
+	{pattern: "PUT /api/admin/mfa-policy", id: "updateMFAPolicy", tag: "admin", summary: "Set the roles that must use MFA", access: token,
+		body: ref("MFAPolicy"), result: ref("MFAPolicy")},
+	{pattern: "GET /api/admin/login-locks", id: "listLoginLocks", tag: "admin", summary: "Accounts and addresses locked out after failed logins",
+		access: token, result: arrayOf(ref("LoginLock"))},
+	{pattern: "POST /api/admin/users/{id}/unlock", id: "unlockUser", tag: "admin", summary: "Clear a user's failed logins and lockout", access: token},
+	{pattern: "GET /api/admin/audit-log", id: "listAuditLog", tag: "admin", summary: "Recent audit log entries, newest first", access: token,
+		query: []*Parameter{
+			query("action", "Only entries with this action", Schema{"type": "string"}),
+			query("limit", "Number of entries", Schema{"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}),
+		},
+		result: arrayOf(ref("AuditEntry"))},
+
+	{pattern: "GET /api/admin/organizations", id: "listOrganizations", tag: "admin", summary: "All organizations", access: token,
+		result: arrayOf(ref("Organization"))},
+	{pattern: "POST /api/admin/organizations", id: "createOrganization", tag: "admin", summary: "Create an organization", access: token,
+		body: ref("OrganizationInput"), status: http.StatusCreated, result: ref("Organization"), extra: []int{http.StatusConflict}},
+	{pattern: "GET /api/admin/organizations/{id}", id: "getOrganization", tag: "admin", summary: "An organization", access: token,
+		result: ref("Organization")},
+	{pattern: "PUT /api/admin/organizations/{id}", id: "updateOrganization", tag: "admin", summary: "Update an organization", access: token,
+		body: ref("OrganizationInput"), result: ref("Organization"), extra: []int{http.StatusConflict}},
+	{pattern: "DELETE /api/admin/organizations/{id}", id: "deleteOrganization", tag: "admin", summary: "Delete an organization", access: token},
+	{pattern: "PUT /api/admin/users/{id}/organization", id: "setMembership", tag: "admin",
+		summary: "Put a user into an organization, or remove them with a null organization_id", access: token, body: ref("Membership")},
+
+	{pattern: "POST /api/admin/impersonate/{id}", id: "impersonate", tag: "admin", summary: "Get a read-only token that acts as another user",
+		access: session, result: ref("Impersonation")},
+
+	{pattern: "GET /api/admin/permissions", id: "listPermissions", tag: "admin", summary: "The permissions roles can grant", access: token,
+		result: arrayOf(ref("Permission"))},
+	{pattern: "GET /api/admin/roles", id: "listRoles", tag: "admin", summary: "All roles", access: token, result: arrayOf(ref("Role"))},
+	{pattern: "POST /api/admin/roles", id: "createRole", tag: "admin", summary: "Create a role", access: token,
+		body: ref("RoleCreation"), status: http.StatusCreated, result: ref("Role"), extra: []int{http.StatusConflict}},
+	{pattern: "GET /api/admin/roles/{name}", id: "getRole", tag: "admin", summary: "A role", access: token, result: ref("Role")},
+	{pattern: "PUT /api/admin/roles/{name}", id: "updateRole", tag: "admin", summary: "Change a custom role", access: token,
+		body: ref("RoleInput"), result: ref("Role"), extra: []int{http.StatusConflict}},
+	{pattern: "DELETE /api/admin/roles/{name}", id: "deleteRole", tag: "admin", summary: "Delete a custom role that nobody has",
+		access: token, extra: []int{http.StatusConflict}},
+}
+
+// object returns a schema for a request body that rejects unknown members.
+func object(required []string, props Schema) Schema {
+	s := Schema{"type": "object", "properties": props, "additionalProperties": false}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func str(minLength, maxLength int) Schema {
+	s := Schema{"type": "string", "minLength": minLength}
+	if maxLength > 0 {
+		s["maxLength"] = maxLength
+	}
+	return s
+}
+
+func nullable(s Schema) Schema {
+	s["type"] = []any{s["type"], "null"}
+	return s
+}
+
+var (
+	emailSchema    = Schema{"type": "string", "format": "email", "maxLength": 128}
+	passwordSchema = Schema{
+		"type": "string", "minLength": validate.PasswordMinLength, "maxLength": validate.PasswordMaxBytes,
+		"description": "At least one letter and one digit or symbol; at most 72 bytes",
+	}
+	prioritySchema = Schema{"type": "string", "enum": enums[reflect.TypeOf(models.PriorityLow)]}
+	statusSchema   = Schema{"type": "string", "enum": enums[reflect.TypeOf(models.StatusOpen)]}
+)
+
+// requestSchemas mirror the validation rules of the request bodies.
+var requestSchemas = map[string]Schema{
+	"Registration": object([]string{"username", "email", "password"}, Schema{
+		"username": str(1, 64),
+		"email":    emailSchema,
+		"password": passwordSchema,
+	}),
+	"Login": object([]string{"email", "password"}, Schema{
+		"email":    str(1, 0),
+		"password": str(1, 0),
+	}),
+	"MFAVerification": object([]string{"mfa_token"}, Schema{
+		"mfa_token":     str(1, 0),
+		"code":          Schema{"type": "string", "description": "TOTP code"},
+		"recovery_code": Schema{"type": "string", "description": "Unused recovery code, instead of code"},
+	}),
+	"PasswordResetRequest": object([]string{"email"}, Schema{"email": emailSchema}),
+	"PasswordResetConfirmation": object([]string{"token", "new_password"}, Schema{
+		"token":        str(1, 0),
+		"new_password": passwordSchema,
+	}),
+	"ProfilePatch": object(nil, Schema{
+		"display_name":       nullable(str(0, 128)),
+		"email":              emailSchema,
+		"timezone":           Schema{"type": "string", "description": "IANA time zone name"},
+		"locale":             Schema{"type": "string", "maxLength": 16, "description": "BCP 47 language tag"},
+		"notification_prefs": Schema{"type": "object", "additionalProperties": Schema{"type": "boolean"}},
+	}),
+	"Token":                object([]string{"token"}, Schema{"token": str(1, 0)}),
+	"PasswordChange":       object([]string{"current_password", "new_password"}, Schema{"current_password": str(1, 0), "new_password": passwordSchema}),
+	"PasswordConfirmation": object([]string{"password"}, Schema{"password": str(1, 0)}),
+	"Code":                 object([]string{"code"}, Schema{"code": Schema{"type": "string", "minLength": 1, "description": "TOTP code"}}),
+	"MFADisable": object(nil, Schema{
+		"password": Schema{"type": "string", "description": "Required for accounts with a local password"},
+		"code":     Schema{"type": "string", "description": "TOTP code, required for accounts without a local password"},
+	}),
+	"APIKeyCreation": object([]string{"name", "scopes"}, Schema{
+		"name": str(1, 64),
+		"scopes": arrayOf(Schema{"type": "string", "enum": []string{
+			models.ScopeTicketsRead, models.ScopeTicketsWrite, models.ScopeCommentsWrite, models.ScopeAdmin,
+		}}),
+		"expires_at": nullable(Schema{"type": "string", "format": "date-time"}),
+	}),
+	"RoleAssignment": object([]string{"role"}, Schema{"role": str(1, 64)}),
+	"TicketCreation": object([]string{"title", "description"}, Schema{
+		"title":       str(1, 255),
+		"description": str(1, 0),
+		"priority":    prioritySchema,
+		"shared":      nullable(Schema{"type": "boolean"}),
+	}),
+	"TicketUpdate": object(nil, Schema{
+		"title":       str(0, 255),
+		"description": Schema{"type": "string"},
+		"priority":    prioritySchema,
+		"status":      statusSchema,
+		"assigned_to": nullable(Schema{"type": "integer"}),
+		"shared":      nullable(Schema{"type": "boolean"}),
+	}),
+	"TicketPatch": object(nil, Schema{
+		"title":       str(1, 255),
+		"description": str(1, 0),
+		"priority":    prioritySchema,
+		"status":      statusSchema,
+		"assigned_to": nullable(Schema{"type": "integer"}),
+		"shared":      Schema{"type": "boolean"},
+	}),
+	"CommentContent": object([]string{"content"}, Schema{"content": str(1, 0)}),
+	"MFAPolicy":      object([]string{"required_roles"}, Schema{"required_roles": arrayOf(Schema{"type": "string"})}),
+	"OrganizationInput": object([]string{"name"}, Schema{
+		"name":             str(1, 128),
+		"domains":          arrayOf(Schema{"type": "string", "format": "hostname"}),
+		"share_by_default": Schema{"type": "boolean", "default": true},
+	}),
+	"Membership": object([]string{"organization_id"}, Schema{
+		"organization_id": nullable(Schema{"type": "integer"}),
+		"manager":         Schema{"type": "boolean"},
+	}),
+	"RoleCreation": object([]string{"name"}, Schema{
+		"name":        Schema{"type": "string", "pattern": "^[a-z][a-z0-9_-]{1,63}$"},
+		"description": str(0, 255),
+		"permissions": arrayOf(Schema{"type": "string", "enum": permissionNames()}),
+	}),
+	"RoleInput": object(nil, Schema{
+		"description": str(0, 255),
+		"permissions": arrayOf(Schema{"type": "string", "enum": permissionNames()}),
+	}),
+}
+
+var responseSchemas = map[string]Schema{
+	"Session": Schema{
+		"type":       "object",
+		"properties": Schema{"token": Schema{"type": "string"}, "user": ref("User")},
+		"required":   []string{"token", "user"},
+	},
+	"MFAChallenge": Schema{
+		"type": "object",
+		"properties": Schema{
+			"mfa_required":            Schema{"type": "boolean"},
+			"mfa_enrollment_required": Schema{"type": "boolean"},
+			"mfa_token":               Schema{"type": "string"},
+		},
+		"required": []string{"mfa_token"},
+	},
+	"LoginResult": Schema{"oneOf": []Schema{ref("Session"), ref("MFAChallenge")}},
+	"TOTPEnrollment": Schema{
+		"type": "object",
+		"properties": Schema{
+			"secret":           Schema{"type": "string"},
+			"provisioning_uri": Schema{"type": "string", "format": "uri"},
+		},
+	},
+	"TOTPActivation": Schema{
+		"type": "object",
+		"properties": Schema{
+			"token":          Schema{"type": "string"},
+			"user":           ref("User"),
+			"recovery_codes": arrayOf(Schema{"type": "string"}),
+		},
+	},
+	"RecoveryCodes": Schema{
+		"type":       "object",
+		"properties": Schema{"recovery_codes": arrayOf(Schema{"type": "string"})},
+	},
+	"APIKeyWithSecret": Schema{"allOf": []Schema{
+		ref("APIKey"),
+		{"type": "object", "properties": Schema{"key": Schema{"type": "string"}}, "required": []string{"key"}},
+	}},
+	"Impersonation": Schema{
+		"type": "object",
+		"properties": Schema{
+			"token":           Schema{"type": "string"},
+			"user":            ref("User"),
+			"impersonator_id": Schema{"type": "integer"},
+			"expires_at":      Schema{"type": "string", "format": "date-time"},
+		},
+	},
+	"Status": Schema{"type": "object", "properties": Schema{"status": Schema{"type": "string"}}},
+	"Health": Schema{
+		"type": "object",
+		"properties": Schema{
+			"status": Schema{"type": "string", "enum": []string{"ok", "unavailable"}},
+			"reason": Schema{"type": "string"},
+		},
+	},
+}
+
+func permissionNames() []string {
+	names := make([]string, len(models.Permissions))
+	for i, p := range models.Permissions {
+		names[i] = p.Name
+	}
+	return names
+}
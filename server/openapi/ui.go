@@ -0,0 +1,57 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// uiPolicy lets Swagger UI load its own scripts and styles but nothing from
+// elsewhere.
+const uiPolicy = "default-src 'self'; img-src 'self' data:; style-src 'self' 'unsafe-inline'; frame-ancestors 'none'"
+
+// SpecHandler serves the document as JSON.
+func SpecHandler() http.Handler {
+	body, err := json.Marshal(Spec())
+	if err != nil {
+		panic("openapi: encode document: " + err.Error())
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(body)
+	})
+}
+
+// UI serves the embedded Swagger UI, showing the document at specURL. It
+// must be mounted at prefix, which ends in a slash.
+func UI(prefix, specURL string) http.Handler {
+	// The stock initializer points at the petstore example; this one is
+	// served in its place.
+	initializer := []byte(`window.onload = function () {
+  window.ui = SwaggerUIBundle({
+    url: ` + strconv.Quote(specURL) + `,
+    dom_id: "#swagger-ui",
+    deepLinking: true,
+    validatorUrl: null,
+    presets: [SwaggerUIBundle.presets.apis, SwaggerUIStandalonePreset],
+    plugins: [SwaggerUIBundle.plugins.DownloadUrl],
+    layout: "StandaloneLayout"
+  });
+};
+`)
+	files := http.FileServerFS(swaggerFiles.FS)
+	return http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", uiPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if r.URL.Path == "swagger-initializer.js" {
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			w.Write(initializer)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+}
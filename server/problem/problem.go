@@ -0,0 +1,171 @@
+// Package problem defines the errors the API reports to its clients and
+// renders them, like any other error, as RFC 7807 problem details.
+package problem
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/lib/pq"
+
+	"helpdesk/server/logging"
+)
+
+// Kind classifies an Error and decides its HTTP status.
+type Kind int
+
+const (
+	KindInvalid Kind = iota + 1
+	KindUnauthenticated
+	KindForbidden
+	KindNotFound
+	KindConflict
+	KindTooLarge
+	KindValidation
+	KindPreconditionRequired
+	KindRateLimited
+	KindUnavailable
+)
+
+var statuses = map[Kind]int{
+	KindInvalid:              http.StatusBadRequest,
+	KindUnauthenticated:      http.StatusUnauthorized,
+	KindForbidden:            http.StatusForbidden,
+	KindNotFound:             http.StatusNotFound,
+	KindConflict:             http.StatusConflict,
+	KindTooLarge:             http.StatusRequestEntityTooLarge,
+	KindValidation:           http.StatusUnprocessableEntity,
+	KindPreconditionRequired: http.StatusPreconditionRequired,
+	KindRateLimited:          http.StatusTooManyRequests,
+	KindUnavailable:          http.StatusServiceUnavailable,
+}
+
+// Error is an error whose Detail is meant for the client. Code is a stable
+// identifier clients can act on; Fields holds the message of each invalid
+// field of a validation error.
+type Error struct {
+	Kind   Kind
+	Code   string
+	Detail string
+	Fields map[string]string
+	// Err is the cause, kept for errors.Is and the logs.
+	Err error
+}
+
+func (e *Error) Error() string { return e.Detail }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func New(kind Kind, code, detail string) *Error {
+	return &Error{Kind: kind, Code: code, Detail: detail}
+}
+
+func Invalid(detail string) *Error {
+	return New(KindInvalid, "invalid_request", detail)
+}
+
+func Unauthenticated(detail string) *Error {
+	return New(KindUnauthenticated, "unauthenticated", detail)
+}
+
+func Forbidden(detail string) *Error {
+	return New(KindForbidden, "forbidden", detail)
+}
+
+// NotFound reports that what, such as "ticket", does not exist or is not
+// visible to the caller.
+func NotFound(what string) *Error {
+	return New(KindNotFound, "not_found", what+" not found")
+}
+
+func Conflict(code, detail string) *Error {
+	return New(KindConflict, code, detail)
+}
+
+func Validation(fields map[string]string) *Error {
+	return &Error{Kind: KindValidation, Code: "validation_failed", Detail: "validation failed", Fields: fields}
+}
+
+// StatusClientClosedRequest is the status nginx uses for requests the client
+// abandoned before the response was ready.
+const StatusClientClosedRequest = 499
+
+// Details is the application/problem+json body of an error response.
+type Details struct {
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	Status    int               `json:"status"`
+	Detail    string            `json:"detail"`
+	Instance  string            `json:"instance,omitempty"`
+	Code      string            `json:"code"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+// Write answers r with err. Errors of this package are reported as they
+// are. Lookups that found no row and unique violations become 404 and 409,
+// abandoned requests 499 and queries that ran out of time 504. Anything else
+// is logged and reported as a generic 500 that does not reveal the cause.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	ctx := r.Context()
+	var e *Error
+	status := http.StatusInternalServerError
+	switch {
+	case errors.As(err, &e):
+		status = statuses[e.Kind]
+	case errors.Is(err, sql.ErrNoRows):
+		e = NotFound("resource")
+		status = http.StatusNotFound
+	case isUniqueViolation(err):
+		e = Conflict("conflict", "resource already exists")
+		status = http.StatusConflict
+	case errors.Is(err, context.Canceled) || ctx.Err() != nil:
+		slog.InfoContext(ctx, "request canceled", "route", r.Pattern, "err", err)
+		e = New(0, "canceled", "request canceled")
+		status = StatusClientClosedRequest
+	case IsTimeout(err):
+		slog.WarnContext(ctx, "request timed out", "route", r.Pattern, "err", err)
+		e = New(0, "timeout", "request timed out")
+		status = http.StatusGatewayTimeout
+	default:
+		slog.ErrorContext(ctx, "internal error", "route", r.Pattern, "err", err)
+		e = New(0, "internal_error", "internal error")
+	}
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+
+	title := http.StatusText(status)
+	if status == StatusClientClosedRequest {
+		title = "Client Closed Request"
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Details{
+		Type:      "about:blank",
+		Title:     title,
+		Status:    status,
+		Detail:    e.Detail,
+		Instance:  r.URL.Path,
+		Code:      e.Code,
+		Fields:    e.Fields,
+		RequestID: logging.RequestID(ctx),
+	})
+}
+
+// IsTimeout reports whether err is a query that ran out of time, either
+// against its context deadline or a statement timeout set in the database.
+func IsTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &pqErr) && pqErr.Code == "57014")
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,128 @@
+// Package ratelimit implements token buckets, kept in process memory or in
+// a Redis-compatible server shared by all replicas.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rate allows bursts of up to Requests requests, refilled evenly over Period.
+type Rate struct {
+	Requests int
+	Period   time.Duration
+}
+
+// Enabled reports whether the rate limits anything at all.
+func (r Rate) Enabled() bool {
+	return r.Requests > 0 && r.Period > 0
+}
+
+// Result describes the bucket of a key after a request was taken from it.
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, zero if
+	// this one was.
+	RetryAfter time.Duration
+}
+
+// Store takes one request from the bucket of key.
+type Store interface {
+	Take(ctx context.Context, key string, rate Rate) (Result, error)
+}
+
+// result derives the Result of a bucket holding tokens after a take.
+func result(allowed bool, tokens float64, rate Rate) Result {
+	perToken := rate.Period / time.Duration(rate.Requests)
+	res := Result{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(rate.Requests) - tokens) * float64(perToken)),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) * float64(perToken))
+	}
+	return res
+}
+
+// Prefix returns a store that keeps its keys apart from those of other
+// prefixes sharing s, such as other tenants.
+func Prefix(s Store, prefix string) Store {
+	return prefixed{s, prefix}
+}
+
+type prefixed struct {
+	Store
+	prefix string
+}
+
+func (p prefixed) Take(ctx context.Context, key string, rate Rate) (Result, error) {
+	return p.Store.Take(ctx, p.prefix+":"+key, rate)
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+	period time.Duration
+}
+
+// Memory keeps buckets in process memory, so each replica counts on its own.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}}
+}
+
+func (m *Memory) Take(ctx context.Context, key string, rate Rate) (Result, error) {
+	now := time.Now()
+	capacity := float64(rate.Requests)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, at: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.at).Seconds()*capacity/rate.Period.Seconds())
+	b.at = now
+	b.period = rate.Period
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return result(allowed, b.tokens, rate), nil
+}
+
+// Run periodically forgets buckets that have filled up again, which are
+// no different from buckets never used.
+func (m *Memory) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		m.mu.Lock()
+		for key, b := range m.buckets {
+			if now.Sub(b.at) >= b.period {
+				delete(m.buckets, key)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript refills and takes from the bucket in KEYS[1] atomically. It uses
+// the server's clock so that replicas with skewed clocks agree, and returns
+// whether the request is allowed and the tokens left as a string, since Lua
+// numbers are truncated to integers on the way out.
+var takeScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(state[1]) or capacity
+local at = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - at) * capacity / period)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', now)
+redis.call('PEXPIRE', KEYS[1], period)
+return {allowed, tostring(tokens)}
+`)
+
+// Redis keeps buckets in a Redis-compatible server so that limits hold
+// across replicas.
+type Redis struct {
+	Client redis.UniversalClient
+}
+
+// NewRedis connects to the server at url, such as redis://host:6379/0.
+func NewRedis(url string) (*Redis, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &Redis{Client: redis.NewClient(opts)}, nil
+}
+
+func (s *Redis) Take(ctx context.Context, key string, rate Rate) (Result, error) {
+	reply, err := takeScript.Run(ctx, s.Client, []string{"ratelimit:" + key},
+		rate.Requests, rate.Period.Milliseconds()).Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(reply) != 2 {
+		return Result{}, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	allowed, _ := reply[0].(int64)
+	left, _ := reply[1].(string)
+	tokens, err := strconv.ParseFloat(left, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("rate limit tokens %q: %w", left, err)
+	}
+	return result(allowed == 1, tokens, rate), nil
+}
+
+func (s *Redis) Close() error {
+	return s.Client.Close()
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"helpdesk/server/authn"
+	"helpdesk/server/config"
+	"helpdesk/server/handlers"
+	"helpdesk/server/jwtkeys"
+	"helpdesk/server/mail"
+	"helpdesk/server/middleware"
+	"helpdesk/server/models"
+	"helpdesk/server/ratelimit"
+	"helpdesk/server/sso"
+)
+
+// newRouter wires the stores, handlers and routes of one tenant on top of
+// that tenant's connection pool and rate limit buckets. The other arguments
+// are shared by all tenants; oidcProvider is nil when single sign-on is not
+// configured.
+func newRouter(cfg *config.Config, database *sql.DB, keys *jwtkeys.KeySet, mailer mail.Sender,
+	ips *middleware.IPResolver, oidcProvider *sso.Provider, limiter ratelimit.Store) http.Handler {
+	userStore := models.NewUserStore(database)
+	ticketStore := models.NewTicketStore(database)
+	commentStore := models.NewCommentStore(database)
+	mfaStore := models.NewMFAStore(database)
+	apiKeyStore := models.NewAPIKeyStore(database)
+	roleStore := models.NewRoleStore(database)
+	auditStore := models.NewAuditStore(database)
+	attemptStore := models.NewLoginAttemptStore(database)
+
+	throttle := authn.NewThrottle(attemptStore, userStore, auditStore, cfg)
+
+	authH := &handlers.AuthHandler{
+		Users:            userStore,
+		Throttle:         throttle,
+		IPs:              ips,
+		Resets:           models.NewPasswordResetStore(database),
+		MFA:              mfaStore,
+		Mailer:           mailer,
+		Keys:             keys,
+		AppURL:           cfg.AppURL,
+		PasswordResetTTL: cfg.PasswordResetTTL,
+		MFAChallengeTTL:  cfg.MFAChallengeTTL,
+
+		RegistrationDisabled: !cfg.PasswordLoginEnabled,
+	}
+	var authenticators authn.Chain
+	if cfg.PasswordLoginEnabled {
+		authenticators = append(authenticators, &authn.Local{Users: userStore})
+	}
+	if cfg.LDAPURL != "" {
+		authenticators = append(authenticators, authn.NewLDAP(userStore, cfg))
+	}
+	if len(authenticators) > 0 {
+		authH.Authenticator = authenticators
+	}
+	mfaH := &handlers.MFAHandler{
+		Users:    userStore,
+		MFA:      mfaStore,
+		Throttle: throttle,
+		IPs:      ips,
+		Keys:     keys,
+		Issuer:   cfg.MFAIssuer,
+	}
+	meH := &handlers.MeHandler{
+		Users:    userStore,
+		Throttle: throttle,
+		IPs:      ips,
+		Mailer:   mailer,
+		Keys:     keys,
+		AppURL:   cfg.AppURL,
+	}
+	apiKeyH := &handlers.APIKeyHandler{Keys: apiKeyStore}
+	lockoutH := &handlers.LockoutHandler{
+		Users:    userStore,
+		Attempts: attemptStore,
+		Audit:    auditStore,
+		IPs:      ips,
+	}
+	auditH := &handlers.AuditHandler{Audit: auditStore}
+	roleH := &handlers.RoleHandler{Roles: roleStore}
+	orgH := &handlers.OrganizationHandler{Orgs: models.NewOrganizationStore(database)}
+	impersonationH := &handlers.ImpersonationHandler{
+		Users: userStore,
+		Roles: roleStore,
+		Audit: auditStore,
+		Keys:  keys,
+		IPs:   ips,
+		TTL:   cfg.ImpersonationTTL,
+	}
+	userH := &handlers.UserHandler{Users: userStore, Roles: roleStore, RequireIfMatch: cfg.RequireIfMatch}
+	ticketH := &handlers.TicketHandler{
+		Tickets:        ticketStore,
+		Users:          userStore,
+		RequireIfMatch: cfg.RequireIfMatch,
+	}
+	commentH := &handlers.CommentHandler{
+		Comments:       commentStore,
+		Tickets:        ticketStore,
+		Users:          userStore,
+		RequireIfMatch: cfg.RequireIfMatch,
+	}
+
+	// Anonymous routes are limited per client address and take small bodies
+	// only; everything else is limited per user once authenticated.
+	anonLimit := middleware.RateLimit(limiter, "anon", ratelimit.Rate{
+		Requests: cfg.RateLimitAnonRequests,
+		Period:   cfg.RateLimitAnonPeriod,
+	}, ips)
+	anonBody := middleware.MaxBytes(anonBodyLimit)
+	anon := func(h http.HandlerFunc) http.Handler { return anonLimit(anonBody(h)) }
+	userLimit := middleware.RateLimit(limiter, "user", ratelimit.Rate{
+		Requests: cfg.RateLimitUserRequests,
+		Period:   cfg.RateLimitUserPeriod,
+	}, ips)
+
+	impersonation := middleware.Impersonation(auditStore, ips)
+	tokenAuth := middleware.Auth(keys, userStore, apiKeyStore, roleStore)
+	enrollAuth := middleware.MFAEnrollment(keys, userStore, roleStore)
+	authMW := func(next http.Handler) http.Handler { return tokenAuth(impersonation(userLimit(next))) }
+	enrollMW := func(next http.Handler) http.Handler { return enrollAuth(impersonation(userLimit(next))) }
+	sessionMW := func(next http.Handler) http.Handler {
+		return authMW(middleware.RequireSession(next))
+	}
+	adminScope := middleware.RequireScope(models.ScopeAdmin)
+	admin := func(perm string) func(http.Handler) http.Handler {
+		requirePerm := middleware.RequirePermission(perm)
+		return func(next http.Handler) http.Handler { return requirePerm(adminScope(next)) }
+	}
+	canDeleteComments := middleware.RequirePermission(models.PermCommentDelete)
+	ticketsRead := middleware.RequireScope(models.ScopeTicketsRead)
+	ticketsWrite := middleware.RequireScope(models.ScopeTicketsWrite)
+	commentsWrite := middleware.RequireScope(models.ScopeCommentsWrite)
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /.well-known/jwks.json", authH.JWKS)
+	mux.Handle("POST /api/auth/register", anon(authH.Register))
+	mux.Handle("POST /api/auth/login", anon(authH.Login))
+	mux.Handle("POST /api/auth/mfa", anon(authH.VerifyMFA))
+
+	if oidcProvider != nil {
+		oidcH := &handlers.OIDCHandler{
+			Provider:        oidcProvider,
+			Flows:           models.NewOIDCFlowStore(database),
+			Users:           userStore,
+			MFA:             mfaStore,
+			Keys:            keys,
+			AppURL:          cfg.AppURL,
+			RedirectURL:     cfg.OIDCRedirectURL,
+			MFAChallengeTTL: cfg.MFAChallengeTTL,
+		}
+		mux.Handle("GET /api/auth/oidc/login", anon(oidcH.Login))
+		mux.Handle("GET /api/auth/oidc/callback", anon(oidcH.Callback))
+	}
+	mux.Handle("POST /api/auth/password-reset", anon(authH.RequestPasswordReset))
+	mux.Handle("POST /api/auth/password-reset/confirm", anon(authH.ConfirmPasswordReset))
+
+	mux.Handle("GET /api/me",
+		authMW(http.HandlerFunc(meH.Get)))
+	mux.Handle("PATCH /api/me",
+		sessionMW(http.HandlerFunc(meH.Update)))
+	mux.Handle("POST /api/me/email/confirm",
+		sessionMW(http.HandlerFunc(meH.ConfirmEmail)))
+	mux.Handle("POST /api/me/password",
+		sessionMW(http.HandlerFunc(meH.ChangePassword)))
+
+	mux.Handle("POST /api/me/mfa/totp",
+		enrollMW(http.HandlerFunc(mfaH.Enroll)))
+	mux.Handle("POST /api/me/mfa/totp/verify",
+		enrollMW(http.HandlerFunc(mfaH.Verify)))
+	mux.Handle("DELETE /api/me/mfa/totp",
+		sessionMW(http.HandlerFunc(mfaH.Disable)))
+	mux.Handle("POST /api/me/mfa/recovery-codes",
+		sessionMW(http.HandlerFunc(mfaH.RegenerateRecoveryCodes)))
+
+	mux.Handle("POST /api/me/api-keys",
+		sessionMW(http.HandlerFunc(apiKeyH.Create)))
+	mux.Handle("GET /api/me/api-keys",
+		sessionMW(http.HandlerFunc(apiKeyH.List)))
+	mux.Handle("DELETE /api/me/api-keys/{id}",
+		sessionMW(http.HandlerFunc(apiKeyH.Revoke)))
+
+	mux.Handle("GET /api/users",
+		authMW(admin(models.PermUserManage)(http.HandlerFunc(userH.List))))
+	mux.Handle("GET /api/users/{id}",
+		authMW(admin(models.PermUserManage)(http.HandlerFunc(userH.Get))))
+	mux.Handle("PUT /api/users/{id}/role",
+		authMW(admin(models.PermUserManage)(http.HandlerFunc(userH.UpdateRole))))
+	mux.Handle("DELETE /api/users/{id}",
+		authMW(admin(models.PermUserManage)(http.HandlerFunc(userH.Delete))))
+
+	mux.Handle("POST /api/tickets",
+		authMW(ticketsWrite(http.HandlerFunc(ticketH.Create))))
+	mux.Handle("GET /api/tickets",
+		authMW(ticketsRead(http.HandlerFunc(ticketH.List))))
+	mux.Handle("GET /api/tickets/{id}",
+		authMW(ticketsRead(http.HandlerFunc(ticketH.Get))))
+	mux.Handle("PUT /api/tickets/{id}",
+		authMW(ticketsWrite(http.HandlerFunc(ticketH.Update))))
+	mux.Handle("PATCH /api/tickets/{id}",
+		authMW(ticketsWrite(http.HandlerFunc(ticketH.Patch))))
+	mux.Handle("DELETE /api/tickets/{id}",
+		authMW(admin(models.PermTicketDelete)(http.HandlerFunc(ticketH.Delete))))
+
+	mux.Handle("POST /api/tickets/{id}/comments",
+		authMW(commentsWrite(http.HandlerFunc(commentH.Create))))
+	mux.Handle("GET /api/tickets/{id}/comments",
+		authMW(ticketsRead(http.HandlerFunc(commentH.List))))
+	mux.Handle("PUT /api/comments/{id}",
+		authMW(commentsWrite(http.HandlerFunc(commentH.Update))))
+	mux.Handle("DELETE /api/comments/{id}",
+		authMW(canDeleteComments(commentsWrite(http.HandlerFunc(commentH.Delete)))))
+
+	mux.Handle("GET /api/admin/deleted/users",
+		authMW(admin(models.PermTrashManage)(http.HandlerFunc(userH.ListDeleted))))
+	mux.Handle("POST /api/admin/deleted/users/{id}/restore",
+		authMW(admin(models.PermTrashManage)(http.HandlerFunc(userH.Restore))))
+	mux.Handle("GET /api/admin/deleted/tickets",
+		authMW(admin(models.PermTrashManage)(http.HandlerFunc(ticketH.ListDeleted))))
+	mux.Handle("POST /api/admin/deleted/tickets/{id}/restore",
+		authMW(admin(models.PermTrashManage)(http.HandlerFunc(ticketH.Restore))))
+	mux.Handle("GET /api/admin/deleted/comments",
+		authMW(admin(models.PermTrashManage)(http.HandlerFunc(commentH.ListDeleted))))
+	mux.Handle("POST /api/admin/deleted/comments/{id}/restore",
+		authMW(admin(models.PermTrashManage)(http.HandlerFunc(commentH.Restore))))
+
+	mux.Handle("GET /api/admin/mfa-policy",
+		authMW(admin(models.PermSecurityManage)(http.HandlerFunc(mfaH.GetPolicy))))
+	mux.Handle("PUT /api/admin/mfa-policy",
+		authMW(admin(models.PermSecurityManage)(http.HandlerFunc(mfaH.UpdatePolicy))))
+
+	mux.Handle("GET /api/admin/login-locks",
+		authMW(admin(models.PermSecurityManage)(http.HandlerFunc(lockoutH.List))))
+	mux.Handle("POST /api/admin/users/{id}/unlock",
+		authMW(admin(models.PermUserManage)(http.HandlerFunc(lockoutH.UnlockUser))))
+	mux.Handle("GET /api/admin/audit-log",
+		authMW(admin(models.PermAuditView)(http.HandlerFunc(auditH.List))))
+
+	mux.Handle("GET /api/admin/organizations",
+		authMW(admin(models.PermOrgManage)(http.HandlerFunc(orgH.List))))
+	mux.Handle("POST /api/admin/organizations",
+		authMW(admin(models.PermOrgManage)(http.HandlerFunc(orgH.Create))))
+	mux.Handle("GET /api/admin/organizations/{id}",
+		authMW(admin(models.PermOrgManage)(http.HandlerFunc(orgH.Get))))
+	mux.Handle("PUT /api/admin/organizations/{id}",
+		authMW(admin(models.PermOrgManage)(http.HandlerFunc(orgH.Update))))
+	mux.Handle("DELETE /api/admin/organizations/{id}",
+		authMW(admin(models.PermOrgManage)(http.HandlerFunc(orgH.Delete))))
+	mux.Handle("PUT /api/admin/users/{id}/organization",
+		authMW(admin(models.PermOrgManage)(http.HandlerFunc(orgH.SetMembership))))
+
+	mux.Handle("POST /api/admin/impersonate/{id}",
+		sessionMW(middleware.RequirePermission(models.PermUserImpersonate)(http.HandlerFunc(impersonationH.Start))))
+
+	mux.Handle("GET /api/admin/permissions",
+		authMW(admin(models.PermRoleManage)(http.HandlerFunc(roleH.ListPermissions))))
+	mux.Handle("GET /api/admin/roles",
+		authMW(admin(models.PermRoleManage)(http.HandlerFunc(roleH.List))))
+	mux.Handle("POST /api/admin/roles",
+		authMW(admin(models.PermRoleManage)(http.HandlerFunc(roleH.Create))))
+	mux.Handle("GET /api/admin/roles/{name}",
+		authMW(admin(models.PermRoleManage)(http.HandlerFunc(roleH.Get))))
+	mux.Handle("PUT /api/admin/roles/{name}",
+		authMW(admin(models.PermRoleManage)(http.HandlerFunc(roleH.Update))))
+	mux.Handle("DELETE /api/admin/roles/{name}",
+		authMW(admin(models.PermRoleManage)(http.HandlerFunc(roleH.Delete))))
+
+	corsHeaders := []string{"Content-Type", "Authorization", "If-Match", "X-API-Key", "X-Request-ID"}
+	if cfg.TenantHeader != "" {
+		corsHeaders = append(corsHeaders, cfg.TenantHeader)
+	}
+	cors := middleware.CORS(middleware.CORSPolicy{
+		AllowedOrigins:   cfg.CORSAllowedOrigins,
+		AllowCredentials: cfg.CORSAllowCredentials,
+		AllowedHeaders:   corsHeaders,
+		ExposedHeaders:   cfg.CORSExposedHeaders,
+		MaxAge:           cfg.CORSMaxAge,
+	}, mux)
+	return middleware.MatchedRoute(cors(middleware.MaxBytes(cfg.MaxBodyBytes)(mux)))
+}
+
+// anonBodyLimit caps the bodies of the anonymous authentication routes, which
+// carry a few short fields at most.
+const anonBodyLimit = 16 << 10
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"helpdesk/server/openapi"
+)
+
+// TestOpenAPICoversRoutes fails when a route registered in router.go or
+// main.go is missing from the OpenAPI document, or the document describes a
+// route that is no longer registered.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	documented := openapi.Patterns()
+	var registered []string
+	for _, file := range []string{"router.go", "main.go"} {
+		for _, pattern := range registeredPatterns(t, file) {
+			registered = append(registered, pattern)
+			if !slices.Contains(documented, pattern) {
+				t.Errorf("%s: %q is not in the OpenAPI document", file, pattern)
+			}
+		}
+	}
+	for _, pattern := range documented {
+		if !slices.Contains(registered, pattern) {
+			t.Errorf("the OpenAPI document describes %q, which is not registered", pattern)
+		}
+	}
+}
+
+// registeredPatterns returns the literal method-qualified patterns passed to
+// Handle and HandleFunc in file. Catch-all and computed patterns are skipped.
+func registeredPatterns(t *testing.T, file string) []string {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patterns []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || (sel.Sel.Name != "Handle" && sel.Sel.Name != "HandleFunc") {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		pattern, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(pattern, " ") {
+			patterns = append(patterns, pattern)
+		}
+		return true
+	})
+	if len(patterns) == 0 {
+		t.Fatalf("%s: no routes found", file)
+	}
+	return patterns
+}
@@ -0,0 +1,138 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"helpdesk/server/authn"
+	"helpdesk/server/config"
+	"helpdesk/server/models"
+)
+
+var ErrEmailNotVerified = errors.New("identity provider did not verify the email address")
+
+// Provider runs the OpenID Connect authorization code flow with PKCE against
+// the issuer configured in OIDC_ISSUER.
+type Provider struct {
+	oauth2         oauth2.Config
+	verifier       *oidc.IDTokenVerifier
+	groupsClaim    string
+	adminGroups    []string
+	operatorGroups []string
+}
+
+// New discovers the issuer's endpoints and signing keys.
+func New(ctx context.Context, cfg *config.Config) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.OIDCIssuer)
+	if err != nil {
+		return nil, fmt.Errorf("discover %s: %w", cfg.OIDCIssuer, err)
+	}
+
+	return &Provider{
+		oauth2: oauth2.Config{
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier:       provider.Verifier(&oidc.Config{ClientID: cfg.OIDCClientID}),
+		groupsClaim:    cfg.OIDCGroupsClaim,
+		adminGroups:    cfg.OIDCAdminGroups,
+		operatorGroups: cfg.OIDCOperatorGroups,
+	}, nil
+}
+
+// AuthCodeURL returns the address of the provider's login page. The provider
+// is shared by all tenants, so each passes the callback of its own host.
+func (p *Provider) AuthCodeURL(state, nonce, codeVerifier, redirectURL string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(codeVerifier),
+		oauth2.SetAuthURLParam("redirect_uri", redirectURL))
+}
+
+// Exchange redeems the authorization code and validates the returned ID
+// token's signature, audience, expiry and nonce. redirectURL must be the one
+// the flow was started with.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce, redirectURL string) (*authn.Identity, error) {
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier),
+		oauth2.SetAuthURLParam("redirect_uri", redirectURL))
+	if err != nil {
+		return nil, fmt.Errorf("exchange code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("verify id_token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("decode id_token claims: %w", err)
+	}
+
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return nil, errors.New("id_token has no email claim")
+	}
+	// Accounts are matched by email, so an address the provider does not
+	// vouch for, including one without the claim, is not accepted.
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		return nil, ErrEmailNotVerified
+	}
+
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		username, _, _ = strings.Cut(email, "@")
+	}
+
+	return &authn.Identity{
+		Subject:  idToken.Subject,
+		Email:    email,
+		Username: username,
+		Role:     p.mapRole(claims[p.groupsClaim]),
+	}, nil
+}
+
+// MapsRoles reports whether group claims decide the user's role. Without any
+// configured groups, roles are managed locally.
+func (p *Provider) MapsRoles() bool {
+	return len(p.adminGroups) > 0 || len(p.operatorGroups) > 0
+}
+
+func (p *Provider) mapRole(claim interface{}) models.Role {
+	groups := map[string]bool{}
+	switch v := claim.(type) {
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups[s] = true
+			}
+		}
+	case string:
+		groups[v] = true
+	}
+
+	for _, g := range p.adminGroups {
+		if groups[g] {
+			return models.RoleAdmin
+		}
+	}
+	for _, g := range p.operatorGroups {
+		if groups[g] {
+			return models.RoleOperator
+		}
+	}
+	return models.RoleUser
+}
@@ -0,0 +1,214 @@
+package tenancy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"helpdesk/server/config"
+	"helpdesk/server/logging"
+	"helpdesk/server/models"
+	"helpdesk/server/problem"
+)
+
+// recheckAfter is how long a tenant is served from the cache before the
+// registry checks that it has not been deprovisioned.
+const recheckAfter = time.Minute
+
+// Opener builds the handler of a tenant, together with the connection pool
+// it runs on so that the registry can close it again.
+type Opener func(t *models.Tenant) (http.Handler, *sql.DB, error)
+
+type entry struct {
+	tenant    *models.Tenant
+	handler   http.Handler
+	db        *sql.DB
+	checkedAt time.Time
+}
+
+// Registry routes each request to the handler of its tenant, which is taken
+// from the subdomain of BaseDomain, else from Header, else Default.
+type Registry struct {
+	Tenants    *models.TenantStore
+	Open       Opener
+	BaseDomain string
+	Header     string
+	Default    string
+
+	// mu guards entries only; tenants are looked up and opened outside it,
+	// one at a time per slug, so a slow tenant does not hold up the others.
+	mu      sync.Mutex
+	entries map[string]*entry
+	loading singleflight.Group
+}
+
+type ctxKey struct{}
+
+// WithTenantID records the tenant a request was routed to.
+func WithTenantID(ctx context.Context, id int) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// TenantID returns the tenant the request in ctx was routed to, or 0.
+func TenantID(ctx context.Context) int {
+	id, _ := ctx.Value(ctxKey{}).(int)
+	return id
+}
+
+func New(tenants *models.TenantStore, open Opener, cfg *config.Config) *Registry {
+	return &Registry{
+		Tenants:    tenants,
+		Open:       open,
+		BaseDomain: strings.ToLower(cfg.TenantBaseDomain),
+		Header:     cfg.TenantHeader,
+		Default:    cfg.DefaultTenant,
+		entries:    map[string]*entry{},
+	}
+}
+
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	slug := reg.slug(r)
+	logging.AddAttrs(r.Context(), slog.String("tenant", slug))
+	e, err := reg.handler(r.Context(), slug)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, problem.New(problem.KindNotFound, "unknown_tenant", "unknown tenant"))
+		return
+	}
+	if err != nil {
+		problem.Write(w, r, fmt.Errorf("open tenant: %w", err))
+		return
+	}
+	e.handler.ServeHTTP(w, r.WithContext(WithTenantID(r.Context(), e.tenant.ID)))
+}
+
+func (reg *Registry) slug(r *http.Request) string {
+	if reg.BaseDomain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if sub, ok := strings.CutSuffix(host, "."+reg.BaseDomain); ok && !strings.Contains(sub, ".") {
+			return sub
+		}
+	}
+	if reg.Header != "" {
+		if slug := strings.ToLower(r.Header.Get(reg.Header)); slug != "" {
+			return slug
+		}
+	}
+	return reg.Default
+}
+
+func (reg *Registry) handler(ctx context.Context, slug string) (*entry, error) {
+	if !models.ValidTenantSlug(slug) {
+		return nil, sql.ErrNoRows
+	}
+	if e := reg.fresh(slug); e != nil {
+		return e, nil
+	}
+
+	// The load is shared by every request for slug that arrives meanwhile,
+	// so it must not be cut short when the first of them goes away.
+	v, err, _ := reg.loading.Do(slug, func() (any, error) {
+		return reg.load(context.WithoutCancel(ctx), slug)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*entry), nil
+}
+
+// fresh returns the cached entry of slug if it was checked recently.
+func (reg *Registry) fresh(slug string) *entry {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if e, ok := reg.entries[slug]; ok && time.Since(e.checkedAt) < recheckAfter {
+		return e
+	}
+	return nil
+}
+
+// load checks the cached entry of slug against the database, and opens the
+// tenant if there is no entry or it is stale.
+func (reg *Registry) load(ctx context.Context, slug string) (*entry, error) {
+	// Another load may have finished between the caller's check and this one.
+	if e := reg.fresh(slug); e != nil {
+		return e, nil
+	}
+	reg.mu.Lock()
+	cached := reg.entries[slug]
+	reg.mu.Unlock()
+
+	t, err := reg.Tenants.GetBySlug(ctx, slug)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if cached != nil {
+		if err == nil && t.ID == cached.tenant.ID {
+			reg.mu.Lock()
+			cached.checkedAt = time.Now()
+			reg.mu.Unlock()
+			return cached, nil
+		}
+		// Deprovisioned, or deleted and recreated under the same slug.
+		reg.swap(slug, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	h, db, err := reg.Open(t)
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{tenant: t, handler: h, db: db, checkedAt: time.Now()}
+	reg.swap(slug, e)
+	return e, nil
+}
+
+// swap replaces the entry of slug with e, or removes it if e is nil, and
+// closes the pool of the entry it replaces.
+func (reg *Registry) swap(slug string, e *entry) {
+	reg.mu.Lock()
+	old := reg.entries[slug]
+	if e != nil {
+		reg.entries[slug] = e
+	} else {
+		delete(reg.entries, slug)
+	}
+	reg.mu.Unlock()
+	if old != nil && old != e {
+		go old.db.Close()
+	}
+}
+
+// Pools returns the connection pools of the tenants opened so far by slug.
+func (reg *Registry) Pools() map[string]*sql.DB {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	pools := make(map[string]*sql.DB, len(reg.entries))
+	for slug, e := range reg.entries {
+		pools[slug] = e.db
+	}
+	return pools
+}
+
+// Close closes the connection pools of all tenants opened so far.
+func (reg *Registry) Close() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for slug, e := range reg.entries {
+		e.db.Close()
+		delete(reg.entries, slug)
+	}
+}
@@ -0,0 +1,67 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238, Appendix B, cut to six digits.
+var rfc6238 = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+// rfcSecret is the ASCII seed "12345678901234567890" of the vectors in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGenerate(t *testing.T) {
+	for _, v := range rfc6238 {
+		if got := generate([]byte("12345678901234567890"), v.unix/period); got != v.code {
+			t.Errorf("generate at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, v := range rfc6238 {
+		at := time.Unix(v.unix, 0)
+		for _, skewed := range []time.Time{at, at.Add(-period * time.Second), at.Add(period * time.Second)} {
+			step, ok := Validate(rfcSecret, v.code, skewed)
+			if !ok || step != v.unix/period {
+				t.Errorf("Validate(%s) at %d = %d, %v; want %d, true", v.code, skewed.Unix(), step, ok, v.unix/period)
+			}
+		}
+		for _, late := range []time.Time{at.Add(-2 * period * time.Second), at.Add(2 * period * time.Second)} {
+			if late.Unix() < 0 {
+				continue
+			}
+			if _, ok := Validate(rfcSecret, v.code, late); ok {
+				t.Errorf("Validate(%s) at %d accepted a code two steps away", v.code, late.Unix())
+			}
+		}
+	}
+}
+
+func TestValidateRejectsMalformed(t *testing.T) {
+	at := time.Unix(59, 0)
+	for _, tt := range []struct{ secret, code string }{
+		{rfcSecret, "94287082"},
+		{rfcSecret, "28708"},
+		{rfcSecret, ""},
+		{"not base32!", "287082"},
+	} {
+		if _, ok := Validate(tt.secret, tt.code, at); ok {
+			t.Errorf("Validate(%q, %q) = true, want false", tt.secret, tt.code)
+		}
+	}
+	if _, ok := Validate("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", at); !ok {
+		t.Error("Validate rejected a lower-case secret")
+	}
+}
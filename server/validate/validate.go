@@ -0,0 +1,245 @@
+// Package validate checks request payloads against the rules in their
+// `validate` struct tags and reports every invalid field at once.
+//
+// Rules are separated by commas:
+//
+//	required     not empty: non-blank strings, non-nil pointers, non-empty slices
+//	min=N, max=N length in characters for strings, items for slices, value for numbers
+//	email        a bare email address of at most 128 characters
+//	oneof=a b c  one of the listed values
+//	password     satisfies the password policy, see Password
+//
+// Fields that are empty and not required are not checked further.
+package validate
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	PasswordMinLength = 8
+	// PasswordMaxBytes is the most bcrypt will hash.
+	PasswordMaxBytes = 72
+)
+
+// Struct checks the struct v points to and returns a message for every
+// invalid field, keyed by its JSON name. Embedded structs are checked as if
+// their fields were declared in v.
+func Struct(v any) map[string]string {
+	fields := map[string]string{}
+	val := reflect.Indirect(reflect.ValueOf(v))
+	if val.Kind() == reflect.Struct {
+		checkStruct(val, fields)
+	}
+	return fields
+}
+
+// Var checks a single value against rules and returns the message for it,
+// or "" if it is valid.
+func Var(v any, rules string) string {
+	r, err := parse(rules)
+	if err != nil {
+		panic(err)
+	}
+	return r.check(reflect.ValueOf(v))
+}
+
+// Email reports whether s is a bare email address that fits the email
+// columns.
+func Email(s string) bool {
+	addr, err := netmail.ParseAddress(s)
+	return err == nil && addr.Address == s && len(s) <= 128
+}
+
+// Password reports whether s satisfies the password policy: between
+// PasswordMinLength characters and PasswordMaxBytes bytes, with at least one
+// letter and one digit or symbol.
+func Password(s string) bool {
+	if utf8.RuneCountInString(s) < PasswordMinLength || len(s) > PasswordMaxBytes {
+		return false
+	}
+	var letter, other bool
+	for _, c := range s {
+		if unicode.IsLetter(c) {
+			letter = true
+		} else if !unicode.IsSpace(c) {
+			other = true
+		}
+	}
+	return letter && other
+}
+
+func checkStruct(val reflect.Value, fields map[string]string) {
+	for _, f := range cachedFields(val.Type()) {
+		fv := val.FieldByIndex(f.index)
+		if f.embedded {
+			checkStruct(fv, fields)
+			continue
+		}
+		if msg := f.rules.check(fv); msg != "" {
+			if _, seen := fields[f.name]; !seen {
+				fields[f.name] = msg
+			}
+		}
+	}
+}
+
+type field struct {
+	index    []int
+	name     string
+	embedded bool
+	rules    rules
+}
+
+var cache sync.Map // reflect.Type -> []field
+
+// cachedFields parses the tags of t once. A malformed tag is a programming
+// error and panics.
+func cachedFields(t reflect.Type) []field {
+	if fs, ok := cache.Load(t); ok {
+		return fs.([]field)
+	}
+	var fs []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			fs = append(fs, field{index: sf.Index, embedded: true})
+			continue
+		}
+		tag, ok := sf.Tag.Lookup("validate")
+		if !ok || !sf.IsExported() {
+			continue
+		}
+		r, err := parse(tag)
+		if err != nil {
+			panic(fmt.Sprintf("validate: %s.%s: %v", t, sf.Name, err))
+		}
+		fs = append(fs, field{index: sf.Index, name: jsonName(sf), rules: r})
+	}
+	cache.Store(t, fs)
+	return fs
+}
+
+func jsonName(sf reflect.StructField) string {
+	name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return sf.Name
+	}
+	return name
+}
+
+type rules struct {
+	required bool
+	min, max int
+	hasMin   bool
+	hasMax   bool
+	email    bool
+	password bool
+	oneof    []string
+}
+
+func parse(tag string) (rules, error) {
+	var r rules
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch name {
+		case "required":
+			r.required = true
+		case "min", "max":
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return r, fmt.Errorf("invalid %s %q", name, arg)
+			}
+			if name == "min" {
+				r.min, r.hasMin = n, true
+			} else {
+				r.max, r.hasMax = n, true
+			}
+		case "email":
+			r.email = true
+		case "password":
+			r.password = true
+		case "oneof":
+			r.oneof = strings.Fields(arg)
+			if len(r.oneof) == 0 {
+				return r, fmt.Errorf("oneof without values")
+			}
+		case "":
+		default:
+			return r, fmt.Errorf("unknown rule %q", name)
+		}
+	}
+	return r, nil
+}
+
+func (r rules) check(v reflect.Value) string {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			if r.required {
+				return "is required"
+			}
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		if strings.TrimSpace(s) == "" {
+			if r.required {
+				return "is required"
+			}
+			return ""
+		}
+		if msg := r.bounds(utf8.RuneCountInString(s), "characters"); msg != "" {
+			return msg
+		}
+		if r.email && !Email(s) {
+			return "must be a valid email address"
+		}
+		if r.password && !Password(s) {
+			return fmt.Sprintf("must be at least %d characters, at most %d bytes, and contain a letter and a digit or symbol", PasswordMinLength, PasswordMaxBytes)
+		}
+		if len(r.oneof) > 0 && !slices.Contains(r.oneof, s) {
+			return "must be one of " + strings.Join(r.oneof, ", ")
+		}
+	case reflect.Slice, reflect.Map:
+		if v.Len() == 0 {
+			if r.required {
+				return "is required"
+			}
+			return ""
+		}
+		return r.bounds(v.Len(), "items")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return r.bounds(int(v.Int()), "")
+	}
+	return ""
+}
+
+// bounds checks n against min and max; unit names what n counts, if anything.
+func (r rules) bounds(n int, unit string) string {
+	if (!r.hasMin || n >= r.min) && (!r.hasMax || n <= r.max) {
+		return ""
+	}
+	if unit != "" {
+		unit = " " + unit
+	}
+	switch {
+	case r.hasMin && r.hasMax:
+		return fmt.Sprintf("must be between %d and %d%s", r.min, r.max, unit)
+	case r.hasMin:
+		return fmt.Sprintf("must be at least %d%s", r.min, unit)
+	default:
+		return fmt.Sprintf("must be at most %d%s", r.max, unit)
+	}
+}
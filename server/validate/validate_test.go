@@ -0,0 +1,142 @@
+package validate
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestVar(t *testing.T) {
+	name := "x"
+	tests := []struct {
+		name  string
+		value any
+		rules string
+		want  string
+	}{
+		{"required string", "a", "required", ""},
+		{"required empty string", "", "required", "is required"},
+		{"required blank string", " \t", "required", "is required"},
+		{"required nil pointer", (*string)(nil), "required", "is required"},
+		{"required pointer", &name, "required", ""},
+		{"required empty slice", []string{}, "required", "is required"},
+		{"optional empty string", "", "min=3,email", ""},
+		{"optional nil pointer", (*string)(nil), "min=3", ""},
+
+		{"min string", "ab", "min=3", "must be at least 3 characters"},
+		{"min counts characters", "äöü", "min=3", ""},
+		{"max string", "abcd", "max=3", "must be at most 3 characters"},
+		{"max counts characters", "äöü", "max=3", ""},
+		{"min and max", "a", "min=2,max=4", "must be between 2 and 4 characters"},
+		{"min slice", []string{"a"}, "min=2", "must be at least 2 items"},
+		{"max slice", []string{"a", "b"}, "max=1", "must be at most 1 items"},
+		{"min number", 0, "min=1", "must be at least 1"},
+		{"max number", 101, "max=100", "must be at most 100"},
+		{"number in range", 50, "min=1,max=100", ""},
+		{"pointer to string", &name, "min=2", "must be at least 2 characters"},
+
+		{"email", "user@example.com", "email", ""},
+		{"email with name", "User <user@example.com>", "email", "must be a valid email address"},
+		{"email without domain", "user@", "email", "must be a valid email address"},
+		{"email too long", strings.Repeat("a", 117) + "@example.com", "email", "must be a valid email address"},
+
+		{"oneof", "medium", "oneof=low medium high", ""},
+		{"oneof unknown", "urgent", "oneof=low medium high", "must be one of low, medium, high"},
+		{"oneof is case sensitive", "Low", "oneof=low medium high", "must be one of low, medium, high"},
+		{"oneof optional empty", "", "oneof=low medium high", ""},
+
+		{"password", "secret12", "password", ""},
+		{"password with symbol", "secret!!", "password", ""},
+		{"password too short", "secr1", "password", "must be at least 8 characters, at most 72 bytes, and contain a letter and a digit or symbol"},
+		{"password without letter", "12345678", "password", "must be at least 8 characters, at most 72 bytes, and contain a letter and a digit or symbol"},
+		{"password letters only", "abcdefgh", "password", "must be at least 8 characters, at most 72 bytes, and contain a letter and a digit or symbol"},
+		{"password too long", strings.Repeat("a1", 37), "password", "must be at least 8 characters, at most 72 bytes, and contain a letter and a digit or symbol"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Var(tt.value, tt.rules); got != tt.want {
+				t.Errorf("Var(%v, %q) = %q, want %q", tt.value, tt.rules, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVarPanicsOnMalformedRules(t *testing.T) {
+	for _, rules := range []string{"min=x", "oneof=", "unknown"} {
+		t.Run(rules, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Var with rules %q did not panic", rules)
+				}
+			}()
+			Var("a", rules)
+		})
+	}
+}
+
+type pagination struct {
+	Limit int `json:"limit" validate:"max=100"`
+}
+
+type search struct {
+	Query    string   `json:"q" validate:"required,max=10"`
+	Status   string   `json:"status" validate:"oneof=open closed"`
+	Tags     []string `json:"tags" validate:"max=2"`
+	Internal string   `validate:"required"`
+	Ignored  string   `json:"ignored"`
+	pagination
+}
+
+func TestStruct(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  map[string]string
+	}{
+		{
+			name:  "valid",
+			value: &search{Query: "printer", Status: "open", Internal: "x", pagination: pagination{Limit: 10}},
+			want:  map[string]string{},
+		},
+		{
+			name:  "every field invalid",
+			value: &search{Status: "pending", Tags: []string{"a", "b", "c"}, pagination: pagination{Limit: 101}},
+			want: map[string]string{
+				"q":        "is required",
+				"status":   "must be one of open, closed",
+				"tags":     "must be at most 2 items",
+				"Internal": "is required",
+				"limit":    "must be at most 100",
+			},
+		},
+		{
+			name:  "struct value",
+			value: search{Query: "printer", Internal: "x"},
+			want:  map[string]string{},
+		},
+		{
+			name:  "not a struct",
+			value: "printer",
+			want:  map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Struct(tt.value); !maps.Equal(got, tt.want) {
+				t.Errorf("Struct = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStructPanicsOnMalformedTag(t *testing.T) {
+	type malformed struct {
+		Name string `json:"name" validate:"max=ten"`
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Struct with a malformed tag did not panic")
+		}
+	}()
+	Struct(&malformed{})
+}